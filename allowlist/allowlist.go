@@ -0,0 +1,212 @@
+package allowlist
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Allowlist holds the address ranges GitHub sends webhook deliveries from,
+// and the proxies in front of webhookproxy whose X-Forwarded-For hops are
+// trusted. GitHub's ranges are checked once they are loaded, or from the
+// start if they are required. It is safe for concurrent use.
+type Allowlist struct {
+	mu       sync.RWMutex
+	ranges   []*net.IPNet
+	loaded   bool
+	required bool
+	trusted  []*net.IPNet
+}
+
+// New creates an allowlist trusting the X-Forwarded-For hops added by
+// proxies in trusted.
+func New(trusted []*net.IPNet) *Allowlist {
+	return &Allowlist{trusted: trusted}
+}
+
+// ParseCIDRs parses a list of ranges in CIDR notation.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ranges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// Set replaces GitHub's ranges.
+func (a *Allowlist) Set(ranges []*net.IPNet) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.ranges = ranges
+	a.loaded = true
+}
+
+// Loaded reports whether GitHub's ranges have been loaded.
+func (a *Allowlist) Loaded() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.loaded
+}
+
+// Require makes GitHub's ranges checked before they are loaded, so no
+// address is allowed until they are, rather than every address.
+func (a *Allowlist) Require() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.required = true
+}
+
+// Checked reports whether addresses are checked against GitHub's ranges,
+// because they are loaded or required.
+func (a *Allowlist) Checked() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.loaded || a.required
+}
+
+// Allowed reports whether ip is in GitHub's ranges.
+func (a *Allowlist) Allowed(ip net.IP) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return Contains(a.ranges, ip)
+}
+
+// Contains reports whether ip is in one of ranges.
+func Contains(ranges []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ranges {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// meta is the part of GitHub's meta API response listing the hook ranges.
+type meta struct {
+	Hooks []string `json:"hooks"`
+}
+
+// parse reads ranges from GitHub's meta API response, or from a list of
+// ranges with one per line. Empty lines and lines starting with # are
+// skipped in lists.
+func parse(b []byte) ([]*net.IPNet, error) {
+	if trimmed := bytes.TrimSpace(b); len(trimmed) > 0 && trimmed[0] == '{' {
+		var m meta
+		if err := json.Unmarshal(trimmed, &m); err != nil {
+			return nil, err
+		}
+		if len(m.Hooks) == 0 {
+			return nil, fmt.Errorf("no hooks ranges in meta")
+		}
+		return ParseCIDRs(m.Hooks)
+	}
+
+	var cidrs []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			cidrs = append(cidrs, line)
+		}
+	}
+	return ParseCIDRs(cidrs)
+}
+
+// LoadFile loads GitHub's ranges from a file holding GitHub's meta API
+// response or a list of ranges.
+func (a *Allowlist) LoadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	ranges, err := parse(b)
+	if err != nil {
+		return fmt.Errorf("invalid ranges in %v: %v", path, err)
+	}
+	a.Set(ranges)
+	return nil
+}
+
+// LoadMeta loads GitHub's ranges from the meta API at url, like
+// https://api.github.com/meta.
+func (a *Allowlist) LoadMeta(client *http.Client, url string) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %v from %v", res.Status, url)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	ranges, err := parse(b)
+	if err != nil {
+		return fmt.Errorf("invalid ranges from %v: %v", url, err)
+	}
+	a.Set(ranges)
+	return nil
+}
+
+// Refresh reloads GitHub's ranges from the meta API at url on every interval
+// until stop is closed. The ranges loaded last are kept if a reload fails.
+func (a *Allowlist) Refresh(client *http.Client, url string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := a.LoadMeta(client, url); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to refresh hook ranges: %v\n", err)
+		}
+	}
+}
+
+// ClientIP returns the address r was sent from. X-Forwarded-For hops are
+// followed from the right as long as they were added by a trusted proxy.
+func (a *Allowlist) ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	var hops []string
+	for _, header := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	for i := len(hops) - 1; i >= 0 && Contains(a.trusted, ip); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
@@ -0,0 +1,118 @@
+package allowlist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	ranges, err := ParseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ranges
+}
+
+func TestAllowlist_LoadMeta(t *testing.T) {
+	meta := `{"verifiable_password_authentication": true, "hooks": ["192.30.252.0/22", "185.199.108.0/22", "2a0a:a440::/29"], "web": ["140.82.112.0/20"]}`
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, meta)
+	}))
+	defer ts.Close()
+
+	a := New(nil)
+	if a.Loaded() {
+		t.Errorf("Loaded() = true before loading")
+	}
+
+	if err := a.LoadMeta(http.DefaultClient, ts.URL); err != nil {
+		t.Fatalf("LoadMeta() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"192.30.252.1", true},
+		{"185.199.111.255", true},
+		{"2a0a:a440::1", true},
+		{"140.82.112.1", false},
+		{"10.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := a.Allowed(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("Allowed(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	t.Run("Failed reload should keep the loaded ranges", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		if err := a.LoadMeta(http.DefaultClient, ts.URL); err == nil {
+			t.Errorf("LoadMeta() should fail")
+		}
+		if !a.Allowed(net.ParseIP("192.30.252.1")) {
+			t.Errorf("Allowed() = false, want the loaded ranges kept")
+		}
+	})
+}
+
+func TestAllowlist_LoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhookproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hooks.txt")
+	ioutil.WriteFile(path, []byte("# GitHub hooks\n192.30.252.0/22\n\n185.199.108.0/22\n"), 0600)
+
+	a := New(nil)
+	if err := a.LoadFile(path); err != nil {
+		t.Fatalf("LoadFile() error = %v", err)
+	}
+	if !a.Loaded() || !a.Allowed(net.ParseIP("185.199.108.1")) || a.Allowed(net.ParseIP("10.0.0.1")) {
+		t.Errorf("LoadFile() did not load the ranges in the file")
+	}
+
+	ioutil.WriteFile(path, []byte("192.30.252.0/33\n"), 0600)
+	if err := a.LoadFile(path); err == nil {
+		t.Errorf("LoadFile() should fail for invalid ranges")
+	}
+}
+
+func TestAllowlist_ClientIP(t *testing.T) {
+	a := New(mustParseCIDRs(t, "10.0.0.0/8"))
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct", "192.30.252.1:43210", nil, "192.30.252.1"},
+		{"untrusted proxy", "203.0.113.1:43210", []string{"192.30.252.1"}, "203.0.113.1"},
+		{"trusted proxy", "10.0.0.1:43210", []string{"192.30.252.1"}, "192.30.252.1"},
+		{"trusted proxies", "10.0.0.1:43210", []string{"192.30.252.1, 10.0.0.2"}, "192.30.252.1"},
+		{"spoofed hop", "10.0.0.1:43210", []string{"192.30.252.1, 203.0.113.1"}, "203.0.113.1"},
+		{"several headers", "10.0.0.1:43210", []string{"203.0.113.1", "192.30.252.1"}, "192.30.252.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/hooks/my-hook", nil)
+			r.RemoteAddr = tt.remoteAddr
+			r.Header["X-Forwarded-For"] = tt.forwardedFor
+
+			if got := a.ClientIP(r); got.String() != tt.want {
+				t.Errorf("ClientIP() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
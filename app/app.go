@@ -7,19 +7,128 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"fmt"
 	"os"
+	"time"
 	"github.com/navikt/webhookproxy/errors"
+	"github.com/navikt/webhookproxy/auth"
+	"github.com/navikt/webhookproxy/delivery"
+	"github.com/navikt/webhookproxy/ratelimit"
+	"github.com/navikt/webhookproxy/replay"
+	"github.com/navikt/webhookproxy/allowlist"
+	"github.com/navikt/webhookproxy/webhook"
 )
 
 type server struct {
-	router *mux.Router
+	router        *mux.Router
+	authenticator auth.Authenticator
+	queue         delivery.Queue
+	deadLetters   delivery.DeadLetters
+	history       *delivery.History
+	dispatcher    *delivery.Dispatcher
+	replays       replay.Cache
+	replayTTL     time.Duration
+	sources       *allowlist.Allowlist
+	maxBodySize   int64
+	limiter       *ratelimit.Limiter
+	rateLimits    ratelimit.Defaults
 }
 
-func NewServer() *server {
-	return &server{mux.NewRouter()}
+type Option func(*server)
+
+// WithAuthenticator protects the management API with bearer tokens accepted
+// by authenticator. Without it the management API is open to anyone.
+func WithAuthenticator(authenticator auth.Authenticator) Option {
+	return func(s *server) {
+		s.authenticator = authenticator
+	}
+}
+
+// WithQueue keeps deliveries to async webhooks in queue. Without it they are
+// kept in memory and lost on restart.
+func WithQueue(queue delivery.Queue) Option {
+	return func(s *server) {
+		s.queue = queue
+	}
+}
+
+// WithDeadLetters keeps deliveries that could not be forwarded in
+// deadLetters. Without it they are kept in memory and lost on restart.
+func WithDeadLetters(deadLetters delivery.DeadLetters) Option {
+	return func(s *server) {
+		s.deadLetters = deadLetters
+	}
+}
+
+// WithHistory records forwarded deliveries in history. Without it the last
+// 100 deliveries of the last day are kept per webhook.
+func WithHistory(history *delivery.History) Option {
+	return func(s *server) {
+		s.history = history
+	}
+}
+
+// WithReplayCache remembers received deliveries in replays to refuse them if
+// they are received again. Without it they are remembered in memory.
+func WithReplayCache(replays replay.Cache) Option {
+	return func(s *server) {
+		s.replays = replays
+	}
+}
+
+// WithReplayTTL sets how long received deliveries are remembered, a day
+// unless given.
+func WithReplayTTL(ttl time.Duration) Option {
+	return func(s *server) {
+		s.replayTTL = ttl
+	}
+}
+
+// WithSourceAllowlist accepts GitHub deliveries only from the hook ranges in
+// sources, and trusts the X-Forwarded-For hops of its proxies. Without it
+// deliveries are only checked against the source ranges of their webhook.
+func WithSourceAllowlist(sources *allowlist.Allowlist) Option {
+	return func(s *server) {
+		s.sources = sources
+	}
+}
+
+// WithMaxBodySize refuses requests with bodies larger than maxBytes, 5 MiB
+// unless given.
+func WithMaxBodySize(maxBytes int64) Option {
+	return func(s *server) {
+		s.maxBodySize = maxBytes
+	}
+}
+
+// WithRateLimits limits how often deliveries are forwarded for the whole
+// proxy, every team and every webhook without a limit of its own. Without it
+// only webhooks with their own limit are limited.
+func WithRateLimits(defaults ratelimit.Defaults) Option {
+	return func(s *server) {
+		s.rateLimits = defaults
+	}
+}
+
+func NewServer(options ...Option) *server {
+	s := &server{
+		router: mux.NewRouter(),
+		queue: delivery.NewMemoryQueue(),
+		deadLetters: delivery.NewMemoryDeadLetters(),
+		history: delivery.NewHistory(100, 24 * time.Hour),
+		replays: replay.NewMemoryCache(),
+		replayTTL: 24 * time.Hour,
+		sources: allowlist.New(nil),
+		maxBodySize: 5 << 20,
+		limiter: ratelimit.NewLimiter(),
+	}
+	for _, option := range options {
+		option(s)
+	}
+	s.dispatcher = delivery.NewDispatcher(s.queue, s.deadLetters, s.history, delivery.NewClients(webhook.DestinationPolicy()))
+	return s
 }
 
 func (s *server) Initialize() {
-	s.router.Use(middlewares.LogHandler, middlewares.ReadRequestBodyHandler)
+	s.router.Use(middlewares.LogHandler)
 
 	s.router.Methods(http.MethodGet).Path("/metrics").
 		Handler(promhttp.Handler())
@@ -29,29 +138,66 @@ func (s *server) Initialize() {
 		Handler(appHandlerFunc(s.isReady))
 
 	s.router.Methods(http.MethodGet).Path("/hooks").
-		Handler(appHandlerFunc(s.listWebhooks))
+		Handler(s.management(appHandlerFunc(s.listWebhooks)))
 	s.router.Methods(http.MethodPost).Path("/hooks").
-		Handler(appHandlerFunc(s.newWebhook))
+		Handler(s.management(s.readBody(appHandlerFunc(s.newWebhook))))
+
+	s.router.Methods(http.MethodGet).Path("/hooks/{id}").
+		Handler(s.management(middlewares.MustHaveWebhook(middlewares.MustManageWebhook(appHandlerFunc(s.listWebhook))))).
+		Name("webhook")
+
+	s.router.Methods(http.MethodDelete).Path("/hooks/{id}").
+		Handler(s.management(middlewares.MustHaveWebhook(middlewares.MustManageWebhook(appHandlerFunc(s.deleteWebhook)))))
+
+	s.router.Methods(http.MethodGet).Path("/hooks/{id}/deliveries").
+		Handler(s.management(middlewares.MustHaveWebhook(middlewares.MustManageWebhook(appHandlerFunc(s.listDeliveries)))))
+
+	s.router.Methods(http.MethodGet).Path("/hooks/{id}/deadletters").
+		Handler(s.management(middlewares.MustHaveWebhook(middlewares.MustManageWebhook(appHandlerFunc(s.listDeadLetters)))))
+	s.router.Methods(http.MethodPost).Path("/hooks/{id}/deadletters/{deliveryId}/redeliver").
+		Handler(s.management(middlewares.MustHaveWebhook(middlewares.MustManageWebhook(appHandlerFunc(s.redeliverDeadLetter)))))
+	s.router.Methods(http.MethodDelete).Path("/hooks/{id}/deadletters/{deliveryId}").
+		Handler(s.management(middlewares.MustHaveWebhook(middlewares.MustManageWebhook(appHandlerFunc(s.deleteDeadLetter)))))
+	s.router.Methods(http.MethodPost).Path("/hooks/{id}/transform/preview").
+		Handler(s.management(middlewares.MustHaveWebhook(middlewares.MustManageWebhook(s.readBody(appHandlerFunc(s.previewTransform))))))
 
 	hookRouter := s.router.PathPrefix("/hooks").Subrouter()
-	hookRouter.Use(middlewares.MustHaveWebhook)
+	hookRouter.Use(middlewares.MustHaveWebhook, mux.MiddlewareFunc(middlewares.MustComeFromAllowedSource(s.sources)))
 
 	hookRouter.Methods(http.MethodPost).Path("/{id}").
 		Headers("X-Github-Event", "ping").
-		Handler(middlewares.MustHaveValidSignature(appHandlerFunc(s.handlePingEvent)))
+		Handler(s.readBody(middlewares.MustHaveValidSignature(appHandlerFunc(s.handlePingEvent))))
 
 	hookRouter.Methods(http.MethodPost).Path("/{id}").
-		Handler(middlewares.MustHaveValidSignature(appHandlerFunc(s.proxyHook)))
+		Handler(s.readBody(middlewares.MustHaveValidSignature(appHandlerFunc(s.proxyHook))))
+}
 
-	hookRouter.Methods(http.MethodGet).Path("/{id}").
-		Handler(appHandlerFunc(s.listWebhook)).
-		Name("webhook")
+// Forget drops the delivery history and circuits of a deleted webhook, so a
+// webhook later created with the same id does not inherit them.
+func (s *server) Forget(wh *webhook.Webhook) {
+	s.history.Remove(wh.Id)
+	s.dispatcher.RemoveCircuits(wh)
+}
 
-	hookRouter.Methods(http.MethodDelete).Path("/{id}").
-		Handler(appHandlerFunc(s.deleteWebhook))
+// management protects a management API handler, authenticating the caller
+// before anything else is done with the request.
+func (s *server) management(h http.Handler) http.Handler {
+	if s.authenticator == nil {
+		return h
+	}
+	return middlewares.MustBeAuthenticated(s.authenticator)(h)
+}
+
+// readBody reads the request body into the request context for handlers that
+// need it. It is only read once the request has been let through, so
+// unauthenticated and unknown requests are refused without buffering them.
+func (s *server) readBody(h http.Handler) http.Handler {
+	return middlewares.ReadRequestBodyHandler(s.maxBodySize)(h)
 }
 
 func (s *server) Run(listenAddr string) {
+	go s.dispatcher.Run(nil)
+
 	httpServer := &http.Server{Addr: listenAddr, Handler: s.router}
 	panic(httpServer.ListenAndServe())
 }
@@ -0,0 +1,76 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Test_server_concurrentRequests hammers the registry from many goroutines at
+// once. It is meant to be run with the race detector: go test -race ./...
+func Test_server_concurrentRequests(t *testing.T) {
+	s := NewServer()
+	s.Initialize()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, client\n")
+	}))
+	defer ts.Close()
+	defer clearWebhooks()
+
+	proxied := newRandomWebhook(ts.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				r, _ := http.NewRequest("POST", "/hooks/"+proxied.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+				r.Header.Set("X-Github-Event", "push")
+				r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+				w := executeRequest(s, r)
+				checkResponseCode(t, http.StatusOK, w.Code)
+
+				r, _ = http.NewRequest("GET", "/hooks/"+proxied.Id, strings.NewReader(""))
+				w = executeRequest(s, r)
+				checkResponseCode(t, http.StatusOK, w.Code)
+			}
+		}()
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				r, _ := http.NewRequest("POST", "/hooks", strings.NewReader(fmt.Sprintf(`{
+	"name": "concurrent-webhook-%d",
+	"team": "my-team-name",
+	"url": "http://forward.tld/my-webhook",
+	"secret": "Zm9vYmFy"
+}`, i%2)))
+				executeRequest(s, r)
+
+				r, _ = http.NewRequest("GET", "/hooks", strings.NewReader(""))
+				w := executeRequest(s, r)
+				checkResponseCode(t, http.StatusOK, w.Code)
+			}
+		}(i)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				wh := newRandomWebhook("http://forward.tld/my-hook")
+				if wh == nil {
+					continue
+				}
+				r, _ := http.NewRequest("DELETE", "/hooks/"+wh.Id, strings.NewReader(""))
+				w := executeRequest(s, r)
+				checkResponseCode(t, http.StatusNoContent, w.Code)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
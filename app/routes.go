@@ -6,12 +6,19 @@ import (
 	"github.com/navikt/webhookproxy/webhook"
 	"github.com/navikt/webhookproxy/events"
 	"time"
-	"bytes"
 	"github.com/navikt/webhookproxy/context"
 	"encoding/json"
-	"io/ioutil"
 	"net/url"
 	"github.com/navikt/webhookproxy/errors"
+	"github.com/navikt/webhookproxy/delivery"
+	"github.com/navikt/webhookproxy/replay"
+	"github.com/navikt/webhookproxy/rules"
+	"github.com/navikt/webhookproxy/transform"
+	"github.com/gorilla/mux"
+	"math"
+	"os"
+	"strconv"
+	"sync"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -22,15 +29,27 @@ var (
 	webhooksCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{Name: "webhooks_count", Help: "number of webhooks"},
 	)
+	webhookFilteredEventCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "webhooks_filtered_events", Help: "number of deliveries not forwarded because of the event filter per hook and event"}, []string{"hook", "event"},
+	)
+	webhookDroppedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "webhooks_dropped_deliveries", Help: "number of deliveries dropped by a routing rule per hook"}, []string{"hook"},
+	)
+	webhookReplayCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "webhooks_replayed_deliveries", Help: "number of deliveries refused as replays per hook"}, []string{"hook"},
+	)
+	webhookThrottledCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "webhooks_throttled_deliveries", Help: "number of deliveries over a rate limit per hook, limiting scope and whether they were refused or queued"}, []string{"hook", "scope", "action"},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(webhookProxyRequestCount)
 	prometheus.MustRegister(webhooksCounter)
-}
-
-var proxyClient = &http.Client{
-	Timeout: time.Second * 5,
+	prometheus.MustRegister(webhookFilteredEventCount)
+	prometheus.MustRegister(webhookDroppedCount)
+	prometheus.MustRegister(webhookReplayCount)
+	prometheus.MustRegister(webhookThrottledCount)
 }
 
 func (s *server) handlePingEvent(w http.ResponseWriter, r *http.Request) error {
@@ -53,25 +72,299 @@ func (s *server) handlePingEvent(w http.ResponseWriter, r *http.Request) error {
 }
 
 func (s *server) proxyHook(w http.ResponseWriter, r *http.Request) error {
-	w.WriteHeader(http.StatusOK)
 	wh := context.WebhookFromContext(r.Context())
+	body := context.RequestBodyFromContext(r.Context())
+
+	// deliveries without an id from the sender cannot be told apart, and
+	// are not checked
+	guid := events.Guid(wh.Provider, r.Header)
+	eventType := events.Type(wh.Provider, r.Header)
+	if guid != "" {
+		now := time.Now()
+		first, err := s.replays.Add(replay.Key(wh.Id, guid), now, now.Add(s.replayTTL))
+		if err != nil {
+			return errors.NewAppError(http.StatusInternalServerError, "failed to check for replays: " + err.Error())
+		}
+		if !first {
+			webhookReplayCount.With(prometheus.Labels{"hook": wh.Id}).Inc()
+			fmt.Fprintf(os.Stderr, "Refusing delivery %v to %v, it was already received\n", guid, wh.Id)
+			message := "delivery " + guid + " was already received"
+			s.history.AddUnforwarded(wh.Id, guid, eventType, delivery.OutcomeReplayed, http.StatusConflict, message)
+			return errors.NewAppError(http.StatusConflict, message)
+		}
+	}
+
+	if !events.Allowed(wh.Events, eventType, body) {
+		webhookFilteredEventCount.With(prometheus.Labels{"hook": wh.Id, "event": eventType}).Inc()
+		fmt.Printf("Not forwarding %v event to %v, it is filtered\n", eventType, wh.Id)
+		message := "event " + eventType + " is filtered and not forwarded"
+		s.history.AddUnforwarded(wh.Id, guid, eventType, delivery.OutcomeFiltered, http.StatusAccepted, message)
+		return respondWithMessage(w, http.StatusAccepted, message)
+	}
+
+	targets := wh.AllTargets()
+	if i := rules.Match(wh.Rules, body); i >= 0 {
+		if wh.Rules[i].Drop {
+			webhookDroppedCount.With(prometheus.Labels{"hook": wh.Id}).Inc()
+			fmt.Printf("Not forwarding delivery to %v, it is dropped by rule %d\n", wh.Id, i+1)
+			message := fmt.Sprintf("dropped by rule %d", i+1)
+			s.history.AddUnforwarded(wh.Id, guid, eventType, delivery.OutcomeDropped, http.StatusAccepted, message)
+			return respondWithMessage(w, http.StatusAccepted, message)
+		}
+		targets = wh.TargetsNamed(wh.Rules[i].Targets)
+	}
+
+	// deliveries to async targets only can wait in the queue for the
+	// rate limits, others are refused
+	maxWait := time.Duration(0)
+	if allAsync(targets) {
+		maxWait = maxQueueWait
+	}
+	wait, limited, ok := s.limiter.Reserve(s.rateLimits.Scopes(wh.Id, wh.Team, wh.RateLimit), time.Now(), maxWait)
+	if !ok {
+		webhookThrottledCount.With(prometheus.Labels{"hook": wh.Id, "scope": limited.Name, "action": "refused"}).Inc()
+		fmt.Fprintf(os.Stderr, "Refusing delivery to %v, the %v rate limit is exceeded\n", wh.Id, limited.Name)
+		s.forgetDelivery(wh, guid)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		message := "rate limit of " + limited.Name + " exceeded"
+		s.history.AddUnforwarded(wh.Id, guid, eventType, delivery.OutcomeRateLimited, http.StatusTooManyRequests, message)
+		return errors.NewAppError(http.StatusTooManyRequests, message)
+	}
+	if wait > 0 {
+		webhookThrottledCount.With(prometheus.Labels{"hook": wh.Id, "scope": limited.Name, "action": "queued"}).Inc()
+		fmt.Printf("Delaying delivery to %v by %v, the %v rate limit is exceeded\n", wh.Id, wait, limited.Name)
+	}
+
+	payload, err := transform.Apply(wh.Transform, transform.Data{Event: eventType, Delivery: guid, Body: string(body)})
+	if err != nil {
+		s.forgetDelivery(wh, guid)
+		return errors.NewAppError(http.StatusInternalServerError, "failed to transform payload: " + err.Error())
+	}
 
 	webhookProxyRequestCount.With(prometheus.Labels{"hook": wh.Id}).Inc()
 
-	fmt.Printf("Forwarding request to %v\n", wh.Url)
-	res, err := proxyClient.Post(wh.Url, "application/json", bytes.NewReader(context.RequestBodyFromContext(r.Context())))
+	outcomes := make([]*targetOutcome, len(targets))
+
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target webhook.Target) {
+			defer wg.Done()
+			outcomes[i] = s.deliver(wh, target, r, payload, wait)
+		}(i, target)
+	}
+	wg.Wait()
+
+	for _, outcome := range outcomes {
+		if outcome.Error != "" {
+			s.forgetDelivery(wh, guid)
+			break
+		}
+	}
+
+	switch wh.Response {
+	case webhook.ResponseAll:
+		status := http.StatusOK
+		for _, outcome := range outcomes {
+			if outcome.Error != "" {
+				status = http.StatusBadGateway
+			}
+		}
+		return respondWithOutcomes(w, status, outcomes)
+	case webhook.ResponseAccepted:
+		return respondWithOutcomes(w, http.StatusAccepted, outcomes)
+	default:
+		primary := outcomes[0]
+		if primary.Error != "" && !primary.retryAt.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(primary.retryAt).Seconds()))))
+			return errors.NewAppError(http.StatusServiceUnavailable, primary.Error)
+		}
+		if primary.Error != "" && primary.Status == 0 {
+			return errors.NewAppError(http.StatusInternalServerError, primary.Error)
+		}
+		if primary.Queued {
+			w.WriteHeader(http.StatusAccepted)
+			return nil
+		}
+
+		w.WriteHeader(primary.Status)
+		fmt.Fprintf(w,"%s", primary.body)
+		return nil
+	}
+}
+
+// maxQueueWait is how long deliveries to async targets may be delayed by the
+// rate limits before they are refused like others.
+const maxQueueWait = time.Hour
+
+func allAsync(targets []webhook.Target) bool {
+	for _, target := range targets {
+		if !target.Async {
+			return false
+		}
+	}
+	return len(targets) > 0
+}
+
+// forgetDelivery removes a delivery that was not forwarded from the replay
+// cache, so the sender may redeliver it.
+func (s *server) forgetDelivery(wh *webhook.Webhook, guid string) {
+	if guid == "" {
+		return
+	}
+	if err := s.replays.Remove(replay.Key(wh.Id, guid)); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to forget delivery %v to %v: %v\n", guid, wh.Id, err)
+	}
+}
+
+// targetOutcome is the result of delivering to one target. Deliveries to
+// async targets are only queued.
+type targetOutcome struct {
+	Target string `json:"target,omitempty"`
+	Url    string `json:"url"`
+	Queued bool   `json:"queued,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	body   []byte
+	// retryAt is set when the circuit of the target is open
+	retryAt time.Time
+}
+
+func respondWithMessage(w http.ResponseWriter, status int, message string) error {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(struct {
+		Message string `json:"message"`
+	}{
+		Message: message,
+	})
+
+	return nil
+}
+
+func respondWithOutcomes(w http.ResponseWriter, status int, outcomes []*targetOutcome) error {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(struct {
+		Targets []*targetOutcome `json:"targets"`
+	}{
+		Targets: outcomes,
+	})
+
+	return nil
+}
+
+// deliver forwards a transformed payload received in r to target, or queues
+// it for the dispatcher if the target is async, due after wait. The headers
+// of r are forwarded by the header policy of the webhook, and the transform
+// may override them.
+func (s *server) deliver(wh *webhook.Webhook, target webhook.Target, r *http.Request, payload *transform.Output, wait time.Duration) *targetOutcome {
+	d := delivery.New(wh, target, r.Header, payload.Body)
+	d.NextAttempt = d.NextAttempt.Add(wait)
+	for name, values := range delivery.ForwardedHeader(wh, r) {
+		d.Header[name] = values
+	}
+	for name, values := range payload.Header {
+		d.Header[name] = values
+	}
+	outcome := &targetOutcome{Target: target.Name, Url: target.Url}
+
+	if target.Async {
+		if err := s.dispatcher.Enqueue(d); err != nil {
+			outcome.Error = err.Error()
+			return outcome
+		}
+
+		fmt.Printf("Queued delivery %v to %v\n", d.Id, target.Url)
+		outcome.Queued = true
+		return outcome
+	}
+
+	fmt.Printf("Forwarding request to %v\n", target.Url)
+	responseBody, err := s.dispatcher.Forward(d, wh)
+	if open, ok := err.(*delivery.CircuitOpenError); ok {
+		if wh.CircuitBreaker != nil && wh.CircuitBreaker.Divert {
+			d.NextAttempt = open.RetryAt
+			if err := s.dispatcher.Enqueue(d); err != nil {
+				outcome.Error = err.Error()
+				return outcome
+			}
+
+			fmt.Printf("Queued delivery %v to %v, its circuit is open\n", d.Id, target.Url)
+			outcome.Queued = true
+			return outcome
+		}
+
+		fmt.Fprintf(os.Stderr, "Not forwarding delivery %v to %v, its circuit is open\n", d.Id, target.Url)
+		outcome.Error = err.Error()
+		outcome.retryAt = open.RetryAt
+		s.deadLetter(d)
+		return outcome
+	}
+	outcome.Status = d.Attempts[len(d.Attempts)-1].Status
+	outcome.body = responseBody
 
 	if err != nil {
-		return errors.NewAppError(http.StatusInternalServerError, err.Error())
+		outcome.Error = err.Error()
+		s.deadLetter(d)
 	}
+	return outcome
+}
+
+// deadLetter keeps a delivery that failed to forward synchronously so it
+// can be redelivered.
+func (s *server) deadLetter(d *delivery.Delivery) {
+	if err := s.dispatcher.DeadLetter(d); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to keep dead letter for %v: %v\n", d.HookId, err)
+	}
+}
 
-	body, err := ioutil.ReadAll(res.Body)
-	defer res.Body.Close()
+// previewTransform renders a sample payload through the transform of the
+// webhook, or the transform given with the sample, without forwarding it.
+func (s *server) previewTransform(w http.ResponseWriter, r *http.Request) error {
+	var preview struct {
+		Event     string               `json:"event"`
+		Payload   json.RawMessage      `json:"payload"`
+		Transform *transform.Transform `json:"transform"`
+	}
+	if err := json.Unmarshal(context.RequestBodyFromContext(r.Context()), &preview); err != nil {
+		return errors.NewAppError(http.StatusBadRequest, "invalid preview request: " + err.Error())
+	}
+
+	t := preview.Transform
+	if t == nil {
+		t = context.WebhookFromContext(r.Context()).Transform
+	}
+	if t == nil {
+		return errors.NewAppError(http.StatusBadRequest, "webhook has no transform")
+	}
+	if err := transform.Validate(t); err != nil {
+		return errors.NewAppError(http.StatusBadRequest, err.Error())
+	}
+
+	output, err := transform.Preview(t, transform.Data{Event: preview.Event, Body: string(preview.Payload)})
 	if err != nil {
-		return errors.NewAppError(http.StatusInternalServerError, err.Error())
+		return errors.NewAppError(http.StatusBadRequest, "failed to transform payload: " + err.Error())
+	}
+	if output.Header.Get("Content-Type") == "" {
+		output.Header.Set("Content-Type", "application/json")
 	}
 
-	fmt.Fprintf(w,"%s", body)
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("content-type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(struct {
+		Header http.Header `json:"header"`
+		Body   string      `json:"body"`
+	}{
+		Header: output.Header,
+		Body: string(output.Body),
+	})
 
 	return nil
 }
@@ -88,16 +381,27 @@ func (s *server) urlForWebhook(w *webhook.Webhook) (*url.URL, error) {
 }
 
 func (s *server) listWebhooks(w http.ResponseWriter, r *http.Request) error {
-	w.WriteHeader(http.StatusOK)
-	w.Header().Set("content-type", "application/json")
+	all, err := webhook.List()
+	if err != nil {
+		return errors.NewAppError(http.StatusInternalServerError, err.Error())
+	}
+
+	principal := context.PrincipalFromContext(r.Context())
+	webhooks := make([]*webhook.Webhook, 0, len(all))
+	for _, wh := range all {
+		if principal != nil && !principal.CanManage(wh.Team) {
+			continue
+		}
 
-	webhooks := webhook.List()
-	for _, wh := range webhooks {
 		if _, err := s.urlForWebhook(wh); err != nil {
 			return errors.NewAppError(http.StatusInternalServerError, err.Error())
 		}
+		webhooks = append(webhooks, wh)
 	}
 
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("content-type", "application/json")
+
 	encoder := json.NewEncoder(w)
 	encoder.Encode(webhooks)
 
@@ -113,16 +417,29 @@ func (s *server) listWebhook(w http.ResponseWriter, r *http.Request) error {
 		return errors.NewAppError(http.StatusInternalServerError, err.Error())
 	}
 	encoder := json.NewEncoder(w)
-	encoder.Encode(wh)
+	encoder.Encode(struct {
+		*webhook.Webhook
+		Circuits []delivery.Circuit `json:"circuits,omitempty"`
+	}{
+		Webhook: wh,
+		Circuits: s.dispatcher.Circuits(wh),
+	})
 
 	return nil
 }
 
 func (s *server) deleteWebhook(w http.ResponseWriter, r *http.Request) error {
-	w.WriteHeader(http.StatusNoContent)
-
 	wh := context.WebhookFromContext(r.Context())
-	webhook.Delete(wh.Id)
+	if wh.IsFileManaged() {
+		return errors.NewAppError(http.StatusConflict, "webhook is managed by file and cannot be deleted through the API")
+	}
+
+	if err := webhook.Delete(wh.Id); err != nil {
+		return errors.NewAppError(http.StatusInternalServerError, err.Error())
+	}
+	s.Forget(wh)
+
+	w.WriteHeader(http.StatusNoContent)
 
 	return nil
 }
@@ -133,6 +450,10 @@ func (s *server) newWebhook(w http.ResponseWriter, r *http.Request) error {
 		return errors.NewAppError(http.StatusBadRequest, "invalid secret, must be base64: " + err.Error())
 	}
 
+	if principal := context.PrincipalFromContext(r.Context()); principal != nil && !principal.CanManage(webhookRequest.Team) {
+		return errors.NewAppError(http.StatusForbidden, "not allowed to manage webhooks of team " + webhookRequest.Team)
+	}
+
 	wh, err := webhook.New(webhookRequest)
 	if err != nil {
 		return err
@@ -153,6 +474,118 @@ func (s *server) newWebhook(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+// listDeliveries returns the delivery history of the webhook, newest first.
+// It is paginated with page and per_page, and filtered by event, guid,
+// outcome, status and failed.
+func (s *server) listDeliveries(w http.ResponseWriter, r *http.Request) error {
+	wh := context.WebhookFromContext(r.Context())
+	query := r.URL.Query()
+
+	page, err := intParam(query, "page", 1)
+	if err != nil || page < 1 {
+		return errors.NewAppError(http.StatusBadRequest, "page must be a positive number")
+	}
+	perPage, err := intParam(query, "per_page", 30)
+	if err != nil || perPage < 1 || perPage > 100 {
+		return errors.NewAppError(http.StatusBadRequest, "per_page must be a number from 1 to 100")
+	}
+	status, err := intParam(query, "status", 0)
+	if err != nil {
+		return errors.NewAppError(http.StatusBadRequest, "status must be a number")
+	}
+
+	filter := delivery.Filter{
+		Event: query.Get("event"),
+		Guid: query.Get("guid"),
+		Outcome: query.Get("outcome"),
+		Status: status,
+		Failed: query.Get("failed") == "true",
+	}
+	records := s.history.List(wh.Id, filter, (page - 1) * perPage, perPage)
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("content-type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(records)
+
+	return nil
+}
+
+func intParam(query url.Values, name string, defaultValue int) (int, error) {
+	if v := query.Get(name); v != "" {
+		return strconv.Atoi(v)
+	}
+	return defaultValue, nil
+}
+
+func (s *server) listDeadLetters(w http.ResponseWriter, r *http.Request) error {
+	wh := context.WebhookFromContext(r.Context())
+
+	deadLetters, err := s.deadLetters.List(wh.Id)
+	if err != nil {
+		return errors.NewAppError(http.StatusInternalServerError, err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("content-type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(deadLetters)
+
+	return nil
+}
+
+// deadLetterFromRequest returns the dead letter in the path, which must
+// belong to the webhook in the context.
+func (s *server) deadLetterFromRequest(r *http.Request) (*delivery.Delivery, error) {
+	wh := context.WebhookFromContext(r.Context())
+
+	d, err := s.deadLetters.Get(mux.Vars(r)["deliveryId"])
+	if err != nil {
+		return nil, errors.NewAppError(http.StatusInternalServerError, err.Error())
+	}
+	if d == nil || d.HookId != wh.Id {
+		return nil, errors.NewAppError(http.StatusNotFound, "dead letter does not exist")
+	}
+
+	return d, nil
+}
+
+func (s *server) redeliverDeadLetter(w http.ResponseWriter, r *http.Request) error {
+	d, err := s.deadLetterFromRequest(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.dispatcher.Redeliver(d, context.WebhookFromContext(r.Context())); err != nil {
+		return errors.NewAppError(http.StatusBadGateway, "redelivery failed: " + err.Error())
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("content-type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.Encode(d)
+
+	return nil
+}
+
+func (s *server) deleteDeadLetter(w http.ResponseWriter, r *http.Request) error {
+	d, err := s.deadLetterFromRequest(r)
+	if err != nil {
+		return err
+	}
+
+	if err := s.deadLetters.Remove(d.Id); err != nil {
+		return errors.NewAppError(http.StatusInternalServerError, err.Error())
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
+
 func (s *server) isAlive(w http.ResponseWriter, r *http.Request) error {
 	w.WriteHeader(http.StatusOK)
 	w.Header().Set("content-type", "text/plain")
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"encoding/pem"
 	"net/http"
 	"testing"
 	"net/http/httptest"
@@ -9,6 +10,20 @@ import (
 	"strings"
 	"time"
 	"math/rand"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"github.com/navikt/webhookproxy/auth"
+	"github.com/navikt/webhookproxy/delivery"
+	"github.com/navikt/webhookproxy/rules"
+	"github.com/navikt/webhookproxy/breaker"
+	"github.com/navikt/webhookproxy/destination"
+	"github.com/navikt/webhookproxy/ratelimit"
+	"github.com/navikt/webhookproxy/signature"
+	"os"
+	"github.com/navikt/webhookproxy/transform"
+	"io/ioutil"
+	"sync"
 )
 
 type MockClient struct {
@@ -35,16 +50,24 @@ func checkResponseBody(t *testing.T, expected, actual string) {
 func newRandomWebhook(url string) *webhook.Webhook {
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	wh, _ := webhook.New(webhook.CreateWebhookRequest{
-		fmt.Sprintf("my-cool-webhook-%d", r.Int()),
-		"awesome-team",
-		url,
-		[]byte("foobar"),
+		Name: fmt.Sprintf("my-cool-webhook-%d", r.Int()),
+		Team: "awesome-team",
+		Url: url,
+		Secret: []byte("foobar"),
 	})
 	return wh
 }
 
+func TestMain(m *testing.M) {
+	// test servers listen on loopback, which the default destination
+	// policy denies
+	webhook.UseDestinationPolicy(&destination.Policy{})
+	os.Exit(m.Run())
+}
+
 func clearWebhooks() {
-	for _, w := range webhook.List() {
+	webhooks, _ := webhook.List()
+	for _, w := range webhooks {
 		webhook.Delete(w.Id)
 	}
 }
@@ -144,6 +167,738 @@ func Test_server_proxyHook(t *testing.T) {
 		checkResponseCode(t, http.StatusOK, w.Code)
 		checkResponseBody(t, "Hello, client\n", w.Body.String())
 	})
+
+	t.Run("request with sha256 signature should route to handler", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "Hello, client\n")
+		}))
+		defer ts.Close()
+
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature-256", "sha256=a5ad0f7cb340a135f30ca24000f8798ba177de5a09359befa4d481b6207d5433")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		checkResponseBody(t, "Hello, client\n", w.Body.String())
+	})
+
+	t.Run("request to async webhook should be acknowledged and queued", func(t *testing.T) {
+		queue := delivery.NewMemoryQueue()
+		s := NewServer(WithQueue(queue))
+		s.Initialize()
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Errorf("async delivery should not be forwarded by the handler")
+		}))
+		defer ts.Close()
+
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-async-webhook",
+			Team: "awesome-team",
+			Url: ts.URL,
+			Secret: []byte("foobar"),
+			Async: true,
+		})
+		defer clearWebhooks()
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusAccepted, w.Code)
+
+		queued, _ := queue.Claim(time.Now(), time.Minute, 10)
+		if len(queued) != 1 || queued[0].HookId != wh.Id || string(queued[0].Body) != `{"zen": "Mind your words, they are important."}` {
+			t.Errorf("queue has %v, want the delivery", queued)
+		}
+	})
+}
+
+func Test_server_fanOut(t *testing.T) {
+	newTarget := func(status int, response string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, response)
+		}))
+	}
+	deployer := newTarget(http.StatusOK, "deployed\n")
+	defer deployer.Close()
+	auditor := newTarget(http.StatusInternalServerError, "audit failed\n")
+	defer auditor.Close()
+
+	newFanOutWebhook := func(response string) *webhook.Webhook {
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-fan-out-webhook-" + response,
+			Team: "awesome-team",
+			Secret: []byte("foobar"),
+			Targets: []webhook.Target{
+				{Name: "deployer", Url: deployer.URL},
+				{Name: "auditor", Url: auditor.URL},
+				{Name: "archiver", Url: "http://archiver.tld/hook", Async: true},
+			},
+			Response: response,
+		})
+		return wh
+	}
+
+	deliver := func(s *server, wh *webhook.Webhook) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		return executeRequest(s, r)
+	}
+
+	wantOutcomes := `{"targets":[` +
+		`{"target":"deployer","url":"` + deployer.URL + `","status":200},` +
+		`{"target":"auditor","url":"` + auditor.URL + `","status":500,"error":"unexpected response status 500 Internal Server Error"},` +
+		`{"target":"archiver","url":"http://archiver.tld/hook","queued":true}]}` + "\n"
+
+	t.Run("primary strategy should respond with the first target's response", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh := newFanOutWebhook("")
+		defer clearWebhooks()
+		w := deliver(s, wh)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		checkResponseBody(t, "deployed\n", w.Body.String())
+	})
+
+	t.Run("all strategy should fail unless all targets succeed", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh := newFanOutWebhook(webhook.ResponseAll)
+		defer clearWebhooks()
+		w := deliver(s, wh)
+
+		checkResponseCode(t, http.StatusBadGateway, w.Code)
+		checkResponseBody(t, wantOutcomes, w.Body.String())
+	})
+
+	t.Run("accepted strategy should always respond 202", func(t *testing.T) {
+		queue := delivery.NewMemoryQueue()
+		s := NewServer(WithQueue(queue))
+		s.Initialize()
+
+		wh := newFanOutWebhook(webhook.ResponseAccepted)
+		defer clearWebhooks()
+		w := deliver(s, wh)
+
+		checkResponseCode(t, http.StatusAccepted, w.Code)
+		checkResponseBody(t, wantOutcomes, w.Body.String())
+
+		queued, _ := queue.Claim(time.Now(), time.Minute, 10)
+		if len(queued) != 1 || queued[0].Target != "archiver" {
+			t.Errorf("queue has %v, want the delivery to the archiver", queued)
+		}
+	})
+
+	t.Run("failed target should be kept as dead letter", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh := newFanOutWebhook("")
+		defer clearWebhooks()
+		deliver(s, wh)
+
+		deadLetters, _ := s.deadLetters.List(wh.Id)
+		if len(deadLetters) != 1 || deadLetters[0].Target != "auditor" {
+			t.Errorf("dead letters = %v, want the delivery to the auditor", deadLetters)
+		}
+	})
+}
+
+func Test_server_eventFilter(t *testing.T) {
+	forwarded := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded++
+		fmt.Fprint(w, "Hello, client\n")
+	}))
+	defer ts.Close()
+
+	s := NewServer()
+	s.Initialize()
+
+	wh, _ := webhook.New(webhook.CreateWebhookRequest{
+		Name: "my-filtered-webhook",
+		Team: "awesome-team",
+		Url: ts.URL,
+		Secret: []byte("foobar"),
+		Events: &webhook.EventFilter{Allow: []string{"push", "pull_request.*"}, Deny: []string{"pull_request.closed"}},
+	})
+	defer clearWebhooks()
+
+	deliver := func(event string, payload string, signature string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(payload))
+		r.Header.Set("X-Github-Event", event)
+		r.Header.Set("X-Hub-Signature-256", signature)
+		return executeRequest(s, r)
+	}
+
+	t.Run("allowed event should be forwarded", func(t *testing.T) {
+		forwarded = 0
+		w := deliver("pull_request", `{"action": "opened"}`, "sha256=ea1b3fcc6e2f4c7c6267acb4eafaecd5fe315f41efb11e771292b1d869de19ed")
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		if forwarded != 1 {
+			t.Errorf("forwarded %d deliveries, want 1", forwarded)
+		}
+	})
+
+	t.Run("filtered event should be acknowledged but not forwarded", func(t *testing.T) {
+		forwarded = 0
+		w := deliver("pull_request", `{"action": "closed"}`, "sha256=b596dd9714c0f55845fe97ec8247f3fba23202362e034b3c720bc201c2c9cdc8")
+
+		checkResponseCode(t, http.StatusAccepted, w.Code)
+		checkResponseBody(t, "{\"message\":\"event pull_request is filtered and not forwarded\"}\n", w.Body.String())
+		if forwarded != 0 {
+			t.Errorf("forwarded %d deliveries, want none", forwarded)
+		}
+	})
+}
+
+func Test_server_rules(t *testing.T) {
+	var forwarded []string
+	var mu sync.Mutex
+	newTarget := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			forwarded = append(forwarded, name)
+			mu.Unlock()
+			fmt.Fprint(w, "Hello, client\n")
+		}))
+	}
+	deployer := newTarget("deployer")
+	defer deployer.Close()
+	auditor := newTarget("auditor")
+	defer auditor.Close()
+
+	s := NewServer()
+	s.Initialize()
+
+	wh, err := webhook.New(webhook.CreateWebhookRequest{
+		Name: "my-routed-webhook",
+		Team: "awesome-team",
+		Secret: []byte("foobar"),
+		Targets: []webhook.Target{
+			{Name: "deployer", Url: deployer.URL},
+			{Name: "auditor", Url: auditor.URL},
+		},
+		Rules: []rules.Rule{
+			{When: []rules.Condition{{Path: "ref", Op: rules.OpEq, Value: "refs/heads/main"}}, Targets: []string{"deployer"}},
+			{When: []rules.Condition{{Path: "ref", Op: rules.OpPrefix, Value: "refs/tags/"}}, Drop: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("webhook.New() error = %v", err)
+	}
+	defer clearWebhooks()
+
+	deliver := func(payload string, signature string) *httptest.ResponseRecorder {
+		forwarded = nil
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(payload))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature-256", signature)
+		return executeRequest(s, r)
+	}
+
+	t.Run("matching rule should route to its targets", func(t *testing.T) {
+		w := deliver(`{"ref": "refs/heads/main"}`, "sha256=b97397bed6803cedf5b05c2eab609e702b9c72b9fb36c7ce809c00413c1780d9")
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		if !reflect.DeepEqual(forwarded, []string{"deployer"}) {
+			t.Errorf("forwarded to %v, want deployer", forwarded)
+		}
+	})
+
+	t.Run("dropping rule should acknowledge but not forward", func(t *testing.T) {
+		w := deliver(`{"ref": "refs/tags/v1.0.0"}`, "sha256=2108428950adf577a7679631d31909eb1bda14f827c33757785f905a51c6c0a2")
+
+		checkResponseCode(t, http.StatusAccepted, w.Code)
+		checkResponseBody(t, "{\"message\":\"dropped by rule 2\"}\n", w.Body.String())
+		if len(forwarded) != 0 {
+			t.Errorf("forwarded to %v, want none", forwarded)
+		}
+	})
+
+	t.Run("delivery matching no rule should be forwarded to all targets", func(t *testing.T) {
+		w := deliver(`{"ref": "refs/heads/feature"}`, "sha256=f73b3471fbd5cbab214e9e8ee76ec7100067635869180b127cd6a73e08757073")
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		if len(forwarded) != 2 {
+			t.Errorf("forwarded to %v, want all targets", forwarded)
+		}
+	})
+
+	t.Run("server should refuse rules for unknown targets", func(t *testing.T) {
+		body := `{"name": "my-invalid-webhook", "team": "awesome-team", "secret": "Zm9vYmFy", "targets": [{"name": "deployer", "url": "http://deployer.tld"}], "rules": [{"when": [{"path": "ref", "op": "eq", "value": "refs/heads/main"}], "targets": ["builder"]}]}`
+		r, _ := http.NewRequest("POST", "/hooks", strings.NewReader(body))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusBadRequest, w.Code)
+		checkResponseBody(t, "{\"message\":\"rule 1: unknown target: builder\"}\n", w.Body.String())
+	})
+}
+
+func Test_server_transform(t *testing.T) {
+	var forwarded *http.Request
+	var forwardedBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		forwarded, forwardedBody = r, string(b)
+		fmt.Fprint(w, "Hello, client\n")
+	}))
+	defer ts.Close()
+
+	s := NewServer()
+	s.Initialize()
+
+	wh, err := webhook.New(webhook.CreateWebhookRequest{
+		Name: "my-transformed-webhook",
+		Team: "awesome-team",
+		Url: ts.URL,
+		Secret: []byte("foobar"),
+		Transform: &transform.Transform{
+			Template: `{{.Payload.pusher.name}} pushed to {{.Payload.ref}}`,
+			ContentType: "text/plain",
+			Headers: map[string]string{"X-Event": "{{.Event}}"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("webhook.New() error = %v", err)
+	}
+	defer clearWebhooks()
+
+	t.Run("server should forward the transformed payload", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"ref": "refs/heads/main", "pusher": {"name": "octocat"}}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature-256", "sha256=9703eaaa988d61fbe707b6c589c64d164bd50be83fb80d6ed9d41f3ba4bde711")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		checkResponseBody(t, "octocat pushed to refs/heads/main", forwardedBody)
+		if got := forwarded.Header.Get("Content-Type"); got != "text/plain" {
+			t.Errorf("forwarded content type %v, want text/plain", got)
+		}
+		if got := forwarded.Header.Get("X-Event"); got != "push" {
+			t.Errorf("forwarded X-Event %v, want push", got)
+		}
+	})
+
+	t.Run("server should forward the headers of the delivery", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"ref": "refs/heads/main", "pusher": {"name": "octocat"}}`))
+		r.RemoteAddr = "140.82.115.1:43210"
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Github-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		r.Header.Set("X-Hub-Signature-256", "sha256=9703eaaa988d61fbe707b6c589c64d164bd50be83fb80d6ed9d41f3ba4bde711")
+		r.Header.Set("Cookie", "session=secret")
+		executeRequest(s, r)
+
+		want := map[string]string{
+			"X-Github-Event": "push",
+			"X-Github-Delivery": "72d3162e-cc78-11e3-81ab-4c9367dc0958",
+			"X-Forwarded-For": "140.82.115.1",
+			"X-Webhookproxy-Hook-Id": wh.Id,
+			"Cookie": "",
+		}
+		for name, value := range want {
+			if got := forwarded.Header.Get(name); got != value {
+				t.Errorf("forwarded %v %q, want %q", name, got, value)
+			}
+		}
+	})
+
+	t.Run("server should preview the transform of the webhook", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id + "/transform/preview", strings.NewReader(`{"event": "push", "payload": {"ref": "refs/heads/dev", "pusher": {"name": "hubot"}}}`))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		checkResponseBody(t, "{\"header\":{\"Content-Type\":[\"text/plain\"],\"X-Event\":[\"push\"]},\"body\":\"hubot pushed to refs/heads/dev\"}\n", w.Body.String())
+	})
+
+	t.Run("server should preview a given transform", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id + "/transform/preview", strings.NewReader(`{"payload": {"ref": "refs/heads/dev"}, "transform": {"template": "{\"text\": {{json .Payload.ref}}}"}}`))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		checkResponseBody(t, "{\"header\":{\"Content-Type\":[\"application/json\"]},\"body\":\"{\\\"text\\\": \\\"refs/heads/dev\\\"}\"}\n", w.Body.String())
+	})
+
+	t.Run("server should refuse to preview an invalid transform", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id + "/transform/preview", strings.NewReader(`{"payload": {}, "transform": {"template": "{{.Payload"}}`))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func Test_server_signing(t *testing.T) {
+	verified := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := signature.VerifyRequest([]byte("deployer-secret"), r)
+		verified <- err
+	}))
+	defer ts.Close()
+
+	s := NewServer()
+	s.Initialize()
+
+	wh, err := webhook.New(webhook.CreateWebhookRequest{
+		Name: "my-signed-webhook",
+		Team: "awesome-team",
+		Secret: []byte("foobar"),
+		Targets: []webhook.Target{{Name: "deployer", Url: ts.URL}},
+		SigningSecrets: map[string][]byte{"deployer": []byte("deployer-secret")},
+	})
+	if err != nil {
+		t.Fatalf("webhook.New() error = %v", err)
+	}
+	defer clearWebhooks()
+
+	t.Run("server should sign forwarded deliveries with the secret of the target", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		if err := <-verified; err != nil {
+			t.Errorf("VerifyRequest() error = %v", err)
+		}
+	})
+
+	t.Run("server should not show signing secrets", func(t *testing.T) {
+		r, _ := http.NewRequest("GET", "/hooks/" + wh.Id, strings.NewReader(""))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+		if strings.Contains(w.Body.String(), "signing_secret") {
+			t.Errorf("response %v shows the signing secrets", w.Body.String())
+		}
+	})
+}
+
+func Test_server_replays(t *testing.T) {
+	status := http.StatusOK
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	s := NewServer()
+	s.Initialize()
+
+	wh := newRandomWebhook(ts.URL)
+	defer clearWebhooks()
+
+	deliver := func(guid string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Github-Delivery", guid)
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		return executeRequest(s, r)
+	}
+
+	t.Run("server should refuse a delivery received before", func(t *testing.T) {
+		checkResponseCode(t, http.StatusOK, deliver("72d3162e-cc78-11e3-81ab-4c9367dc0958").Code)
+
+		w := deliver("72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		checkResponseCode(t, http.StatusConflict, w.Code)
+		checkResponseBody(t, "{\"message\":\"delivery 72d3162e-cc78-11e3-81ab-4c9367dc0958 was already received\"}\n", w.Body.String())
+	})
+
+	t.Run("server should accept a redelivery of a delivery that was not forwarded", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		checkResponseCode(t, http.StatusServiceUnavailable, deliver("8a3e1b42-cc78-11e3-81ab-4c9367dc0958").Code)
+
+		status = http.StatusOK
+		checkResponseCode(t, http.StatusOK, deliver("8a3e1b42-cc78-11e3-81ab-4c9367dc0958").Code)
+	})
+}
+
+func Test_server_maxBodySize(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("delivery larger than the max body size should not be forwarded")
+	}))
+	defer ts.Close()
+
+	s := NewServer(WithMaxBodySize(32))
+	s.Initialize()
+
+	wh := newRandomWebhook(ts.URL)
+	defer clearWebhooks()
+
+	t.Run("server should refuse a delivery larger than the max body size", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusRequestEntityTooLarge, w.Code)
+		checkResponseBody(t, "{\"message\":\"request body is larger than 32 bytes\"}\n", w.Body.String())
+	})
+
+	t.Run("server should refuse a webhook larger than the max body size", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks", strings.NewReader(`{"url": "` + ts.URL + `", "secret": "Zm9vYmFy"}`))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("server should not read the body of unknown webhooks", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks/unknown", strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusNotFound, w.Code)
+	})
+}
+
+func Test_server_rateLimits(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	newLimitedWebhook := func(name string, async bool, limit *ratelimit.Limit) *webhook.Webhook {
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: name,
+			Team: "awesome-team",
+			Url: ts.URL,
+			Secret: []byte("foobar"),
+			Async: async,
+			RateLimit: limit,
+		})
+		return wh
+	}
+	deliver := func(s *server, wh *webhook.Webhook) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		return executeRequest(s, r)
+	}
+
+	t.Run("server should refuse deliveries over the limit of the webhook", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh := newLimitedWebhook("my-limited-webhook", false, &ratelimit.Limit{Rate: 1, Burst: 1})
+		defer clearWebhooks()
+
+		checkResponseCode(t, http.StatusOK, deliver(s, wh).Code)
+
+		w := deliver(s, wh)
+		checkResponseCode(t, http.StatusTooManyRequests, w.Code)
+		checkResponseBody(t, "{\"message\":\"rate limit of hook exceeded\"}\n", w.Body.String())
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != "1" {
+			t.Errorf("Expected Retry-After <1>. Got <%v>", retryAfter)
+		}
+	})
+
+	t.Run("server should refuse deliveries over the default limit of the team", func(t *testing.T) {
+		s := NewServer(WithRateLimits(ratelimit.Defaults{Team: &ratelimit.Limit{Rate: 1, Burst: 1}}))
+		s.Initialize()
+
+		first := newLimitedWebhook("my-first-webhook", false, nil)
+		second := newLimitedWebhook("my-second-webhook", false, nil)
+		defer clearWebhooks()
+
+		checkResponseCode(t, http.StatusOK, deliver(s, first).Code)
+
+		w := deliver(s, second)
+		checkResponseCode(t, http.StatusTooManyRequests, w.Code)
+		checkResponseBody(t, "{\"message\":\"rate limit of team exceeded\"}\n", w.Body.String())
+	})
+
+	t.Run("server should queue async deliveries over the limit for later", func(t *testing.T) {
+		queue := delivery.NewMemoryQueue()
+		s := NewServer(WithQueue(queue))
+		s.Initialize()
+
+		wh := newLimitedWebhook("my-limited-async-webhook", true, &ratelimit.Limit{Rate: 1, Burst: 1})
+		defer clearWebhooks()
+
+		checkResponseCode(t, http.StatusAccepted, deliver(s, wh).Code)
+		checkResponseCode(t, http.StatusAccepted, deliver(s, wh).Code)
+
+		if queued, _ := queue.Claim(time.Now(), time.Minute, 10); len(queued) != 1 {
+			t.Errorf("queue has %d deliveries due now, want 1", len(queued))
+		}
+		if queued, _ := queue.Claim(time.Now().Add(2 * time.Second), time.Minute, 10); len(queued) != 1 {
+			t.Errorf("queue has %d deliveries due after the limit, want 1", len(queued))
+		}
+	})
+}
+
+func Test_server_circuitBreaker(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	newBreakingWebhook := func(name string, divert bool) *webhook.Webhook {
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: name,
+			Team: "awesome-team",
+			Url: ts.URL,
+			Secret: []byte("foobar"),
+			CircuitBreaker: &breaker.Settings{Threshold: 1, Cooldown: 60, Divert: divert},
+		})
+		return wh
+	}
+	deliver := func(s *server, wh *webhook.Webhook) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		return executeRequest(s, r)
+	}
+
+	t.Run("server should fail fast when the circuit of the target is open", func(t *testing.T) {
+		requests = 0
+		s := NewServer()
+		s.Initialize()
+
+		wh := newBreakingWebhook("my-breaking-webhook", false)
+		defer clearWebhooks()
+
+		checkResponseCode(t, http.StatusServiceUnavailable, deliver(s, wh).Code)
+
+		w := deliver(s, wh)
+		checkResponseCode(t, http.StatusServiceUnavailable, w.Code)
+		if !strings.Contains(w.Body.String(), "circuit of target is open until") {
+			t.Errorf("Expected body to tell the circuit is open. Got <%v>", w.Body.String())
+		}
+		if retryAfter := w.Header().Get("Retry-After"); retryAfter != "60" {
+			t.Errorf("Expected Retry-After <60>. Got <%v>", retryAfter)
+		}
+		if requests != 1 {
+			t.Errorf("target received %d requests, want 1 before the circuit opened", requests)
+		}
+
+		r, _ := http.NewRequest("GET", "/hooks/" + wh.Id, strings.NewReader(""))
+		w = executeRequest(s, r)
+		if !strings.Contains(w.Body.String(), `"circuits":[{"url":"` + ts.URL + `","state":"open","failures":1,"opened_at":`) {
+			t.Errorf("Expected webhook with its open circuit. Got <%v>", w.Body.String())
+		}
+	})
+
+	t.Run("server should queue deliveries when the circuit of the target is open and they are diverted", func(t *testing.T) {
+		requests = 0
+		queue := delivery.NewMemoryQueue()
+		s := NewServer(WithQueue(queue))
+		s.Initialize()
+
+		wh := newBreakingWebhook("my-diverting-webhook", true)
+		defer clearWebhooks()
+
+		checkResponseCode(t, http.StatusServiceUnavailable, deliver(s, wh).Code)
+		checkResponseCode(t, http.StatusAccepted, deliver(s, wh).Code)
+
+		if queued, _ := queue.Claim(time.Now(), time.Minute, 10); len(queued) != 0 {
+			t.Errorf("queue has %d deliveries due now, want none before the cooldown", len(queued))
+		}
+		if queued, _ := queue.Claim(time.Now().Add(time.Minute), time.Minute, 10); len(queued) != 1 {
+			t.Errorf("queue has %d deliveries due after the cooldown, want 1", len(queued))
+		}
+	})
+}
+
+func Test_server_clientSettings(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	s := NewServer()
+	s.Initialize()
+
+	deliver := func(wh *webhook.Webhook) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		return executeRequest(s, r)
+	}
+
+	t.Run("server should forward to a target with a certificate of the ca of the webhook", func(t *testing.T) {
+		wh, err := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-tls-webhook",
+			Team: "awesome-team",
+			Url: ts.URL,
+			Secret: []byte("foobar"),
+			Client: &webhook.ClientSettings{CA: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer clearWebhooks()
+
+		checkResponseCode(t, http.StatusOK, deliver(wh).Code)
+	})
+
+	t.Run("server should not forward to a target with a certificate of an unknown ca", func(t *testing.T) {
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+
+		w := deliver(wh)
+		checkResponseCode(t, http.StatusInternalServerError, w.Code)
+		if !strings.Contains(w.Body.String(), "certificate") {
+			t.Errorf("Expected body to tell the certificate is not trusted. Got <%v>", w.Body.String())
+		}
+	})
+}
+
+func Test_server_destinationPolicy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("delivery should not be forwarded to a denied address")
+	}))
+	defer ts.Close()
+
+	webhook.UseDestinationPolicy(destination.DefaultPolicy())
+	defer webhook.UseDestinationPolicy(&destination.Policy{})
+
+	s := NewServer()
+	s.Initialize()
+	defer clearWebhooks()
+
+	t.Run("server should refuse webhooks forwarding to the metadata service", func(t *testing.T) {
+		r, _ := http.NewRequest("POST", "/hooks", strings.NewReader(`{"name": "my-metadata-webhook", "team": "awesome-team", "url": "http://169.254.169.254/latest/meta-data/", "secret": "Zm9vYmFy"}`))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusBadRequest, w.Code)
+		checkResponseBody(t, "{\"message\":\"url not allowed: address 169.254.169.254 is denied\"}\n", w.Body.String())
+	})
+
+	t.Run("server should not forward to host names resolving to denied addresses", func(t *testing.T) {
+		wh, err := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-rebound-webhook",
+			Team: "awesome-team",
+			Url: strings.Replace(ts.URL, "127.0.0.1", "localhost", 1),
+			Secret: []byte("foobar"),
+		})
+		if err != nil {
+			t.Fatalf("webhook.New() error = %v", err)
+		}
+
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusInternalServerError, w.Code)
+		if !strings.Contains(w.Body.String(), "is denied") {
+			t.Errorf("response %v, want the address to be denied", w.Body.String())
+		}
+	})
 }
 
 func Test_server_listWebhook(t *testing.T) {
@@ -170,7 +925,7 @@ func Test_server_listWebhook(t *testing.T) {
 		checkResponseCode(t, http.StatusOK, w.Code)
 		bb, _ := wh.CreatedAt.MarshalJSON()
 		jsonTime := string(bb)
-		checkResponseBody(t, "{\"id\":\"" + wh.Id + "\",\"name\":\"" + wh.Name + "\",\"team\":\"" + wh.Team + "\",\"url\":\"" + wh.Url + "\",\"proxy_url\":\"/hooks/" + wh.Id + "\",\"created_at\":" + jsonTime + "}\n", w.Body.String())
+		checkResponseBody(t, "{\"id\":\"" + wh.Id + "\",\"name\":\"" + wh.Name + "\",\"team\":\"" + wh.Team + "\",\"url\":\"" + wh.Url + "\",\"proxy_url\":\"/hooks/" + wh.Id + "\",\"created_at\":" + jsonTime + ",\"source\":\"api\"}\n", w.Body.String())
 	})
 }
 
@@ -198,7 +953,7 @@ func Test_server_listWebhooks(t *testing.T) {
 		checkResponseCode(t, http.StatusOK, w.Code)
 		bb, _ := wh.CreatedAt.MarshalJSON()
 		jsonTime := string(bb)
-		checkResponseBody(t, "[{\"id\":\"" + wh.Id + "\",\"name\":\"" + wh.Name + "\",\"team\":\"" + wh.Team + "\",\"url\":\"" + wh.Url + "\",\"proxy_url\":\"/hooks/" + wh.Id + "\",\"created_at\":" + jsonTime + "}]\n", w.Body.String())
+		checkResponseBody(t, "[{\"id\":\"" + wh.Id + "\",\"name\":\"" + wh.Name + "\",\"team\":\"" + wh.Team + "\",\"url\":\"" + wh.Url + "\",\"proxy_url\":\"/hooks/" + wh.Id + "\",\"created_at\":" + jsonTime + ",\"source\":\"api\"}]\n", w.Body.String())
 	})
 }
 
@@ -231,6 +986,26 @@ func Test_server_deleteWebhook(t *testing.T) {
 		checkResponseCode(t, http.StatusOK, w.Code)
 		checkResponseBody(t, "[]\n", w.Body.String())
 	})
+
+	t.Run("server should refuse to delete file managed webhook", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh, _ := webhook.FromRequest(webhook.CreateWebhookRequest{
+			Name: "my-file-hook",
+			Team: "awesome-team",
+			Url: "http://forward.tld/my-hook",
+			Secret: []byte("foobar"),
+		}, webhook.SourceFile)
+		webhook.Save(wh)
+		defer clearWebhooks()
+
+		r, _ := http.NewRequest("DELETE", "/hooks/" + wh.Id, strings.NewReader(""))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusConflict, w.Code)
+		checkResponseBody(t, "{\"message\":\"webhook is managed by file and cannot be deleted through the API\"}\n", w.Body.String())
+	})
 }
 
 func Test_server_newWebhook(t *testing.T) {
@@ -251,6 +1026,24 @@ func Test_server_newWebhook(t *testing.T) {
 `, w.Body.String())
 	})
 
+	t.Run("server should fail if provider is unknown", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		r, _ := http.NewRequest("POST", "/hooks", strings.NewReader(`{
+	"name": "awesome-webhook",
+	"team": "my-team-name",
+	"url": "http://forward.tld/my-webhook",
+	"secret": "Zm9vYmFy",
+	"provider": "sourceforge"
+}`))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusBadRequest, w.Code)
+		checkResponseBody(t, `{"message":"unknown provider: sourceforge"}
+`, w.Body.String())
+	})
+
 	t.Run("server should respond with webhook", func(t *testing.T) {
 		s := NewServer()
 		s.Initialize()
@@ -263,12 +1056,358 @@ func Test_server_newWebhook(t *testing.T) {
 }`))
 		w := executeRequest(s, r)
 
-		wh := webhook.Lookup("my-team-name", "awesome-webhook")
+		wh, _ := webhook.Lookup("my-team-name", "awesome-webhook")
 
 		checkResponseCode(t, http.StatusCreated, w.Code)
 		bb, _ := wh.CreatedAt.MarshalJSON()
 		jsonTime := string(bb)
-		checkResponseBody(t, "{\"id\":\"" + wh.Id + "\",\"name\":\"awesome-webhook\",\"team\":\"my-team-name\",\"url\":\"http://forward.tld/my-webhook\",\"proxy_url\":\"/hooks/" + wh.Id + "\",\"created_at\":" + jsonTime + "}\n", w.Body.String())
+		checkResponseBody(t, "{\"id\":\"" + wh.Id + "\",\"name\":\"awesome-webhook\",\"team\":\"my-team-name\",\"url\":\"http://forward.tld/my-webhook\",\"proxy_url\":\"/hooks/" + wh.Id + "\",\"created_at\":" + jsonTime + ",\"source\":\"api\"}\n", w.Body.String())
+	})
+}
+
+func Test_server_management(t *testing.T) {
+	authenticator := auth.NewTokenAuthenticator([]auth.Token{{Name: "awesome-team-ci", Token: "s3cr3t", Teams: []string{"awesome-team"}}})
+
+	t.Run("management routes should require a token", func(t *testing.T) {
+		s := NewServer(WithAuthenticator(authenticator))
+		s.Initialize()
+
+		wh := newRandomWebhook("http://forward.tld/my-hook")
+		defer clearWebhooks()
+
+		for _, r := range []*http.Request{
+			httptest.NewRequest("GET", "/hooks", nil),
+			httptest.NewRequest("POST", "/hooks", strings.NewReader(`{}`)),
+			httptest.NewRequest("GET", "/hooks/" + wh.Id, nil),
+			httptest.NewRequest("GET", "/hooks/dfb90a8c012eb0b97e6ec0865226bccedd723502", nil),
+			httptest.NewRequest("DELETE", "/hooks/" + wh.Id, nil),
+		} {
+			w := executeRequest(s, r)
+			checkResponseCode(t, http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("management routes should accept a valid token", func(t *testing.T) {
+		s := NewServer(WithAuthenticator(authenticator))
+		s.Initialize()
+
+		wh := newRandomWebhook("http://forward.tld/my-hook")
+		defer clearWebhooks()
+
+		r, _ := http.NewRequest("GET", "/hooks/" + wh.Id, strings.NewReader(""))
+		r.Header.Set("Authorization", "Bearer s3cr3t")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("webhook deliveries should not require a token", func(t *testing.T) {
+		s := NewServer(WithAuthenticator(authenticator))
+		s.Initialize()
+
+		wh := newRandomWebhook("http://forward.tld/my-hook")
+		defer clearWebhooks()
+
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "ping")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusAccepted, w.Code)
+	})
+}
+
+func Test_server_teamAuthorization(t *testing.T) {
+	authenticator := auth.NewTokenAuthenticator([]auth.Token{
+		{Name: "team-a-ci", Token: "team-a-token", Teams: []string{"team-a"}},
+		{Name: "team-b-ci", Token: "team-b-token", Teams: []string{"team-b"}},
+		{Name: "admin", Token: "admin-token", Admin: true},
+	})
+
+	newTeamWebhook := func(team string) *webhook.Webhook {
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-hook",
+			Team: team,
+			Url: "http://forward.tld/my-hook",
+			Secret: []byte("foobar"),
+		})
+		return wh
+	}
+
+	listIds := func(s *server, token string) []string {
+		r, _ := http.NewRequest("GET", "/hooks", strings.NewReader(""))
+		r.Header.Set("Authorization", "Bearer " + token)
+		w := executeRequest(s, r)
+
+		var webhooks []webhook.Webhook
+		json.Unmarshal(w.Body.Bytes(), &webhooks)
+		ids := make([]string, 0)
+		for _, wh := range webhooks {
+			ids = append(ids, wh.Id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	t.Run("list should only show the caller's teams, admins see all", func(t *testing.T) {
+		s := NewServer(WithAuthenticator(authenticator))
+		s.Initialize()
+
+		a := newTeamWebhook("team-a")
+		b := newTeamWebhook("team-b")
+		defer clearWebhooks()
+
+		if got := listIds(s, "team-a-token"); !reflect.DeepEqual(got, []string{a.Id}) {
+			t.Errorf("team-a got %v, want [%v]", got, a.Id)
+		}
+
+		want := []string{a.Id, b.Id}
+		sort.Strings(want)
+		if got := listIds(s, "admin-token"); !reflect.DeepEqual(got, want) {
+			t.Errorf("admin got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("creating a webhook for another team should be forbidden", func(t *testing.T) {
+		s := NewServer(WithAuthenticator(authenticator))
+		s.Initialize()
+		defer clearWebhooks()
+
+		r, _ := http.NewRequest("POST", "/hooks", strings.NewReader(`{
+	"name": "awesome-webhook",
+	"team": "team-b",
+	"url": "http://forward.tld/my-webhook",
+	"secret": "Zm9vYmFy"
+}`))
+		r.Header.Set("Authorization", "Bearer team-a-token")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusForbidden, w.Code)
+		checkResponseBody(t, "{\"message\":\"not allowed to manage webhooks of team team-b\"}\n", w.Body.String())
+	})
+
+	t.Run("showing and deleting another team's webhook should be forbidden", func(t *testing.T) {
+		s := NewServer(WithAuthenticator(authenticator))
+		s.Initialize()
+
+		b := newTeamWebhook("team-b")
+		defer clearWebhooks()
+
+		for _, method := range []string{"GET", "DELETE"} {
+			r, _ := http.NewRequest(method, "/hooks/" + b.Id, strings.NewReader(""))
+			r.Header.Set("Authorization", "Bearer team-a-token")
+			w := executeRequest(s, r)
+
+			checkResponseCode(t, http.StatusForbidden, w.Code)
+		}
+
+		r, _ := http.NewRequest("DELETE", "/hooks/" + b.Id, strings.NewReader(""))
+		r.Header.Set("Authorization", "Bearer admin-token")
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusNoContent, w.Code)
+	})
+}
+
+func Test_server_listDeliveries(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "Hello, client\n")
+	}))
+	defer ts.Close()
+
+	t.Run("forwarded deliveries should be listed newest first", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+		for _, guid := range []string{"72d3162e-cc78-11e3-81ab-4c9367dc0958", "8a3e1b42-cc78-11e3-81ab-4c9367dc0958"} {
+			r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+			r.Header.Set("X-Github-Event", "push")
+			r.Header.Set("X-Github-Delivery", guid)
+			r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+			executeRequest(s, r)
+		}
+
+		r, _ := http.NewRequest("GET", "/hooks/" + wh.Id + "/deliveries?per_page=1", strings.NewReader(""))
+		w := executeRequest(s, r)
+		checkResponseCode(t, http.StatusOK, w.Code)
+
+		var records []delivery.Record
+		json.Unmarshal(w.Body.Bytes(), &records)
+		if len(records) != 1 {
+			t.Errorf("deliveries = %v, want one record", records)
+			return
+		}
+		record := records[0]
+		if record.Guid != "8a3e1b42-cc78-11e3-81ab-4c9367dc0958" || record.Event != "push" ||
+			record.Status != http.StatusOK || record.Response != "Hello, client\n" {
+			t.Errorf("record = %v, want the last delivery with its response", record)
+		}
+	})
+
+	t.Run("deliveries that were not forwarded should be listed with their outcome", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+		for i := 0; i < 2; i++ {
+			r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+			r.Header.Set("X-Github-Event", "push")
+			r.Header.Set("X-Github-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+			r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+			executeRequest(s, r)
+		}
+
+		r, _ := http.NewRequest("GET", "/hooks/" + wh.Id + "/deliveries", strings.NewReader(""))
+		w := executeRequest(s, r)
+		checkResponseCode(t, http.StatusOK, w.Code)
+
+		var records []delivery.Record
+		json.Unmarshal(w.Body.Bytes(), &records)
+		if len(records) != 2 {
+			t.Errorf("deliveries = %v, want two records", records)
+			return
+		}
+		if replayed := records[0]; replayed.Outcome != delivery.OutcomeReplayed || replayed.Status != http.StatusConflict ||
+			replayed.Event != "push" || replayed.Target != "" {
+			t.Errorf("record = %v, want the replayed delivery refused with 409", replayed)
+		}
+		if forwarded := records[1]; forwarded.Outcome != delivery.OutcomeForwarded || forwarded.Status != http.StatusOK {
+			t.Errorf("record = %v, want the forwarded delivery", forwarded)
+		}
+
+		r, _ = http.NewRequest("GET", "/hooks/" + wh.Id + "/deliveries?outcome=replayed", strings.NewReader(""))
+		w = executeRequest(s, r)
+		json.Unmarshal(w.Body.Bytes(), &records)
+		if len(records) != 1 || records[0].Outcome != delivery.OutcomeReplayed {
+			t.Errorf("deliveries = %v, want the replayed delivery only", records)
+		}
+	})
+
+	t.Run("invalid pagination should fail", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+
+		r, _ := http.NewRequest("GET", "/hooks/" + wh.Id + "/deliveries?per_page=1000", strings.NewReader(""))
+		w := executeRequest(s, r)
+
+		checkResponseCode(t, http.StatusBadRequest, w.Code)
+		checkResponseBody(t, "{\"message\":\"per_page must be a number from 1 to 100\"}\n", w.Body.String())
+	})
+}
+
+func Test_server_deadLetters(t *testing.T) {
+	failing := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprint(w, "Hello, client\n")
+	}))
+	defer ts.Close()
+
+	deliver := func(s *server, wh *webhook.Webhook) {
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id, strings.NewReader(`{"zen": "Mind your words, they are important."}`))
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Hub-Signature", "sha1=dfb90a8c012eb0b97e6ec0865226bccedd723502")
+		executeRequest(s, r)
+	}
+
+	listDeadLetters := func(s *server, wh *webhook.Webhook) []delivery.Delivery {
+		r, _ := http.NewRequest("GET", "/hooks/" + wh.Id + "/deadletters", strings.NewReader(""))
+		w := executeRequest(s, r)
+		checkResponseCode(t, http.StatusOK, w.Code)
+
+		var deadLetters []delivery.Delivery
+		json.Unmarshal(w.Body.Bytes(), &deadLetters)
+		return deadLetters
+	}
+
+	t.Run("failed forward should be listed as dead letter", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		failing = true
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+		deliver(s, wh)
+
+		deadLetters := listDeadLetters(s, wh)
+		if len(deadLetters) != 1 {
+			t.Errorf("dead letters = %v, want the failed delivery", deadLetters)
+			return
+		}
+		d := deadLetters[0]
+		if string(d.Body) != `{"zen": "Mind your words, they are important."}` || d.Url != ts.URL ||
+			len(d.Attempts) != 1 || d.Attempts[0].Status != http.StatusServiceUnavailable {
+			t.Errorf("dead letter = %v, want body, target and failed attempt", d)
+		}
+	})
+
+	t.Run("redelivered dead letter should be removed when it succeeds", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		failing = true
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+		deliver(s, wh)
+		d := listDeadLetters(s, wh)[0]
+
+		r, _ := http.NewRequest("POST", "/hooks/" + wh.Id + "/deadletters/" + d.Id + "/redeliver", strings.NewReader(""))
+		w := executeRequest(s, r)
+		checkResponseCode(t, http.StatusBadGateway, w.Code)
+		if deadLetters := listDeadLetters(s, wh); len(deadLetters) != 1 || len(deadLetters[0].Attempts) != 2 {
+			t.Errorf("dead letters = %v, want the dead letter with both attempts", deadLetters)
+		}
+
+		failing = false
+		w = executeRequest(s, r)
+		checkResponseCode(t, http.StatusOK, w.Code)
+		if deadLetters := listDeadLetters(s, wh); len(deadLetters) != 0 {
+			t.Errorf("dead letters = %v, want none", deadLetters)
+		}
+	})
+
+	t.Run("deleted dead letter should be gone", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		failing = true
+		wh := newRandomWebhook(ts.URL)
+		defer clearWebhooks()
+		deliver(s, wh)
+		d := listDeadLetters(s, wh)[0]
+
+		r, _ := http.NewRequest("DELETE", "/hooks/" + wh.Id + "/deadletters/" + d.Id, strings.NewReader(""))
+		w := executeRequest(s, r)
+		checkResponseCode(t, http.StatusNoContent, w.Code)
+
+		if deadLetters := listDeadLetters(s, wh); len(deadLetters) != 0 {
+			t.Errorf("dead letters = %v, want none", deadLetters)
+		}
+	})
+
+	t.Run("dead letter of another webhook should not be found", func(t *testing.T) {
+		s := NewServer()
+		s.Initialize()
+
+		failing = true
+		wh := newRandomWebhook(ts.URL)
+		other, _ := webhook.New(webhook.CreateWebhookRequest{Name: "my-other-webhook", Team: "awesome-team", Url: ts.URL, Secret: []byte("foobar")})
+		defer clearWebhooks()
+		deliver(s, wh)
+		d := listDeadLetters(s, wh)[0]
+
+		r, _ := http.NewRequest("POST", "/hooks/" + other.Id + "/deadletters/" + d.Id + "/redeliver", strings.NewReader(""))
+		w := executeRequest(s, r)
+		checkResponseCode(t, http.StatusNotFound, w.Code)
+		checkResponseBody(t, "{\"message\":\"dead letter does not exist\"}\n", w.Body.String())
 	})
 }
 
@@ -0,0 +1,53 @@
+package auth
+
+import (
+	"fmt"
+)
+
+// Principal is an authenticated caller of the management API. A principal
+// manages the webhooks of its teams, while admins manage all webhooks.
+type Principal struct {
+	Name  string
+	Teams []string
+	Admin bool
+}
+
+// CanManage reports whether the principal may manage the webhooks of team.
+func (p *Principal) CanManage(team string) bool {
+	if p.Admin {
+		return true
+	}
+
+	for _, t := range p.Teams {
+		if t == team {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates a bearer token.
+type Authenticator interface {
+	Authenticate(token string) (*Principal, error)
+}
+
+var ErrInvalidToken = fmt.Errorf("invalid token")
+
+type chain []Authenticator
+
+// Chain returns an authenticator that accepts a token if any of the given
+// authenticators accepts it.
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+func (c chain) Authenticate(token string) (*Principal, error) {
+	err := ErrInvalidToken
+	for _, a := range c {
+		var principal *Principal
+		if principal, err = a.Authenticate(token); err == nil {
+			return principal, nil
+		}
+	}
+	return nil, err
+}
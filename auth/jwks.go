@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// minRefreshInterval limits how often an unknown key id makes the key set
+// be fetched again, so tokens with made up key ids cannot be used to flood
+// the identity provider.
+const minRefreshInterval = time.Minute
+
+// JWKS is a JSON Web Key Set fetched from an identity provider. Keys are
+// cached and fetched again when a token refers to an unknown key id, which
+// happens when the provider rotates its keys.
+type JWKS struct {
+	url       string
+	client    *http.Client
+	mu        sync.Mutex
+	keys      map[string]interface{}
+	fetchedAt time.Time
+	// fetching is closed when the fetch in flight is done, nil if there
+	// is none
+	fetching chan struct{}
+}
+
+func NewJWKS(url string) *JWKS {
+	return &JWKS{
+		url:    url,
+		client: &http.Client{Timeout: 5 * time.Second},
+		keys:   map[string]interface{}{},
+	}
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Key returns the public key with the given id. If the token has no key id,
+// the only key in the set is used. The key set is fetched without holding
+// the lock, so known keys are returned while it is fetched.
+func (j *JWKS) Key(kid string) (interface{}, error) {
+	j.mu.Lock()
+	if key, ok := j.lookup(kid); ok {
+		j.mu.Unlock()
+		return key, nil
+	}
+
+	fetching := j.fetching
+	if fetching == nil {
+		if time.Since(j.fetchedAt) < minRefreshInterval {
+			j.mu.Unlock()
+			return nil, fmt.Errorf("unknown key id: %v", kid)
+		}
+
+		fetching = make(chan struct{})
+		j.fetching = fetching
+		j.fetchedAt = time.Now()
+		j.mu.Unlock()
+
+		keys, err := j.fetch()
+
+		j.mu.Lock()
+		if err == nil {
+			j.keys = keys
+		}
+		j.fetching = nil
+		close(fetching)
+		j.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// wait for the fetch in flight rather than fetching again
+		j.mu.Unlock()
+		<-fetching
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id: %v", kid)
+}
+
+func (j *JWKS) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// fetch returns the signing keys in the key set at url. It must be called
+// without mu held.
+func (j *JWKS) fetch() (map[string]interface{}, error) {
+	res, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", res.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			fmt.Printf("Skipping JWKS key %v: %v\n", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %v", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %v", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"fmt"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// jwtAuthenticator accepts OIDC tokens signed by a key in the identity
+// provider's JWKS, issued by issuer for audience. The principal's teams are
+// read from the teamsClaim claim, and members of any of adminTeams are
+// admins.
+type jwtAuthenticator struct {
+	keys       *JWKS
+	issuer     string
+	audience   string
+	teamsClaim string
+	adminTeams []string
+}
+
+func NewJWTAuthenticator(keys *JWKS, issuer string, audience string, teamsClaim string, adminTeams []string) *jwtAuthenticator {
+	return &jwtAuthenticator{keys, issuer, audience, teamsClaim, adminTeams}
+}
+
+func (a *jwtAuthenticator) Authenticate(token string) (*Principal, error) {
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method: %v", t.Header["alg"])
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.Key(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims := parsed.Claims.(jwt.MapClaims)
+	if !claims.VerifyIssuer(a.issuer, true) {
+		return nil, fmt.Errorf("unexpected issuer: %v", claims["iss"])
+	}
+	if !claims.VerifyAudience(a.audience, true) {
+		return nil, fmt.Errorf("unexpected audience: %v", claims["aud"])
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, fmt.Errorf("token has no subject")
+	}
+
+	principal := &Principal{Name: subject, Teams: stringsClaim(claims[a.teamsClaim])}
+	for _, team := range a.adminTeams {
+		if principal.CanManage(team) {
+			principal.Admin = true
+		}
+	}
+
+	return principal, nil
+}
+
+// stringsClaim reads a claim that is either a string or a list of strings.
+func stringsClaim(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, value := range v {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
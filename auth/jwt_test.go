@@ -0,0 +1,229 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// jwksStub serves the public part of its keys as a JWKS.
+type jwksStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     map[string]*rsa.PrivateKey
+	requests int32
+}
+
+func newJWKSStub(kids ...string) *jwksStub {
+	stub := &jwksStub{keys: map[string]*rsa.PrivateKey{}}
+	for _, kid := range kids {
+		stub.addKey(kid)
+	}
+
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&stub.requests, 1)
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+
+		keys := make([]jsonWebKey, 0)
+		for kid, key := range stub.keys {
+			keys = append(keys, jsonWebKey{
+				Kid: kid,
+				Kty: "RSA",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	return stub
+}
+
+func (s *jwksStub) addKey(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	s.mu.Lock()
+	s.keys[kid] = key
+	s.mu.Unlock()
+}
+
+func (s *jwksStub) sign(kid string, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	s.mu.Lock()
+	signed, err := token.SignedString(s.keys[kid])
+	s.mu.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+func validClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":    "https://issuer.tld",
+		"aud":    []string{"webhookproxy"},
+		"sub":    "jane.doe",
+		"groups": []string{"team-a", "team-b"},
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func Test_jwtAuthenticator_Authenticate(t *testing.T) {
+	stub := newJWKSStub("key-1")
+	defer stub.Close()
+
+	a := NewJWTAuthenticator(NewJWKS(stub.URL), "https://issuer.tld", "webhookproxy", "groups", []string{"platform-team"})
+
+	t.Run("Valid token should authenticate", func(t *testing.T) {
+		got, err := a.Authenticate(stub.sign("key-1", validClaims()))
+		if err != nil {
+			t.Errorf("Authenticate() error = %v", err)
+			return
+		}
+		want := &Principal{Name: "jane.doe", Teams: []string{"team-a", "team-b"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Authenticate() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Member of admin team should be admin", func(t *testing.T) {
+		claims := validClaims()
+		claims["groups"] = "platform-team"
+
+		got, err := a.Authenticate(stub.sign("key-1", claims))
+		if err != nil {
+			t.Errorf("Authenticate() error = %v", err)
+			return
+		}
+		if !got.Admin {
+			t.Errorf("Authenticate() = %v, want admin", got)
+		}
+	})
+
+	invalid := map[string]func(claims jwt.MapClaims){
+		"Expired token should fail":         func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"Wrong issuer should fail":          func(c jwt.MapClaims) { c["iss"] = "https://other-issuer.tld" },
+		"Wrong audience should fail":        func(c jwt.MapClaims) { c["aud"] = "other-app" },
+		"Token without subject should fail": func(c jwt.MapClaims) { delete(c, "sub") },
+	}
+	for name, modify := range invalid {
+		t.Run(name, func(t *testing.T) {
+			claims := validClaims()
+			modify(claims)
+
+			if _, err := a.Authenticate(stub.sign("key-1", claims)); err == nil {
+				t.Errorf("Authenticate() should fail")
+			}
+		})
+	}
+
+	t.Run("Token signed with unknown key should fail", func(t *testing.T) {
+		other := newJWKSStub("key-1")
+		defer other.Close()
+
+		if _, err := a.Authenticate(other.sign("key-1", validClaims())); err == nil {
+			t.Errorf("Authenticate() should fail")
+		}
+	})
+
+	t.Run("Unsigned token should fail", func(t *testing.T) {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+		if _, err := a.Authenticate(token); err == nil {
+			t.Errorf("Authenticate() should fail")
+		}
+	})
+}
+
+func TestJWKS_Key(t *testing.T) {
+	t.Run("Rotated key should be fetched", func(t *testing.T) {
+		stub := newJWKSStub("key-1")
+		defer stub.Close()
+
+		keys := NewJWKS(stub.URL)
+		if _, err := keys.Key("key-1"); err != nil {
+			t.Errorf("Key() error = %v", err)
+			return
+		}
+
+		stub.addKey("key-2")
+		keys.fetchedAt = time.Now().Add(-minRefreshInterval)
+
+		if _, err := keys.Key("key-2"); err != nil {
+			t.Errorf("Key() error = %v", err)
+		}
+	})
+
+	t.Run("Known keys should be returned while the key set is fetched", func(t *testing.T) {
+		stub := newJWKSStub("key-1")
+		defer stub.Close()
+
+		keys := NewJWKS(stub.URL)
+		if _, err := keys.Key("key-1"); err != nil {
+			t.Errorf("Key() error = %v", err)
+			return
+		}
+
+		stub.addKey("key-2")
+		keys.fetchedAt = time.Now().Add(-minRefreshInterval)
+
+		// the stub answers once it is unlocked
+		stub.mu.Lock()
+		rotated := make(chan error)
+		go func() {
+			_, err := keys.Key("key-2")
+			rotated <- err
+		}()
+		for atomic.LoadInt32(&stub.requests) < 2 {
+			time.Sleep(time.Millisecond)
+		}
+
+		known := make(chan error)
+		go func() {
+			_, err := keys.Key("key-1")
+			known <- err
+		}()
+		select {
+		case err := <-known:
+			if err != nil {
+				t.Errorf("Key() error = %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Key() of a known key waited for the fetch")
+		}
+
+		stub.mu.Unlock()
+		if err := <-rotated; err != nil {
+			t.Errorf("Key() error = %v", err)
+		}
+	})
+
+	t.Run("Unknown keys should not be fetched more than once a minute", func(t *testing.T) {
+		stub := newJWKSStub("key-1")
+		defer stub.Close()
+
+		keys := NewJWKS(stub.URL)
+		for i := 0; i < 5; i++ {
+			keys.Key("made-up-key")
+		}
+
+		if requests := atomic.LoadInt32(&stub.requests); requests != 1 {
+			t.Errorf("JWKS was fetched %d times, want 1", requests)
+		}
+	})
+}
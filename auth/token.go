@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/ghodss/yaml"
+)
+
+// Token is a static API token given to a named client, allowed to manage the
+// webhooks of its teams, or all webhooks if it is an admin token.
+type Token struct {
+	Name  string   `json:"name"`
+	Token string   `json:"token"`
+	Teams []string `json:"teams"`
+	Admin bool     `json:"admin"`
+}
+
+// LoadTokens reads a YAML or JSON list of tokens, typically from a mounted
+// Secret.
+func LoadTokens(path string) ([]Token, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []Token
+	if err := json.Unmarshal(j, &tokens); err != nil {
+		return nil, err
+	}
+
+	for i, t := range tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, fmt.Errorf("token %d: name and token are required", i+1)
+		}
+	}
+
+	return tokens, nil
+}
+
+type tokenAuthenticator struct {
+	tokens []Token
+}
+
+func NewTokenAuthenticator(tokens []Token) *tokenAuthenticator {
+	return &tokenAuthenticator{tokens}
+}
+
+// Authenticate compares the token with every configured token in constant
+// time, so the time taken does not reveal which tokens exist.
+func (a *tokenAuthenticator) Authenticate(token string) (*Principal, error) {
+	var match *Token
+	for i := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.tokens[i].Token)) == 1 {
+			match = &a.tokens[i]
+		}
+	}
+
+	if match == nil {
+		return nil, ErrInvalidToken
+	}
+
+	return &Principal{Name: match.Name, Teams: match.Teams, Admin: match.Admin}, nil
+}
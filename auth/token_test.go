@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadTokens(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhookproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("Tokens should be read from YAML", func(t *testing.T) {
+		path := filepath.Join(dir, "tokens.yaml")
+		ioutil.WriteFile(path, []byte("- name: team-a-ci\n  token: s3cr3t\n  teams: [team-a]\n- name: admin\n  token: 4dm1n\n  admin: true\n"), 0600)
+
+		got, err := LoadTokens(path)
+		if err != nil {
+			t.Errorf("LoadTokens() error = %v", err)
+			return
+		}
+
+		want := []Token{
+			{Name: "team-a-ci", Token: "s3cr3t", Teams: []string{"team-a"}},
+			{Name: "admin", Token: "4dm1n", Admin: true},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("LoadTokens() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Token without value should fail", func(t *testing.T) {
+		path := filepath.Join(dir, "tokens.json")
+		ioutil.WriteFile(path, []byte(`[{"name": "team-a-ci"}]`), 0600)
+
+		if _, err := LoadTokens(path); err == nil {
+			t.Errorf("LoadTokens() should fail when token is empty")
+		}
+	})
+}
+
+func TestPrincipal_CanManage(t *testing.T) {
+	tests := []struct {
+		name      string
+		principal Principal
+		team      string
+		want      bool
+	}{
+		{"member should manage own team", Principal{Teams: []string{"team-a", "team-b"}}, "team-b", true},
+		{"non-member should not manage team", Principal{Teams: []string{"team-a"}}, "team-b", false},
+		{"admin should manage any team", Principal{Admin: true}, "team-b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.principal.CanManage(tt.team); got != tt.want {
+				t.Errorf("CanManage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_tokenAuthenticator_Authenticate(t *testing.T) {
+	a := NewTokenAuthenticator([]Token{
+		{Name: "team-a-ci", Token: "s3cr3t"},
+		{Name: "team-b-ci", Token: "0th3r", Teams: []string{"team-b"}},
+	})
+
+	t.Run("Known token should authenticate", func(t *testing.T) {
+		got, err := a.Authenticate("0th3r")
+		if err != nil {
+			t.Errorf("Authenticate() error = %v", err)
+			return
+		}
+		want := &Principal{Name: "team-b-ci", Teams: []string{"team-b"}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Authenticate() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Unknown token should fail", func(t *testing.T) {
+		if _, err := a.Authenticate("s3cr3"); err != ErrInvalidToken {
+			t.Errorf("Authenticate() error = %v, want %v", err, ErrInvalidToken)
+		}
+	})
+
+	t.Run("Chain should try every authenticator", func(t *testing.T) {
+		chained := Chain(NewTokenAuthenticator(nil), a)
+
+		got, err := chained.Authenticate("s3cr3t")
+		if err != nil {
+			t.Errorf("Authenticate() error = %v", err)
+			return
+		}
+		if got.Name != "team-a-ci" {
+			t.Errorf("Authenticate() = %v, want team-a-ci", got)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+// Package breaker keeps circuit breakers for the targets deliveries are
+// forwarded to, so deliveries to a target that is down fail right away
+// instead of waiting for the forward to time out.
+//
+// A circuit is closed while forwards succeed. It opens when Threshold
+// forwards in a row fail, and stays open for Cooldown seconds. Then it is
+// half-open, letting a single trial forward through: if it succeeds the
+// circuit closes, and if it fails the circuit opens again.
+package breaker
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the state of a circuit.
+type State int
+
+const (
+	Closed State = iota
+	HalfOpen
+	Open
+)
+
+func (s State) String() string {
+	switch s {
+	case HalfOpen:
+		return "half-open"
+	case Open:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Settings configure the circuits of the targets of a webhook. Unset
+// numbers are taken from DefaultSettings.
+type Settings struct {
+	// Threshold is how many forwards in a row have to fail to open the
+	// circuit.
+	Threshold int `json:"threshold,omitempty"`
+	// Cooldown is how many seconds the circuit stays open before a trial
+	// forward is let through.
+	Cooldown int `json:"cooldown,omitempty"`
+	// Divert queues deliveries to a target with an open circuit to be
+	// retried, instead of failing them.
+	Divert bool `json:"divert,omitempty"`
+}
+
+// DefaultSettings hold the settings used when a webhook leaves them unset.
+var DefaultSettings = Settings{
+	Threshold: 5,
+	Cooldown:  30,
+}
+
+// Validate checks that the numbers of s are not negative.
+func Validate(s *Settings) error {
+	if s == nil {
+		return nil
+	}
+	if s.Threshold < 0 || s.Cooldown < 0 {
+		return fmt.Errorf("circuit breaker settings must not be negative")
+	}
+	return nil
+}
+
+// settings returns s with defaults filled in.
+func settings(s *Settings) Settings {
+	c := DefaultSettings
+	if s == nil {
+		return c
+	}
+	if s.Threshold > 0 {
+		c.Threshold = s.Threshold
+	}
+	if s.Cooldown > 0 {
+		c.Cooldown = s.Cooldown
+	}
+	c.Divert = s.Divert
+	return c
+}
+
+// Status is the state of a circuit as shown to users. OpenedAt is set
+// unless the circuit is closed.
+type Status struct {
+	State    State      `json:"state"`
+	Failures int        `json:"failures,omitempty"`
+	OpenedAt *time.Time `json:"opened_at,omitempty"`
+}
+
+// Breaker is the circuit of one target. It is safe for concurrent use.
+type Breaker struct {
+	mu       sync.Mutex
+	state    State
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+// Allow reports whether a forward may be made at now, and when to try again
+// if not. Once the cooldown of an open circuit has passed, the forward
+// allowed is the trial, and others are refused until its outcome is
+// recorded.
+func (b *Breaker) Allow(s *Settings, now time.Time) (bool, time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cooldown := time.Duration(settings(s).Cooldown) * time.Second
+	switch b.state {
+	case Open:
+		if reopens := b.openedAt.Add(cooldown); now.Before(reopens) {
+			return false, reopens
+		}
+		b.state = HalfOpen
+		b.trial = true
+		return true, time.Time{}
+	case HalfOpen:
+		if b.trial {
+			return false, now.Add(cooldown)
+		}
+		b.trial = true
+		return true, time.Time{}
+	default:
+		return true, time.Time{}
+	}
+}
+
+// Record records the outcome of a forward allowed at now.
+func (b *Breaker) Record(success bool, s *Settings, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.trial = false
+	if success {
+		b.state = Closed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	switch b.state {
+	case HalfOpen:
+		b.state = Open
+		b.openedAt = now
+	case Closed:
+		if b.failures >= settings(s).Threshold {
+			b.state = Open
+			b.openedAt = now
+		}
+	}
+}
+
+// Status returns the state of the circuit.
+func (b *Breaker) Status() Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := Status{State: b.state, Failures: b.failures}
+	if b.state != Closed {
+		openedAt := b.openedAt
+		status.OpenedAt = &openedAt
+	}
+	return status
+}
+
+// Set holds the circuits of targets by key. It is safe for concurrent use.
+type Set struct {
+	mu       sync.Mutex
+	breakers map[string]*Breaker
+}
+
+func NewSet() *Set {
+	return &Set{breakers: map[string]*Breaker{}}
+}
+
+// Get returns the circuit under key, creating a closed one if there is none.
+func (s *Set) Get(key string) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.breakers[key]
+	if !ok {
+		b = &Breaker{}
+		s.breakers[key] = b
+	}
+	return b
+}
+
+// Lookup returns the circuit under key, or nil if none has been used.
+func (s *Set) Lookup(key string) *Breaker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.breakers[key]
+}
+
+// Remove forgets the circuit under key.
+func (s *Set) Remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.breakers, key)
+}
+
+// RemovePrefix forgets the circuits under keys starting with prefix.
+func (s *Set) RemovePrefix(prefix string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.breakers {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.breakers, key)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package breaker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	s := &Settings{Threshold: 2, Cooldown: 10}
+
+	open := func() *Breaker {
+		b := &Breaker{}
+		b.Record(false, s, now)
+		b.Record(false, s, now)
+		return b
+	}
+
+	t.Run("circuit should open after threshold failures in a row", func(t *testing.T) {
+		b := &Breaker{}
+		b.Record(false, s, now)
+		b.Record(true, s, now)
+		b.Record(false, s, now)
+		if ok, _ := b.Allow(s, now); !ok || b.Status().State != Closed {
+			t.Errorf("circuit should be closed after failures broken by a success, got %v", b.Status().State)
+		}
+
+		b.Record(false, s, now)
+		ok, retryAt := b.Allow(s, now.Add(time.Second))
+		if ok || b.Status().State != Open {
+			t.Errorf("circuit should be open after %d failures in a row, got %v", s.Threshold, b.Status().State)
+		}
+		if !retryAt.Equal(now.Add(10 * time.Second)) {
+			t.Errorf("Allow() retryAt = %v, want end of cooldown %v", retryAt, now.Add(10*time.Second))
+		}
+	})
+
+	t.Run("circuit should let one trial through after the cooldown", func(t *testing.T) {
+		b := open()
+
+		if ok, _ := b.Allow(s, now.Add(10*time.Second)); !ok {
+			t.Errorf("Allow() should let a trial through after the cooldown")
+		}
+		if b.Status().State != HalfOpen {
+			t.Errorf("circuit should be half-open during the trial, got %v", b.Status().State)
+		}
+		if ok, _ := b.Allow(s, now.Add(10*time.Second)); ok {
+			t.Errorf("Allow() should only let one trial through")
+		}
+	})
+
+	t.Run("successful trial should close the circuit", func(t *testing.T) {
+		b := open()
+		b.Allow(s, now.Add(10*time.Second))
+		b.Record(true, s, now.Add(10*time.Second))
+
+		if status := b.Status(); status.State != Closed || status.Failures != 0 || status.OpenedAt != nil {
+			t.Errorf("Status() = %+v, want closed", status)
+		}
+	})
+
+	t.Run("failed trial should open the circuit again", func(t *testing.T) {
+		b := open()
+		b.Allow(s, now.Add(10*time.Second))
+		b.Record(false, s, now.Add(11*time.Second))
+
+		if ok, retryAt := b.Allow(s, now.Add(12*time.Second)); ok || !retryAt.Equal(now.Add(21*time.Second)) {
+			t.Errorf("Allow() = %v, %v, want refused until %v", ok, retryAt, now.Add(21*time.Second))
+		}
+	})
+
+	t.Run("defaults should apply without settings", func(t *testing.T) {
+		b := &Breaker{}
+		for i := 0; i < DefaultSettings.Threshold-1; i++ {
+			b.Record(false, nil, now)
+		}
+		if b.Status().State != Closed {
+			t.Errorf("circuit should be closed before the default threshold")
+		}
+		b.Record(false, nil, now)
+		if b.Status().State != Open {
+			t.Errorf("circuit should be open at the default threshold")
+		}
+	})
+}
+
+func TestStatus_MarshalJSON(t *testing.T) {
+	b, _ := json.Marshal(Status{State: HalfOpen, Failures: 3})
+	if string(b) != `{"state":"half-open","failures":3}` {
+		t.Errorf("json.Marshal() = %s", b)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate(&Settings{Threshold: -1}); err == nil {
+		t.Errorf("Validate() should fail for a negative threshold")
+	}
+	if err := Validate(&Settings{Cooldown: -1}); err == nil {
+		t.Errorf("Validate() should fail for a negative cooldown")
+	}
+	if err := Validate(nil); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
@@ -2,28 +2,71 @@ package context
 
 import (
 	"net/http"
-	"io/ioutil"
+	"io"
+	"bytes"
+	"errors"
+	"sync"
 	"context"
 	"github.com/navikt/webhookproxy/webhook"
+	"github.com/navikt/webhookproxy/auth"
 )
 
 type requestContextKey int
 const (
 	requestBodyKey requestContextKey = iota
 	webhookKey
+	principalKey
 )
 
 
-func NewContextWithRequestBody(ctx context.Context, r *http.Request) (context.Context, error) {
-	body, err := ioutil.ReadAll(r.Body)
+// ErrRequestBodyTooLarge is returned when the request body is larger than
+// allowed.
+var ErrRequestBodyTooLarge = errors.New("request body too large")
+
+// maxPooledBufferSize keeps buffers grown by unusually large bodies from
+// being held on to by the pool.
+const maxPooledBufferSize = 1 << 20
+
+var buffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// NewContextWithRequestBody reads the body of r into a pooled buffer, failing
+// with ErrRequestBodyTooLarge after maxBytes. The body is valid until the
+// returned release func is called, which hands the buffer back to the pool.
+func NewContextWithRequestBody(ctx context.Context, r *http.Request, maxBytes int64) (context.Context, func(), error) {
 	defer r.Body.Close()
-	if err != nil {
-		return nil, err
+	if r.ContentLength > maxBytes {
+		return nil, nil, ErrRequestBodyTooLarge
 	}
 
-	return context.WithValue(ctx, requestBodyKey, body), nil
+	buf := buffers.Get().(*bytes.Buffer)
+	release := func() {
+		if buf.Cap() <= maxPooledBufferSize {
+			buf.Reset()
+			buffers.Put(buf)
+		}
+	}
+
+	if r.ContentLength > 0 {
+		buf.Grow(int(r.ContentLength))
+	}
+	if _, err := buf.ReadFrom(io.LimitReader(r.Body, maxBytes+1)); err != nil {
+		release()
+		return nil, nil, err
+	}
+	if int64(buf.Len()) > maxBytes {
+		release()
+		return nil, nil, ErrRequestBodyTooLarge
+	}
+
+	return context.WithValue(ctx, requestBodyKey, buf.Bytes()), release, nil
 }
 
+// RequestBodyFromContext returns the body read by NewContextWithRequestBody.
+// It is only valid until the handler returns, and must be copied to be kept.
 func RequestBodyFromContext(ctx context.Context) []byte {
 	return ctx.Value(requestBodyKey).([]byte)
 }
@@ -32,7 +75,20 @@ func NewContextWithWebhook(ctx context.Context,webhook *webhook.Webhook) context
 	return context.WithValue(ctx, webhookKey, webhook)
 }
 
+// WebhookFromContext returns the webhook the request is for, or nil outside
+// of the webhook routes.
 func WebhookFromContext(ctx context.Context) *webhook.Webhook {
-	return ctx.Value(webhookKey).(*webhook.Webhook)
+	webhook, _ := ctx.Value(webhookKey).(*webhook.Webhook)
+	return webhook
 }
 
+func NewContextWithPrincipal(ctx context.Context, principal *auth.Principal) context.Context {
+	return context.WithValue(ctx, principalKey, principal)
+}
+
+// PrincipalFromContext returns the authenticated caller, or nil when the
+// management API is not protected.
+func PrincipalFromContext(ctx context.Context) *auth.Principal {
+	principal, _ := ctx.Value(principalKey).(*auth.Principal)
+	return principal
+}
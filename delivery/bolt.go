@@ -0,0 +1,175 @@
+package delivery
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var deliveriesBucket = []byte("deliveries")
+
+// boltQueue keeps deliveries in an embedded bbolt database, one JSON value
+// per delivery keyed by id.
+type boltQueue struct {
+	db *bolt.DB
+}
+
+func NewBoltQueue(db *bolt.DB) (*boltQueue, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deliveriesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltQueue{db}, nil
+}
+
+func (q *boltQueue) put(b *bolt.Bucket, delivery *Delivery) error {
+	v, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(delivery.Id), v)
+}
+
+func (q *boltQueue) Enqueue(delivery *Delivery) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return q.put(tx.Bucket(deliveriesBucket), delivery)
+	})
+}
+
+func (q *boltQueue) Claim(now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	claimed := make([]*Delivery, 0)
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+
+		due := make([]*Delivery, 0)
+		err := b.ForEach(func(k, v []byte) error {
+			var d Delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if !d.NextAttempt.After(now) {
+				due = append(due, &d)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+		if len(due) > limit {
+			due = due[:limit]
+		}
+
+		for _, d := range due {
+			d.NextAttempt = now.Add(lease)
+			if err := q.put(b, d); err != nil {
+				return err
+			}
+			claimed = append(claimed, d)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claimed, nil
+}
+
+func (q *boltQueue) Update(delivery *Delivery) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(deliveriesBucket)
+		if b.Get([]byte(delivery.Id)) == nil {
+			return nil
+		}
+		return q.put(b, delivery)
+	})
+}
+
+func (q *boltQueue) Remove(id string) error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deliveriesBucket).Delete([]byte(id))
+	})
+}
+
+var deadLettersBucket = []byte("deadletters")
+
+// boltDeadLetters keeps dead letters in an embedded bbolt database, one JSON
+// value per delivery keyed by id.
+type boltDeadLetters struct {
+	db *bolt.DB
+}
+
+func NewBoltDeadLetters(db *bolt.DB) (*boltDeadLetters, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deadLettersBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltDeadLetters{db}, nil
+}
+
+func (l *boltDeadLetters) Save(delivery *Delivery) error {
+	v, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Put([]byte(delivery.Id), v)
+	})
+}
+
+func (l *boltDeadLetters) List(hookId string) ([]*Delivery, error) {
+	list := make([]*Delivery, 0)
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).ForEach(func(k, v []byte) error {
+			var d Delivery
+			if err := json.Unmarshal(v, &d); err != nil {
+				return err
+			}
+			if d.HookId == hookId {
+				list = append(list, &d)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortByCreatedAt(list)
+	return list, nil
+}
+
+func (l *boltDeadLetters) Get(id string) (*Delivery, error) {
+	var d *Delivery
+	err := l.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(deadLettersBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		d = &Delivery{}
+		return json.Unmarshal(v, d)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (l *boltDeadLetters) Remove(id string) error {
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(deadLettersBucket).Delete([]byte(id))
+	})
+}
@@ -0,0 +1,62 @@
+package delivery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhookproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks.db")
+
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("bolt.Open() error = %v", err)
+	}
+
+	q, err := NewBoltQueue(db)
+	if err != nil {
+		t.Fatalf("NewBoltQueue() error = %v", err)
+	}
+
+	testQueue(t, q)
+
+	deadLetters, err := NewBoltDeadLetters(db)
+	if err != nil {
+		t.Fatalf("NewBoltDeadLetters() error = %v", err)
+	}
+
+	testDeadLetters(t, deadLetters)
+
+	t.Run("Deliveries should survive reopening the queue", func(t *testing.T) {
+		d := newTestDelivery("my-hook", time.Now())
+		q.Enqueue(d)
+		db.Close()
+
+		db, err := bolt.Open(path, 0600, nil)
+		if err != nil {
+			t.Fatalf("bolt.Open() error = %v", err)
+		}
+		defer db.Close()
+
+		reopened, err := NewBoltQueue(db)
+		if err != nil {
+			t.Errorf("NewBoltQueue() error = %v", err)
+			return
+		}
+
+		claimed, _ := reopened.Claim(time.Now(), time.Minute, 10)
+		if len(claimed) != 1 || claimed[0].Id != d.Id {
+			t.Errorf("Claim() = %v, want [%v]", claimed, d)
+		}
+	})
+}
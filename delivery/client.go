@@ -0,0 +1,162 @@
+package delivery
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/navikt/webhookproxy/destination"
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// DefaultTimeout is how long a forward may take unless the client settings
+// of the webhook say otherwise.
+const DefaultTimeout = 5 * time.Second
+
+// unusedClientTTL is how long a client is kept after it was last used, so
+// clients of changed or deleted webhooks are closed.
+const unusedClientTTL = time.Hour
+
+// Clients builds the clients deliveries are forwarded with, one for every
+// client configuration of the webhooks, and keeps them so connections are
+// reused. Clients only connect to addresses allowed by the destination
+// policy, also when forwarding through a proxy, and only follow redirects to
+// urls it allows. Proxies from the
+// environment are not used, as the addresses could not be checked through
+// them. It is safe for concurrent use.
+type Clients struct {
+	policy     *destination.Policy
+	mu         sync.Mutex
+	clients    map[string]*cachedClient
+	lastPruned time.Time
+}
+
+type cachedClient struct {
+	client    *http.Client
+	transport *http.Transport
+	lastUsed  time.Time
+}
+
+func NewClients(policy *destination.Policy) *Clients {
+	return &Clients{policy: policy, clients: map[string]*cachedClient{}}
+}
+
+// Client returns the client for the client settings of wh.
+func (c *Clients) Client(wh *webhook.Webhook) (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.lastPruned) > unusedClientTTL {
+		for key, cached := range c.clients {
+			if now.Sub(cached.lastUsed) > unusedClientTTL {
+				cached.transport.CloseIdleConnections()
+				delete(c.clients, key)
+			}
+		}
+		c.lastPruned = now
+	}
+
+	key := clientKey(wh.Client, wh.ClientKey)
+	if cached, ok := c.clients[key]; ok {
+		cached.lastUsed = now
+		return cached.client, nil
+	}
+
+	client, transport, err := newClient(c.policy, wh.Client, wh.ClientKey)
+	if err != nil {
+		return nil, err
+	}
+	c.clients[key] = &cachedClient{client: client, transport: transport, lastUsed: now}
+	return client, nil
+}
+
+// clientKey tells client configurations apart. Webhooks without settings
+// share the default client.
+func clientKey(settings *webhook.ClientSettings, key []byte) string {
+	if settings == nil && key == nil {
+		return ""
+	}
+
+	b, _ := json.Marshal(settings)
+	h := sha256.New()
+	h.Write(b)
+	h.Write([]byte{0})
+	h.Write(key)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func newClient(policy *destination.Policy, settings *webhook.ClientSettings, key []byte) (*http.Client, *http.Transport, error) {
+	if settings == nil {
+		settings = &webhook.ClientSettings{}
+	}
+
+	timeout := DefaultTimeout
+	if settings.Timeout > 0 {
+		timeout = time.Duration(settings.Timeout) * time.Second
+	}
+
+	tlsConfig := &tls.Config{}
+	if settings.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(settings.CA)) {
+			return nil, nil, fmt.Errorf("no certificates in client ca")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if settings.Certificate != "" {
+		certificate, err := tls.X509KeyPair([]byte(settings.Certificate), key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	transport := &http.Transport{
+		DialContext:         policy.Dialer(DefaultTimeout).DialContext,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+	if settings.Proxy != "" {
+		proxy, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid client proxy: %v", err)
+		}
+		// the dialer only sees the address of the proxy, so the target is
+		// resolved and checked before every request instead. The proxy
+		// resolves it again, which leaves a short window for rebinding.
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := policy.CheckURL(req.URL.String()); err != nil {
+				return nil, err
+			}
+			if err := policy.CheckHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return proxy, nil
+		}
+	}
+
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("stopped after 10 redirects")
+			}
+			return policy.CheckURL(req.URL.String())
+		},
+	}
+	return client, transport, nil
+}
@@ -0,0 +1,215 @@
+package delivery
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/navikt/webhookproxy/allowlist"
+	"github.com/navikt/webhookproxy/destination"
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// newClientCertificate issues a client certificate from a new ca. It returns
+// the pool of the ca for servers to verify it with, and the PEM encoded
+// certificate and key.
+func newClientCertificate(t *testing.T) (*x509.CertPool, string, []byte) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "webhookproxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func certificatePEM(ts *httptest.Server) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}))
+}
+
+func post(t *testing.T, clients *Clients, wh *webhook.Webhook, url string) (*http.Response, error) {
+	client, err := clients.Client(wh)
+	if err != nil {
+		t.Fatalf("Client() error = %v", err)
+	}
+	res, err := client.Post(url, "application/json", strings.NewReader(`{}`))
+	if err == nil {
+		res.Body.Close()
+	}
+	return res, err
+}
+
+func TestClients(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("Client should trust the given ca", func(t *testing.T) {
+		ts := httptest.NewTLSServer(ok)
+		defer ts.Close()
+		clients := NewClients(&destination.Policy{})
+
+		if _, err := post(t, clients, &webhook.Webhook{}, ts.URL); err == nil {
+			t.Errorf("default client should not trust the certificate of the target")
+		}
+
+		wh := &webhook.Webhook{Client: &webhook.ClientSettings{CA: certificatePEM(ts)}}
+		if res, err := post(t, clients, wh, ts.URL); err != nil || res.StatusCode != http.StatusOK {
+			t.Errorf("client with the ca of the target should be able to post, got %v", err)
+		}
+	})
+
+	t.Run("Client should present the client certificate", func(t *testing.T) {
+		pool, certificate, key := newClientCertificate(t)
+		ts := httptest.NewUnstartedServer(ok)
+		ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+		ts.StartTLS()
+		defer ts.Close()
+		clients := NewClients(&destination.Policy{})
+
+		wh := &webhook.Webhook{Client: &webhook.ClientSettings{CA: certificatePEM(ts)}}
+		if _, err := post(t, clients, wh, ts.URL); err == nil {
+			t.Errorf("client without a certificate should be refused by the target")
+		}
+
+		wh = &webhook.Webhook{Client: &webhook.ClientSettings{CA: certificatePEM(ts), Certificate: certificate}, ClientKey: key}
+		if res, err := post(t, clients, wh, ts.URL); err != nil || res.StatusCode != http.StatusOK {
+			t.Errorf("client with a certificate should be able to post, got %v", err)
+		}
+	})
+
+	t.Run("Client should give up after the timeout", func(t *testing.T) {
+		done := make(chan struct{})
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+			}
+		}))
+		defer ts.Close()
+		defer close(done)
+		clients := NewClients(&destination.Policy{})
+
+		start := time.Now()
+		if _, err := post(t, clients, &webhook.Webhook{Client: &webhook.ClientSettings{Timeout: 1}}, ts.URL); err == nil {
+			t.Errorf("client should time out")
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("client timed out after %v, want about a second", elapsed)
+		}
+	})
+
+	t.Run("Client should forward through the proxy", func(t *testing.T) {
+		var proxied string
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied = r.URL.String()
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer proxy.Close()
+		clients := NewClients(&destination.Policy{})
+
+		wh := &webhook.Webhook{Client: &webhook.ClientSettings{Proxy: proxy.URL}}
+		if res, err := post(t, clients, wh, "http://internal-server.tld/hook"); err != nil || res.StatusCode != http.StatusOK {
+			t.Errorf("client should post through the proxy, got %v", err)
+		}
+		if proxied != "http://internal-server.tld/hook" {
+			t.Errorf("proxy received %v, want the target url", proxied)
+		}
+	})
+
+	t.Run("Client should not connect to a denied proxy", func(t *testing.T) {
+		proxy := httptest.NewServer(ok)
+		defer proxy.Close()
+		clients := NewClients(destination.DefaultPolicy())
+
+		wh := &webhook.Webhook{Client: &webhook.ClientSettings{Proxy: proxy.URL}}
+		if _, err := post(t, clients, wh, "http://10.0.0.1/hook"); err == nil || !strings.Contains(err.Error(), "is denied") {
+			t.Errorf("client should refuse to connect to a proxy on loopback, got %v", err)
+		}
+	})
+
+	t.Run("Client should not forward to a denied target through the proxy", func(t *testing.T) {
+		proxied := false
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			proxied = true
+		}))
+		defer proxy.Close()
+		private, _ := allowlist.ParseCIDRs([]string{"10.0.0.0/8"})
+		clients := NewClients(&destination.Policy{Denied: private})
+
+		wh := &webhook.Webhook{Client: &webhook.ClientSettings{Proxy: proxy.URL}}
+		if _, err := post(t, clients, wh, "http://10.1.2.3/hook"); err == nil || !strings.Contains(err.Error(), "is denied") {
+			t.Errorf("client should refuse a denied target behind the proxy, got %v", err)
+		}
+		if _, err := post(t, clients, wh, "http://internal-server.invalid/hook"); err == nil {
+			t.Errorf("client should refuse a target it cannot resolve when addresses are restricted")
+		}
+		if proxied {
+			t.Errorf("proxy should not have been used")
+		}
+	})
+
+	t.Run("Clients should be kept per configuration", func(t *testing.T) {
+		clients := NewClients(&destination.Policy{})
+		client := func(wh *webhook.Webhook) *http.Client {
+			c, err := clients.Client(wh)
+			if err != nil {
+				t.Fatalf("Client() error = %v", err)
+			}
+			return c
+		}
+
+		if client(&webhook.Webhook{Id: "a"}) != client(&webhook.Webhook{Id: "b"}) {
+			t.Errorf("webhooks without settings should share the default client")
+		}
+		if client(&webhook.Webhook{Client: &webhook.ClientSettings{Timeout: 10}}) != client(&webhook.Webhook{Client: &webhook.ClientSettings{Timeout: 10}}) {
+			t.Errorf("webhooks with the same settings should share a client")
+		}
+		if client(&webhook.Webhook{Client: &webhook.ClientSettings{Timeout: 10}}) == client(&webhook.Webhook{Client: &webhook.ClientSettings{Timeout: 20}}) {
+			t.Errorf("webhooks with different settings should not share a client")
+		}
+	})
+}
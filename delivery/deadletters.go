@@ -0,0 +1,73 @@
+package delivery
+
+import (
+	"sort"
+	"sync"
+)
+
+// DeadLetters keeps deliveries that could not be forwarded, with the body,
+// headers, target and attempts, until they are redelivered or discarded.
+// List returns the dead letters of a webhook, oldest first. Get returns nil
+// and no error when the dead letter does not exist. Implementations must be
+// safe for concurrent use.
+type DeadLetters interface {
+	Save(delivery *Delivery) error
+	List(hookId string) ([]*Delivery, error)
+	Get(id string) (*Delivery, error)
+	Remove(id string) error
+}
+
+func sortByCreatedAt(deliveries []*Delivery) {
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].CreatedAt.Before(deliveries[j].CreatedAt) })
+}
+
+// memoryDeadLetters keeps dead letters in process memory; they are lost on
+// restart.
+type memoryDeadLetters struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+func NewMemoryDeadLetters() *memoryDeadLetters {
+	return &memoryDeadLetters{deliveries: map[string]*Delivery{}}
+}
+
+func (l *memoryDeadLetters) Save(delivery *Delivery) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.deliveries[delivery.Id] = delivery.copy()
+	return nil
+}
+
+func (l *memoryDeadLetters) List(hookId string) ([]*Delivery, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := make([]*Delivery, 0)
+	for _, d := range l.deliveries {
+		if d.HookId == hookId {
+			list = append(list, d.copy())
+		}
+	}
+	sortByCreatedAt(list)
+	return list, nil
+}
+
+func (l *memoryDeadLetters) Get(id string) (*Delivery, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if d, ok := l.deliveries[id]; ok {
+		return d.copy(), nil
+	}
+	return nil, nil
+}
+
+func (l *memoryDeadLetters) Remove(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.deliveries, id)
+	return nil
+}
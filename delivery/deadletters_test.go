@@ -0,0 +1,84 @@
+package delivery
+
+import (
+	"testing"
+	"time"
+)
+
+func testDeadLetters(t *testing.T, l DeadLetters) {
+	t.Run("Get unknown dead letter should return nil", func(t *testing.T) {
+		got, err := l.Get("does-not-exist")
+		if err != nil {
+			t.Errorf("Get() error = %v", err)
+			return
+		}
+		if got != nil {
+			t.Errorf("Get() = %v, want nil", got)
+		}
+	})
+
+	t.Run("Saved dead letters should be listed per webhook, oldest first", func(t *testing.T) {
+		now := time.Now()
+		second := newTestDelivery("my-failing-hook", now)
+		second.CreatedAt = now
+		second.Attempts = []Attempt{{At: now, Status: 502, Error: "unexpected response status 502 Bad Gateway"}}
+		first := newTestDelivery("my-failing-hook", now)
+		first.CreatedAt = now.Add(-time.Minute)
+		other := newTestDelivery("my-other-hook", now)
+		for _, d := range []*Delivery{second, first, other} {
+			if err := l.Save(d); err != nil {
+				t.Errorf("Save() error = %v", err)
+				return
+			}
+			defer l.Remove(d.Id)
+		}
+
+		list, err := l.List("my-failing-hook")
+		if err != nil {
+			t.Errorf("List() error = %v", err)
+			return
+		}
+		if len(list) != 2 || list[0].Id != first.Id || list[1].Id != second.Id {
+			t.Errorf("List() = %v, want [%v %v]", list, first, second)
+			return
+		}
+		if len(list[1].Attempts) != 1 || list[1].Attempts[0].Status != 502 || string(list[1].Body) != string(second.Body) {
+			t.Errorf("List() = %v, want attempts and body of %v", list[1], second)
+		}
+	})
+
+	t.Run("Saving a dead letter again should update it", func(t *testing.T) {
+		d := newTestDelivery("my-failing-hook", time.Now())
+		l.Save(d)
+		defer l.Remove(d.Id)
+
+		d.Attempts = append(d.Attempts, Attempt{At: time.Now(), Error: "connection refused"})
+		l.Save(d)
+
+		got, _ := l.Get(d.Id)
+		if got == nil || len(got.Attempts) != 1 {
+			t.Errorf("Get() = %v, want updated dead letter", got)
+		}
+		if list, _ := l.List("my-failing-hook"); len(list) != 1 {
+			t.Errorf("List() = %v, want one dead letter", list)
+		}
+	})
+
+	t.Run("Removed dead letter should be gone", func(t *testing.T) {
+		d := newTestDelivery("my-failing-hook", time.Now())
+		l.Save(d)
+
+		if err := l.Remove(d.Id); err != nil {
+			t.Errorf("Remove() error = %v", err)
+			return
+		}
+
+		if got, _ := l.Get(d.Id); got != nil {
+			t.Errorf("Get() = %v, want nil", got)
+		}
+	})
+}
+
+func TestMemoryDeadLetters(t *testing.T) {
+	testDeadLetters(t, NewMemoryDeadLetters())
+}
@@ -0,0 +1,91 @@
+package delivery
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/navikt/webhookproxy/events"
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// Delivery is a payload received for a webhook that is to be forwarded to
+// one of the webhook's targets. Guid is the id the sender gave the delivery,
+// if any.
+type Delivery struct {
+	Id          string      `json:"id"`
+	HookId      string      `json:"hook_id"`
+	Guid        string      `json:"guid,omitempty"`
+	Event       string      `json:"event,omitempty"`
+	Target      string      `json:"target,omitempty"`
+	Url         string      `json:"url"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Attempts    []Attempt   `json:"attempts"`
+	NextAttempt time.Time   `json:"next_attempt"`
+}
+
+// Attempt records the outcome of one attempt to forward a delivery. Status
+// is zero if no response was received. Response holds the start of the
+// response body.
+type Attempt struct {
+	At       time.Time `json:"at"`
+	Latency  int64     `json:"latency_ms"`
+	Status   int       `json:"status,omitempty"`
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// New creates a delivery of body to a target of wh, due right away. The
+// event type and sender's id are taken from header.
+func New(wh *webhook.Webhook, target webhook.Target, header http.Header, body []byte) *Delivery {
+	now := time.Now()
+	return &Delivery{
+		Id:          newId(),
+		HookId:      wh.Id,
+		Guid:        events.Guid(wh.Provider, header),
+		Event:       events.Type(wh.Provider, header),
+		Target:      target.Name,
+		Url:         target.Url,
+		Header:      http.Header{"Content-Type": {"application/json"}},
+		Body:        body,
+		CreatedAt:   now,
+		NextAttempt: now,
+	}
+}
+
+// copy returns a copy of the delivery with its own header and attempts. The
+// body is shared, it is never modified in place.
+func (d *Delivery) copy() *Delivery {
+	c := *d
+	c.Header = make(http.Header, len(d.Header))
+	for k, v := range d.Header {
+		c.Header[k] = append([]string(nil), v...)
+	}
+	c.Attempts = append([]Attempt(nil), d.Attempts...)
+	return &c
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Queue holds deliveries until they have been forwarded. Queues must be safe
+// for concurrent use.
+type Queue interface {
+	Enqueue(delivery *Delivery) error
+	// Claim returns up to limit deliveries that are due at now, and postpones
+	// them to now+lease so they are not claimed again while being forwarded.
+	// A delivery claimed by a worker that dies is retried when the lease
+	// runs out.
+	Claim(now time.Time, lease time.Duration, limit int) ([]*Delivery, error)
+	// Update saves the attempts and next attempt of a claimed delivery.
+	Update(delivery *Delivery) error
+	Remove(id string) error
+}
@@ -0,0 +1,392 @@
+package delivery
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/navikt/webhookproxy/breaker"
+	"github.com/navikt/webhookproxy/signature"
+	"github.com/navikt/webhookproxy/webhook"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	deliveryAttemptCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "webhooks_delivery_attempts", Help: "number of attempts to forward queued deliveries per hook and result"}, []string{"hook", "result"},
+	)
+	deadLetterCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{Name: "webhooks_dead_letters", Help: "number of deliveries moved to the dead letters per hook"}, []string{"hook"},
+	)
+	circuitState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{Name: "webhooks_circuit_state", Help: "state of the circuit per hook and target, 0 closed, 1 half-open and 2 open"}, []string{"hook", "target"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(deliveryAttemptCount)
+	prometheus.MustRegister(deadLetterCount)
+	prometheus.MustRegister(circuitState)
+}
+
+var defaultJitter = 0.2
+
+// DefaultRetryPolicy holds the retry settings used when a target leaves them
+// unset.
+var DefaultRetryPolicy = webhook.RetryPolicy{
+	MaxAttempts:    8,
+	InitialBackoff: 10,
+	MaxBackoff:     3600,
+	Jitter:         &defaultJitter,
+}
+
+const (
+	pollInterval = time.Second
+	// claimLease must be longer than a forward can take, or a slow delivery
+	// is forwarded twice. Forwards are bounded by the client timeout.
+	claimLease = 2 * webhook.MaxClientTimeout * time.Second
+	claimLimit = 100
+)
+
+// random returns a number in [0, 1). It is replaced in tests.
+var random = rand.Float64
+
+// Dispatcher forwards queued deliveries, retrying failed forwards according
+// to the retry policy of their target until they succeed or run out of
+// attempts. Deliveries that run out of attempts are moved to the dead
+// letters.
+//
+// Every attempt to forward a delivery, queued or not, is recorded in the
+// history.
+type Dispatcher struct {
+	queue       Queue
+	deadLetters DeadLetters
+	history     *History
+	clients     *Clients
+	circuits    *breaker.Set
+	wake        chan struct{}
+}
+
+func NewDispatcher(queue Queue, deadLetters DeadLetters, history *History, clients *Clients) *Dispatcher {
+	return &Dispatcher{
+		queue:       queue,
+		deadLetters: deadLetters,
+		history:     history,
+		clients:     clients,
+		circuits:    breaker.NewSet(),
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Enqueue adds a delivery to the queue and wakes the dispatcher to forward
+// it.
+func (d *Dispatcher) Enqueue(delivery *Delivery) error {
+	if err := d.queue.Enqueue(delivery); err != nil {
+		return err
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run forwards due deliveries until stop is closed.
+func (d *Dispatcher) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		d.dispatch(time.Now())
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// dispatch claims the deliveries due at now and attempts to forward them.
+func (d *Dispatcher) dispatch(now time.Time) {
+	deliveries, err := d.queue.Claim(now, claimLease, claimLimit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to claim deliveries: %v\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		go func(delivery *Delivery) {
+			defer wg.Done()
+			d.attempt(delivery)
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) attempt(delivery *Delivery) {
+	wh, err := webhook.Get(delivery.HookId)
+	if err != nil {
+		// the delivery is attempted again when its claim runs out
+		fmt.Fprintf(os.Stderr, "Error: failed to look up webhook of delivery %v: %v\n", delivery.Id, err)
+		return
+	}
+	if wh == nil {
+		fmt.Printf("Dropping delivery %v, webhook %v no longer exists\n", delivery.Id, delivery.HookId)
+		d.remove(delivery)
+		return
+	}
+
+	target := wh.Target(delivery.Target)
+	if target == nil {
+		fmt.Printf("Dropping delivery %v, webhook %v no longer has target %v\n", delivery.Id, delivery.HookId, delivery.Target)
+		d.remove(delivery)
+		return
+	}
+	policy := retryPolicy(target.Retry)
+
+	fmt.Printf("Forwarding delivery %v to %v, attempt %d of %d\n", delivery.Id, delivery.Url, len(delivery.Attempts)+1, policy.MaxAttempts)
+	if _, err := d.Forward(delivery, wh); err != nil {
+		if open, ok := err.(*CircuitOpenError); ok {
+			// not an attempt, the delivery waits for the circuit instead
+			delivery.NextAttempt = open.RetryAt
+			if err := d.queue.Update(delivery); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: failed to reschedule delivery %v: %v\n", delivery.Id, err)
+			}
+			return
+		}
+
+		if len(delivery.Attempts) >= policy.MaxAttempts {
+			fmt.Fprintf(os.Stderr, "Error: giving up delivery %v to %v after %d attempts: %v\n", delivery.Id, delivery.Url, len(delivery.Attempts), err)
+			if err := d.DeadLetter(delivery); err != nil {
+				// the delivery is attempted again when its claim runs out
+				fmt.Fprintf(os.Stderr, "Error: failed to move delivery %v to the dead letters: %v\n", delivery.Id, err)
+				return
+			}
+			d.remove(delivery)
+			return
+		}
+
+		delivery.NextAttempt = time.Now().Add(backoff(policy, len(delivery.Attempts)))
+		if err := d.queue.Update(delivery); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to reschedule delivery %v: %v\n", delivery.Id, err)
+		}
+		return
+	}
+
+	d.remove(delivery)
+}
+
+func (d *Dispatcher) remove(delivery *Delivery) {
+	if err := d.queue.Remove(delivery.Id); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to remove delivery %v: %v\n", delivery.Id, err)
+	}
+}
+
+// DeadLetter keeps a delivery that could not be forwarded so it can be
+// inspected and redelivered.
+func (d *Dispatcher) DeadLetter(delivery *Delivery) error {
+	if err := d.deadLetters.Save(delivery); err != nil {
+		return err
+	}
+
+	deadLetterCount.With(prometheus.Labels{"hook": delivery.HookId}).Inc()
+	return nil
+}
+
+// Redeliver forwards a dead letter once more to the current url of its
+// target in wh. The dead letter is removed if the forward succeeds, and
+// updated with the failed attempt otherwise.
+func (d *Dispatcher) Redeliver(delivery *Delivery, wh *webhook.Webhook) error {
+	target := wh.Target(delivery.Target)
+	if target == nil {
+		return fmt.Errorf("webhook no longer has target %v", delivery.Target)
+	}
+	delivery.Url = target.Url
+
+	fmt.Printf("Redelivering delivery %v to %v\n", delivery.Id, delivery.Url)
+	if _, err := d.Forward(delivery, wh); err != nil {
+		if err := d.deadLetters.Save(delivery); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: failed to update dead letter %v: %v\n", delivery.Id, err)
+		}
+		return err
+	}
+
+	return d.deadLetters.Remove(delivery.Id)
+}
+
+// maxRecordedResponse is how much of a response body is kept with an
+// attempt.
+const maxRecordedResponse = 1024
+
+// CircuitOpenError is returned by Forward when the circuit of the target is
+// open, and the delivery was not posted.
+type CircuitOpenError struct {
+	RetryAt time.Time
+}
+
+func (e *CircuitOpenError) Error() string {
+	return "circuit of target is open until " + e.RetryAt.UTC().Format(time.RFC3339)
+}
+
+// Forward posts the delivery to its url once, signed with the signing secret
+// of its target in wh if it has one, adds the attempt to the delivery and
+// records it in the history. It returns the response body; a response other
+// than 2xx is returned along with an error. Nothing is posted while the
+// circuit of the target is open, and a *CircuitOpenError is returned.
+func (d *Dispatcher) Forward(delivery *Delivery, wh *webhook.Webhook) ([]byte, error) {
+	circuit := d.circuits.Get(circuitKey(delivery.HookId, delivery.Target, delivery.Url))
+	allowed, retryAt := circuit.Allow(wh.CircuitBreaker, time.Now())
+	d.observe(delivery, circuit)
+	if !allowed {
+		return nil, &CircuitOpenError{RetryAt: retryAt}
+	}
+
+	attempt := Attempt{At: time.Now()}
+	body, err := d.post(delivery, wh, &attempt)
+
+	// responses other than server errors tell the target is up
+	circuit.Record(err == nil || (attempt.Status != 0 && attempt.Status < 500), wh.CircuitBreaker, time.Now())
+	d.observe(delivery, circuit)
+	attempt.Latency = int64(time.Since(attempt.At) / time.Millisecond)
+	if len(body) > maxRecordedResponse {
+		attempt.Response = string(body[:maxRecordedResponse])
+	} else {
+		attempt.Response = string(body)
+	}
+
+	if err != nil {
+		attempt.Error = err.Error()
+		deliveryAttemptCount.With(prometheus.Labels{"hook": delivery.HookId, "result": "failure"}).Inc()
+	} else {
+		deliveryAttemptCount.With(prometheus.Labels{"hook": delivery.HookId, "result": "success"}).Inc()
+	}
+
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	d.history.Add(delivery)
+	return body, err
+}
+
+// Circuit is the state of the circuit of a target of a webhook.
+type Circuit struct {
+	Target string `json:"target,omitempty"`
+	Url    string `json:"url"`
+	breaker.Status
+}
+
+// Circuits returns the state of the circuits of the targets of wh that have
+// been forwarded to. The circuits of others are closed.
+func (d *Dispatcher) Circuits(wh *webhook.Webhook) []Circuit {
+	var circuits []Circuit
+	for _, target := range wh.AllTargets() {
+		if circuit := d.circuits.Lookup(circuitKey(wh.Id, target.Name, target.Url)); circuit != nil {
+			circuits = append(circuits, Circuit{Target: target.Name, Url: target.Url, Status: circuit.Status()})
+		}
+	}
+	return circuits
+}
+
+// RemoveCircuits forgets the circuits of a deleted webhook, including those
+// of urls its targets no longer have.
+func (d *Dispatcher) RemoveCircuits(wh *webhook.Webhook) {
+	d.circuits.RemovePrefix(wh.Id + "/")
+	for _, target := range wh.AllTargets() {
+		circuitState.Delete(prometheus.Labels{"hook": wh.Id, "target": target.Name})
+	}
+}
+
+// observe exposes the state of the circuit of the target of delivery.
+func (d *Dispatcher) observe(delivery *Delivery, circuit *breaker.Breaker) {
+	circuitState.With(prometheus.Labels{"hook": delivery.HookId, "target": delivery.Target}).Set(float64(circuit.Status().State))
+}
+
+// circuitKey returns the key of the circuit of a target of a webhook. The
+// unnamed target of a webhook without targets has the empty name. The url is
+// part of the key, so a target given a new url starts with a closed circuit.
+func circuitKey(hookId string, target string, url string) string {
+	return hookId + "/" + target + " " + url
+}
+
+func (d *Dispatcher) post(delivery *Delivery, wh *webhook.Webhook, attempt *Attempt) ([]byte, error) {
+	client, err := d.clients.Client(wh)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, delivery.Url, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = delivery.copy().Header
+	if signingSecret := wh.SigningSecret(delivery.Target); signingSecret != nil {
+		// signed on every attempt, so retries are not refused as too old
+		req.Header.Set(signature.Header, signature.Sign(signingSecret, attempt.At, delivery.Body))
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	attempt.Status = res.StatusCode
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return body, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return body, fmt.Errorf("unexpected response status %v", res.Status)
+	}
+	return body, nil
+}
+
+// retryPolicy returns retry with defaults filled in.
+func retryPolicy(retry *webhook.RetryPolicy) webhook.RetryPolicy {
+	policy := DefaultRetryPolicy
+	if retry == nil {
+		return policy
+	}
+
+	if retry.MaxAttempts > 0 {
+		policy.MaxAttempts = retry.MaxAttempts
+	}
+	if retry.InitialBackoff > 0 {
+		policy.InitialBackoff = retry.InitialBackoff
+	}
+	if retry.MaxBackoff > 0 {
+		policy.MaxBackoff = retry.MaxBackoff
+	}
+	if retry.Jitter != nil {
+		policy.Jitter = retry.Jitter
+	}
+	return policy
+}
+
+// backoff returns how long to wait before the next attempt after the given
+// number of failed attempts.
+func backoff(policy webhook.RetryPolicy, attempts int) time.Duration {
+	delay := time.Duration(policy.InitialBackoff) * time.Second
+	max := time.Duration(policy.MaxBackoff) * time.Second
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	if policy.Jitter == nil {
+		return delay
+	}
+	jitter := *policy.Jitter * (2*random() - 1)
+	return time.Duration(float64(delay) * (1 + jitter))
+}
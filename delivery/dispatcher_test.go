@@ -0,0 +1,308 @@
+package delivery
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/navikt/webhookproxy/breaker"
+	"github.com/navikt/webhookproxy/destination"
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func Test_backoff(t *testing.T) {
+	random = func() float64 { return 0.5 }
+	defer func() { random = rand.Float64 }()
+
+	jitter := 0.2
+	policy := webhook.RetryPolicy{MaxAttempts: 10, InitialBackoff: 10, MaxBackoff: 60, Jitter: &jitter}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 10 * time.Second},
+		{2, 20 * time.Second},
+		{3, 40 * time.Second},
+		{4, 60 * time.Second},
+		{9, 60 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(policy, tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+
+	random = func() float64 { return 0 }
+	if got := backoff(policy, 1); got != 8*time.Second {
+		t.Errorf("backoff() with jitter = %v, want %v", got, 8*time.Second)
+	}
+
+	jitter = 0
+	if got := backoff(policy, 1); got != 10*time.Second {
+		t.Errorf("backoff() without jitter = %v, want %v", got, 10*time.Second)
+	}
+}
+
+func Test_retryPolicy(t *testing.T) {
+	got := retryPolicy(&webhook.RetryPolicy{MaxAttempts: 3})
+	want := DefaultRetryPolicy
+	want.MaxAttempts = 3
+	if got != want {
+		t.Errorf("retryPolicy() = %v, want %v", got, want)
+	}
+
+	noJitter := 0.0
+	if got := retryPolicy(&webhook.RetryPolicy{Jitter: &noJitter}); *got.Jitter != 0 {
+		t.Errorf("retryPolicy() jitter = %v, want 0 to turn jitter off", *got.Jitter)
+	}
+}
+
+// targetStub answers with the given status codes in order, then 200.
+type targetStub struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (s *targetStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, _ := ioutil.ReadAll(r.Body)
+	s.bodies = append(s.bodies, string(body))
+
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func (s *targetStub) requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.bodies)
+}
+
+func newTestHook(t *testing.T, url string, retry *webhook.RetryPolicy) *webhook.Webhook {
+	wh := &webhook.Webhook{Id: "my-async-hook", Name: "my-async-hook", Team: "my-team", Url: url, Async: true, Retry: retry}
+	if _, err := webhook.Save(wh); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	return wh
+}
+
+func TestDispatcher(t *testing.T) {
+	random = func() float64 { return 0.5 }
+	defer func() { random = rand.Float64 }()
+
+	t.Run("Successful delivery should be removed from the queue", func(t *testing.T) {
+		target := &targetStub{}
+		ts := httptest.NewServer(target)
+		defer ts.Close()
+		wh := newTestHook(t, ts.URL, nil)
+		defer webhook.Delete(wh.Id)
+
+		q := NewMemoryQueue()
+		d := NewDispatcher(q, NewMemoryDeadLetters(), NewHistory(10, time.Hour), NewClients(&destination.Policy{}))
+		d.Enqueue(New(wh, wh.AllTargets()[0], nil, []byte(`{"zen": "Design for failure."}`)))
+
+		d.dispatch(time.Now())
+
+		if target.requests() != 1 || target.bodies[0] != `{"zen": "Design for failure."}` {
+			t.Errorf("target received %v, want the delivery once", target.bodies)
+		}
+		if claimed, _ := q.Claim(time.Now().Add(time.Hour), time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("queue has %v, want none", claimed)
+		}
+	})
+
+	t.Run("Failed delivery should be retried after backoff", func(t *testing.T) {
+		target := &targetStub{statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+		ts := httptest.NewServer(target)
+		defer ts.Close()
+		wh := newTestHook(t, ts.URL, &webhook.RetryPolicy{InitialBackoff: 10})
+		defer webhook.Delete(wh.Id)
+
+		q := NewMemoryQueue()
+		d := NewDispatcher(q, NewMemoryDeadLetters(), NewHistory(10, time.Hour), NewClients(&destination.Policy{}))
+		d.Enqueue(New(wh, wh.AllTargets()[0], nil, []byte(`{}`)))
+
+		now := time.Now()
+		d.dispatch(now)
+		d.dispatch(now.Add(5 * time.Second))
+		if target.requests() != 1 {
+			t.Errorf("target received %d requests before backoff, want 1", target.requests())
+		}
+
+		d.dispatch(now.Add(11 * time.Second))
+		if target.requests() != 2 {
+			t.Errorf("target received %d requests after first backoff, want 2", target.requests())
+		}
+
+		d.dispatch(now.Add(32 * time.Second))
+		if target.requests() != 3 {
+			t.Errorf("target received %d requests after second backoff, want 3", target.requests())
+		}
+
+		if claimed, _ := q.Claim(now.Add(time.Hour), time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("queue has %v, want none", claimed)
+		}
+	})
+
+	t.Run("Delivery should be moved to the dead letters after max attempts", func(t *testing.T) {
+		target := &targetStub{statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway}}
+		ts := httptest.NewServer(target)
+		defer ts.Close()
+		wh := newTestHook(t, ts.URL, &webhook.RetryPolicy{MaxAttempts: 2, InitialBackoff: 1})
+		defer webhook.Delete(wh.Id)
+
+		q := NewMemoryQueue()
+		deadLetters := NewMemoryDeadLetters()
+		d := NewDispatcher(q, deadLetters, NewHistory(10, time.Hour), NewClients(&destination.Policy{}))
+		queued := New(wh, wh.AllTargets()[0], nil, []byte(`{}`))
+		d.Enqueue(queued)
+
+		now := time.Now()
+		d.dispatch(now)
+		d.dispatch(now.Add(2 * time.Second))
+		d.dispatch(now.Add(time.Hour))
+
+		if target.requests() != 2 {
+			t.Errorf("target received %d requests, want 2", target.requests())
+		}
+		if claimed, _ := q.Claim(now.Add(2*time.Hour), time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("queue has %v, want none", claimed)
+		}
+
+		dead, _ := deadLetters.Get(queued.Id)
+		if dead == nil || len(dead.Attempts) != 2 || dead.Attempts[1].Status != http.StatusBadGateway || string(dead.Body) != `{}` {
+			t.Errorf("dead letter = %v, want delivery with both attempts", dead)
+		}
+	})
+
+	t.Run("Redelivered dead letter should be removed when it succeeds", func(t *testing.T) {
+		target := &targetStub{statuses: []int{http.StatusInternalServerError}}
+		ts := httptest.NewServer(target)
+		defer ts.Close()
+		wh := newTestHook(t, ts.URL, nil)
+		defer webhook.Delete(wh.Id)
+
+		deadLetters := NewMemoryDeadLetters()
+		d := NewDispatcher(NewMemoryQueue(), deadLetters, NewHistory(10, time.Hour), NewClients(&destination.Policy{}))
+		dead := New(&webhook.Webhook{Id: wh.Id}, webhook.Target{Url: "http://old-server.tld/hook"}, nil, []byte(`{}`))
+		d.DeadLetter(dead)
+
+		if err := d.Redeliver(dead, wh); err == nil {
+			t.Errorf("Redeliver() should fail when the target fails")
+		}
+		if got, _ := deadLetters.Get(dead.Id); got == nil || len(got.Attempts) != 1 || got.Url != ts.URL {
+			t.Errorf("dead letter = %v, want failed attempt to the webhook's url", got)
+		}
+
+		if err := d.Redeliver(dead, wh); err != nil {
+			t.Errorf("Redeliver() error = %v", err)
+		}
+		if got, _ := deadLetters.Get(dead.Id); got != nil {
+			t.Errorf("dead letter = %v, want removed", got)
+		}
+		if target.requests() != 2 {
+			t.Errorf("target received %d requests, want 2", target.requests())
+		}
+	})
+
+	t.Run("Delivery to an open circuit should wait for it without using an attempt", func(t *testing.T) {
+		target := &targetStub{statuses: []int{http.StatusServiceUnavailable}}
+		ts := httptest.NewServer(target)
+		defer ts.Close()
+		wh := newTestHook(t, ts.URL, &webhook.RetryPolicy{InitialBackoff: 1})
+		wh.CircuitBreaker = &breaker.Settings{Threshold: 1, Cooldown: 60}
+		webhook.Save(wh)
+		defer webhook.Delete(wh.Id)
+
+		q := NewMemoryQueue()
+		d := NewDispatcher(q, NewMemoryDeadLetters(), NewHistory(10, time.Hour), NewClients(&destination.Policy{}))
+		d.Enqueue(New(wh, wh.AllTargets()[0], nil, []byte(`{}`)))
+
+		now := time.Now()
+		d.dispatch(now)
+
+		waiting := New(wh, wh.AllTargets()[0], nil, []byte(`{}`))
+		d.Enqueue(waiting)
+		d.dispatch(time.Now())
+
+		if target.requests() != 1 {
+			t.Errorf("target received %d requests, want 1 before the circuit opened", target.requests())
+		}
+		claimed, _ := q.Claim(now.Add(30*time.Second), time.Minute, 10)
+		if len(claimed) != 1 || claimed[0].Id == waiting.Id {
+			t.Errorf("queue has %v due before the cooldown, want only the failed delivery", claimed)
+		}
+		claimed, _ = q.Claim(now.Add(61*time.Second), time.Minute, 10)
+		if len(claimed) != 1 || claimed[0].Id != waiting.Id || len(claimed[0].Attempts) != 0 {
+			t.Errorf("queue has %v due after the cooldown, want the waiting delivery without attempts", claimed)
+		}
+
+		circuits := d.Circuits(wh)
+		if len(circuits) != 1 || circuits[0].State != breaker.Open || circuits[0].Failures != 1 {
+			t.Errorf("Circuits() = %+v, want the open circuit", circuits)
+		}
+	})
+
+	t.Run("Target given a new url should not inherit the circuit of the old one", func(t *testing.T) {
+		failing := &targetStub{statuses: []int{http.StatusServiceUnavailable}}
+		old := httptest.NewServer(failing)
+		defer old.Close()
+		target := &targetStub{}
+		ts := httptest.NewServer(target)
+		defer ts.Close()
+		wh := newTestHook(t, old.URL, nil)
+		wh.CircuitBreaker = &breaker.Settings{Threshold: 1, Cooldown: 60}
+		webhook.Save(wh)
+		defer webhook.Delete(wh.Id)
+
+		d := NewDispatcher(NewMemoryQueue(), NewMemoryDeadLetters(), NewHistory(10, time.Hour), NewClients(&destination.Policy{}))
+		if _, err := d.Forward(New(wh, wh.AllTargets()[0], nil, []byte(`{}`)), wh); err == nil {
+			t.Errorf("Forward() should fail when the target fails")
+		}
+
+		wh.Url = ts.URL
+		webhook.Save(wh)
+		if _, err := d.Forward(New(wh, wh.AllTargets()[0], nil, []byte(`{}`)), wh); err != nil {
+			t.Errorf("Forward() error = %v, want the new url forwarded to", err)
+		}
+		if target.requests() != 1 {
+			t.Errorf("target received %d requests, want 1", target.requests())
+		}
+
+		d.RemoveCircuits(wh)
+		if circuit := d.circuits.Lookup(circuitKey(wh.Id, "", old.URL)); circuit != nil {
+			t.Errorf("RemoveCircuits() kept the circuit of the old url")
+		}
+	})
+
+	t.Run("Delivery for a deleted webhook should be dropped", func(t *testing.T) {
+		target := &targetStub{}
+		ts := httptest.NewServer(target)
+		defer ts.Close()
+		wh := newTestHook(t, ts.URL, nil)
+		webhook.Delete(wh.Id)
+
+		q := NewMemoryQueue()
+		d := NewDispatcher(q, NewMemoryDeadLetters(), NewHistory(10, time.Hour), NewClients(&destination.Policy{}))
+		d.Enqueue(New(wh, wh.AllTargets()[0], nil, []byte(`{}`)))
+
+		d.dispatch(time.Now())
+
+		if target.requests() != 0 {
+			t.Errorf("target received %d requests, want none", target.requests())
+		}
+		if claimed, _ := q.Claim(time.Now().Add(time.Hour), time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("queue has %v, want none", claimed)
+		}
+	})
+}
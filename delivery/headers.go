@@ -0,0 +1,123 @@
+package delivery
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// DefaultForwardedHeaders are the headers of received deliveries forwarded
+// to targets unless the webhook has its own allowlist. They tell the event,
+// the sender's delivery id and the signatures.
+var DefaultForwardedHeaders = []string{
+	"User-Agent",
+	"X-Github-Event",
+	"X-Github-Delivery",
+	"X-Github-Hook-Id",
+	"X-Github-Hook-Installation-Target-Id",
+	"X-Github-Hook-Installation-Target-Type",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Gitlab-Event",
+	"X-Gitlab-Event-Uuid",
+	"X-Event-Key",
+	"X-Request-Uuid",
+	"X-Hook-Uuid",
+	"X-Gitea-Event",
+	"X-Gitea-Delivery",
+	"X-Gitea-Signature",
+	"X-Slack-Request-Timestamp",
+	"X-Slack-Signature",
+	"Stripe-Signature",
+}
+
+// SensitiveHeaders hold credentials or signatures made with the webhook
+// secret. They are stripped from forwarded deliveries when the header policy
+// of the webhook asks for it.
+var SensitiveHeaders = []string{
+	"Authorization",
+	"Cookie",
+	"X-Hub-Signature",
+	"X-Hub-Signature-256",
+	"X-Gitlab-Token",
+	"X-Gitea-Signature",
+	"X-Slack-Signature",
+	"Stripe-Signature",
+}
+
+// HookIdHeader tells targets which webhook a delivery was received on.
+const HookIdHeader = "X-Webhookproxy-Hook-Id"
+
+// ForwardedHeader returns the headers of r to forward to the targets of wh
+// by its header policy, with X-Forwarded-For, Forwarded and HookIdHeader
+// added.
+func ForwardedHeader(wh *webhook.Webhook, r *http.Request) http.Header {
+	allow := DefaultForwardedHeaders
+	var strip []string
+	if policy := wh.Headers; policy != nil {
+		if len(policy.Allow) > 0 {
+			allow = policy.Allow
+		}
+		strip = policy.Strip
+		if policy.StripSensitive {
+			strip = append(append([]string(nil), strip...), SensitiveHeaders...)
+		}
+	}
+
+	header := http.Header{}
+	for _, name := range allow {
+		if values, ok := r.Header[http.CanonicalHeaderKey(name)]; ok {
+			header[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+		}
+	}
+	for _, name := range strip {
+		header.Del(name)
+	}
+
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+		header.Set("X-Forwarded-For", prior+", "+client)
+	} else {
+		header.Set("X-Forwarded-For", client)
+	}
+
+	forwarded := "for=" + forwardedNode(client) + ";host=" + quote(r.Host) + ";proto=" + scheme(r)
+	if prior := r.Header.Get("Forwarded"); prior != "" {
+		forwarded = prior + ", " + forwarded
+	}
+	header.Set("Forwarded", forwarded)
+
+	header.Set(HookIdHeader, wh.Id)
+	return header
+}
+
+// forwardedNode formats an address for the Forwarded header, which wants
+// IPv6 addresses bracketed and quoted.
+func forwardedNode(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() == nil {
+		return `"[` + ip + `]"`
+	}
+	return quote(ip)
+}
+
+// quote quotes values of the Forwarded header that are not tokens, like
+// hosts with a port.
+func quote(value string) string {
+	if strings.ContainsAny(value, ":[]\" ,;=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+func scheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
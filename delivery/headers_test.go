@@ -0,0 +1,78 @@
+package delivery
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func TestForwardedHeader(t *testing.T) {
+	newRequest := func() *http.Request {
+		r := httptest.NewRequest("POST", "http://proxy.tld/hooks/abc", strings.NewReader("{}"))
+		r.RemoteAddr = "140.82.115.1:43210"
+		r.Header.Set("User-Agent", "GitHub-Hookshot/044aadd")
+		r.Header.Set("X-Github-Event", "push")
+		r.Header.Set("X-Github-Delivery", "72d3162e-cc78-11e3-81ab-4c9367dc0958")
+		r.Header.Set("X-Hub-Signature-256", "sha256=d57c68ca6f92289e6987922ff26938930f6e66a2d161ef06abdf1859230aa23c")
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("Accept", "*/*")
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		policy *webhook.HeaderPolicy
+		want   http.Header
+	}{
+		{"default allowlist", nil, http.Header{
+			"User-Agent":          {"GitHub-Hookshot/044aadd"},
+			"X-Github-Event":      {"push"},
+			"X-Github-Delivery":   {"72d3162e-cc78-11e3-81ab-4c9367dc0958"},
+			"X-Hub-Signature-256": {"sha256=d57c68ca6f92289e6987922ff26938930f6e66a2d161ef06abdf1859230aa23c"},
+		}},
+		{"own allowlist", &webhook.HeaderPolicy{Allow: []string{"x-github-event", "Accept"}}, http.Header{
+			"X-Github-Event": {"push"},
+			"Accept":         {"*/*"},
+		}},
+		{"stripped headers", &webhook.HeaderPolicy{Strip: []string{"User-Agent"}}, http.Header{
+			"X-Github-Event":      {"push"},
+			"X-Github-Delivery":   {"72d3162e-cc78-11e3-81ab-4c9367dc0958"},
+			"X-Hub-Signature-256": {"sha256=d57c68ca6f92289e6987922ff26938930f6e66a2d161ef06abdf1859230aa23c"},
+		}},
+		{"stripped sensitive headers", &webhook.HeaderPolicy{Allow: []string{"X-Github-Event", "Authorization"}, StripSensitive: true}, http.Header{
+			"X-Github-Event": {"push"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := &webhook.Webhook{Id: "abc", Headers: tt.policy}
+			tt.want.Set("X-Forwarded-For", "140.82.115.1")
+			tt.want.Set("Forwarded", "for=140.82.115.1;host=proxy.tld;proto=http")
+			tt.want.Set("X-Webhookproxy-Hook-Id", "abc")
+
+			if got := ForwardedHeader(wh, newRequest()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ForwardedHeader() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("prior proxies should be kept", func(t *testing.T) {
+		r := newRequest()
+		r.RemoteAddr = "[2001:db8::1]:443"
+		r.Host = "proxy.tld:8080"
+		r.Header.Set("X-Forwarded-For", "140.82.115.1")
+		r.Header.Set("Forwarded", "for=140.82.115.1")
+
+		got := ForwardedHeader(&webhook.Webhook{Id: "abc"}, r)
+		if want := "140.82.115.1, 2001:db8::1"; got.Get("X-Forwarded-For") != want {
+			t.Errorf("X-Forwarded-For = %v, want %v", got.Get("X-Forwarded-For"), want)
+		}
+		if want := `for=140.82.115.1, for="[2001:db8::1]";host="proxy.tld:8080";proto=http`; got.Get("Forwarded") != want {
+			t.Errorf("Forwarded = %v, want %v", got.Get("Forwarded"), want)
+		}
+	})
+}
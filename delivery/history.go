@@ -0,0 +1,156 @@
+package delivery
+
+import (
+	"sync"
+	"time"
+)
+
+// Outcomes of received deliveries kept in the history.
+const (
+	OutcomeForwarded   = "forwarded"
+	OutcomeFiltered    = "filtered"
+	OutcomeDropped     = "dropped"
+	OutcomeReplayed    = "replayed"
+	OutcomeRateLimited = "rate_limited"
+)
+
+// Record describes one attempt to forward a delivery, kept in the history
+// of its webhook. Deliveries that were not forwarded are recorded with the
+// status and message they were answered with instead, and no target.
+type Record struct {
+	DeliveryId string    `json:"delivery_id,omitempty"`
+	HookId     string    `json:"hook_id"`
+	Guid       string    `json:"guid,omitempty"`
+	Event      string    `json:"event,omitempty"`
+	Target     string    `json:"target,omitempty"`
+	Outcome    string    `json:"outcome"`
+	ReceivedAt time.Time `json:"received_at"`
+	Attempt
+}
+
+// Failed reports whether the attempt did not get a 2xx response.
+func (r *Record) Failed() bool {
+	return r.Status < 200 || r.Status > 299
+}
+
+// Filter selects records in the history. Zero fields match any record.
+type Filter struct {
+	Event   string
+	Guid    string
+	Outcome string
+	Status  int
+	Failed  bool
+}
+
+func (f Filter) matches(r *Record) bool {
+	return (f.Event == "" || f.Event == r.Event) &&
+		(f.Guid == "" || f.Guid == r.Guid) &&
+		(f.Outcome == "" || f.Outcome == r.Outcome) &&
+		(f.Status == 0 || f.Status == r.Status) &&
+		(!f.Failed || r.Failed())
+}
+
+// History keeps the latest forward attempts and unforwarded deliveries per
+// webhook in process memory, at most maxRecords per webhook and none older
+// than maxAge. Each replica only has the deliveries it received. It is safe
+// for concurrent use.
+type History struct {
+	mu         sync.Mutex
+	records    map[string][]*Record
+	maxRecords int
+	maxAge     time.Duration
+}
+
+func NewHistory(maxRecords int, maxAge time.Duration) *History {
+	return &History{
+		records:    map[string][]*Record{},
+		maxRecords: maxRecords,
+		maxAge:     maxAge,
+	}
+}
+
+// Add records the last attempt of delivery.
+func (h *History) Add(delivery *Delivery) {
+	if len(delivery.Attempts) == 0 {
+		return
+	}
+
+	record := &Record{
+		DeliveryId: delivery.Id,
+		HookId:     delivery.HookId,
+		Guid:       delivery.Guid,
+		Event:      delivery.Event,
+		Target:     delivery.Target,
+		Outcome:    OutcomeForwarded,
+		ReceivedAt: delivery.CreatedAt,
+		Attempt:    delivery.Attempts[len(delivery.Attempts)-1],
+	}
+	h.add(record)
+}
+
+// AddUnforwarded records a delivery received for a webhook that was not
+// forwarded for outcome, and was answered with status and message.
+func (h *History) AddUnforwarded(hookId string, guid string, event string, outcome string, status int, message string) {
+	now := time.Now()
+	h.add(&Record{
+		HookId:     hookId,
+		Guid:       guid,
+		Event:      event,
+		Outcome:    outcome,
+		ReceivedAt: now,
+		Attempt:    Attempt{At: now, Status: status, Response: message},
+	})
+}
+
+func (h *History) add(record *Record) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	records := h.prune(append(h.records[record.HookId], record))
+	if len(records) > h.maxRecords {
+		// copy rather than reslice so the dropped records can be collected
+		records = append([]*Record(nil), records[len(records)-h.maxRecords:]...)
+	}
+	h.records[record.HookId] = records
+}
+
+// prune drops the records older than maxAge. It must be called with mu held.
+func (h *History) prune(records []*Record) []*Record {
+	oldest := time.Now().Add(-h.maxAge)
+	for i, r := range records {
+		if r.At.After(oldest) {
+			return records[i:]
+		}
+	}
+	return nil
+}
+
+// List returns the records of a webhook matching filter, newest first,
+// skipping offset records and returning at most limit.
+func (h *History) List(hookId string, filter Filter, offset int, limit int) []*Record {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	records := h.prune(h.records[hookId])
+	list := make([]*Record, 0)
+	for i := len(records) - 1; i >= 0 && len(list) < limit; i-- {
+		if !filter.matches(records[i]) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		c := *records[i]
+		list = append(list, &c)
+	}
+	return list
+}
+
+// Remove drops the history of a webhook.
+func (h *History) Remove(hookId string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.records, hookId)
+}
@@ -0,0 +1,114 @@
+package delivery
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func newTestRecord(hookId string, guid string, event string, status int, at time.Time) *Delivery {
+	header := http.Header{"X-Github-Delivery": {guid}, "X-Github-Event": {event}}
+	d := New(&webhook.Webhook{Id: hookId}, webhook.Target{Url: "http://internal-server.tld/hook"}, header, []byte(`{}`))
+	d.Attempts = []Attempt{{At: at, Status: status}}
+	return d
+}
+
+func guids(records []*Record) []string {
+	list := make([]string, 0, len(records))
+	for _, r := range records {
+		list = append(list, r.Guid)
+	}
+	return list
+}
+
+func TestHistory(t *testing.T) {
+	now := time.Now()
+
+	t.Run("List should return records of the webhook, newest first", func(t *testing.T) {
+		h := NewHistory(10, time.Hour)
+		h.Add(newTestRecord("my-hook", "1", "push", 200, now))
+		h.Add(newTestRecord("my-other-hook", "2", "push", 200, now))
+		h.Add(newTestRecord("my-hook", "3", "issues", 502, now))
+
+		records := h.List("my-hook", Filter{}, 0, 10)
+		if got := guids(records); fmt.Sprint(got) != "[3 1]" {
+			t.Errorf("List() = %v, want [3 1]", got)
+			return
+		}
+		if r := records[0]; r.Event != "issues" || r.Status != 502 || r.HookId != "my-hook" {
+			t.Errorf("List() = %v, want event, status and hook of the delivery", r)
+		}
+	})
+
+	t.Run("History should keep at most maxRecords per webhook", func(t *testing.T) {
+		h := NewHistory(2, time.Hour)
+		for i := 1; i <= 3; i++ {
+			h.Add(newTestRecord("my-hook", fmt.Sprint(i), "push", 200, now))
+		}
+
+		if got := guids(h.List("my-hook", Filter{}, 0, 10)); fmt.Sprint(got) != "[3 2]" {
+			t.Errorf("List() = %v, want [3 2]", got)
+		}
+	})
+
+	t.Run("History should drop records older than maxAge", func(t *testing.T) {
+		h := NewHistory(10, time.Hour)
+		h.Add(newTestRecord("my-hook", "1", "push", 200, now.Add(-2*time.Hour)))
+		h.Add(newTestRecord("my-hook", "2", "push", 200, now))
+
+		if got := guids(h.List("my-hook", Filter{}, 0, 10)); fmt.Sprint(got) != "[2]" {
+			t.Errorf("List() = %v, want [2]", got)
+		}
+	})
+
+	t.Run("Unforwarded deliveries should be kept with their outcome", func(t *testing.T) {
+		h := NewHistory(10, time.Hour)
+		h.Add(newTestRecord("my-hook", "1", "push", 200, now))
+		h.AddUnforwarded("my-hook", "2", "issues", OutcomeFiltered, 202, "event issues is filtered and not forwarded")
+		h.AddUnforwarded("my-hook", "3", "push", OutcomeRateLimited, 429, "rate limit of hook exceeded")
+
+		if got := guids(h.List("my-hook", Filter{Outcome: OutcomeFiltered}, 0, 10)); fmt.Sprint(got) != "[2]" {
+			t.Errorf("List() = %v, want [2]", got)
+		}
+		if got := guids(h.List("my-hook", Filter{Failed: true}, 0, 10)); fmt.Sprint(got) != "[3]" {
+			t.Errorf("List() = %v, want [3]", got)
+		}
+		if r := h.List("my-hook", Filter{Guid: "1"}, 0, 10)[0]; r.Outcome != OutcomeForwarded {
+			t.Errorf("List() outcome = %v, want %v", r.Outcome, OutcomeForwarded)
+		}
+	})
+
+	t.Run("List should filter and paginate", func(t *testing.T) {
+		h := NewHistory(10, time.Hour)
+		h.Add(newTestRecord("my-hook", "1", "push", 200, now))
+		h.Add(newTestRecord("my-hook", "2", "issues", 500, now))
+		h.Add(newTestRecord("my-hook", "3", "push", 0, now))
+		h.Add(newTestRecord("my-hook", "4", "push", 200, now))
+		h.Add(newTestRecord("my-hook", "5", "push", 500, now))
+
+		tests := []struct {
+			name   string
+			filter Filter
+			offset int
+			limit  int
+			want   string
+		}{
+			{"event", Filter{Event: "issues"}, 0, 10, "[2]"},
+			{"guid", Filter{Guid: "4"}, 0, 10, "[4]"},
+			{"status", Filter{Status: 500}, 0, 10, "[5 2]"},
+			{"failed", Filter{Failed: true}, 0, 10, "[5 3 2]"},
+			{"first page", Filter{}, 0, 2, "[5 4]"},
+			{"second page", Filter{}, 2, 2, "[3 2]"},
+			{"filtered page", Filter{Event: "push"}, 1, 2, "[4 3]"},
+			{"past the end", Filter{}, 10, 2, "[]"},
+		}
+		for _, tt := range tests {
+			if got := guids(h.List("my-hook", tt.filter, tt.offset, tt.limit)); fmt.Sprint(got) != tt.want {
+				t.Errorf("List() %v = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package delivery
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryQueue keeps deliveries in process memory; they are lost on restart.
+type memoryQueue struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+}
+
+func NewMemoryQueue() *memoryQueue {
+	return &memoryQueue{deliveries: map[string]*Delivery{}}
+}
+
+func (q *memoryQueue) Enqueue(delivery *Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.deliveries[delivery.Id] = delivery.copy()
+	return nil
+}
+
+func (q *memoryQueue) Claim(now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	due := make([]*Delivery, 0)
+	for _, d := range q.deliveries {
+		if !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	claimed := make([]*Delivery, 0, len(due))
+	for _, d := range due {
+		d.NextAttempt = now.Add(lease)
+		claimed = append(claimed, d.copy())
+	}
+	return claimed, nil
+}
+
+func (q *memoryQueue) Update(delivery *Delivery) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.deliveries[delivery.Id]; ok {
+		q.deliveries[delivery.Id] = delivery.copy()
+	}
+	return nil
+}
+
+func (q *memoryQueue) Remove(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.deliveries, id)
+	return nil
+}
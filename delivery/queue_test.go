@@ -0,0 +1,149 @@
+package delivery
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func newTestDelivery(hookId string, nextAttempt time.Time) *Delivery {
+	d := New(&webhook.Webhook{Id: hookId}, webhook.Target{Url: "http://internal-server.tld/hook"}, nil, []byte(`{"zen": "Keep it logically awesome."}`))
+	d.NextAttempt = nextAttempt
+	return d
+}
+
+func testQueue(t *testing.T, q Queue) {
+	now := time.Now().Truncate(time.Second)
+
+	t.Run("Claim should return due deliveries only", func(t *testing.T) {
+		due := newTestDelivery("my-hook", now.Add(-time.Second))
+		later := newTestDelivery("my-hook", now.Add(time.Hour))
+		q.Enqueue(due)
+		q.Enqueue(later)
+		defer q.Remove(due.Id)
+		defer q.Remove(later.Id)
+
+		claimed, err := q.Claim(now, time.Minute, 10)
+		if err != nil {
+			t.Errorf("Claim() error = %v", err)
+			return
+		}
+		if len(claimed) != 1 || claimed[0].Id != due.Id {
+			t.Errorf("Claim() = %v, want [%v]", claimed, due)
+			return
+		}
+		if string(claimed[0].Body) != string(due.Body) || claimed[0].Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Claim() = %v, want body and header of %v", claimed[0], due)
+		}
+	})
+
+	t.Run("Claimed delivery should not be claimed again until the lease runs out", func(t *testing.T) {
+		d := newTestDelivery("my-hook", now)
+		q.Enqueue(d)
+		defer q.Remove(d.Id)
+
+		if claimed, _ := q.Claim(now, time.Minute, 10); len(claimed) != 1 {
+			t.Errorf("Claim() = %v, want [%v]", claimed, d)
+		}
+		if claimed, _ := q.Claim(now.Add(time.Second), time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("Claim() = %v, want none", claimed)
+		}
+		if claimed, _ := q.Claim(now.Add(time.Minute), time.Minute, 10); len(claimed) != 1 {
+			t.Errorf("Claim() = %v, want [%v]", claimed, d)
+		}
+	})
+
+	t.Run("Claim should return the oldest deliveries up to limit", func(t *testing.T) {
+		first := newTestDelivery("my-hook", now.Add(-3*time.Second))
+		second := newTestDelivery("my-hook", now.Add(-2*time.Second))
+		third := newTestDelivery("my-hook", now.Add(-1*time.Second))
+		for _, d := range []*Delivery{third, first, second} {
+			q.Enqueue(d)
+			defer q.Remove(d.Id)
+		}
+
+		claimed, _ := q.Claim(now, time.Minute, 2)
+		if len(claimed) != 2 || claimed[0].Id != first.Id || claimed[1].Id != second.Id {
+			t.Errorf("Claim() = %v, want [%v %v]", claimed, first, second)
+		}
+	})
+
+	t.Run("Updated delivery should be claimed at its next attempt", func(t *testing.T) {
+		d := newTestDelivery("my-hook", now)
+		q.Enqueue(d)
+		defer q.Remove(d.Id)
+
+		claimed, _ := q.Claim(now, time.Minute, 10)
+		claimed[0].Attempts = []Attempt{{At: now, Error: "connection refused"}}
+		claimed[0].NextAttempt = now.Add(10 * time.Second)
+		if err := q.Update(claimed[0]); err != nil {
+			t.Errorf("Update() error = %v", err)
+			return
+		}
+
+		if claimed, _ := q.Claim(now.Add(9*time.Second), time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("Claim() = %v, want none", claimed)
+		}
+		claimed, _ = q.Claim(now.Add(10*time.Second), time.Minute, 10)
+		if len(claimed) != 1 || len(claimed[0].Attempts) != 1 || claimed[0].Attempts[0].Error != "connection refused" {
+			t.Errorf("Claim() = %v, want updated delivery", claimed)
+		}
+	})
+
+	t.Run("Removed delivery should not be claimed", func(t *testing.T) {
+		d := newTestDelivery("my-hook", now)
+		q.Enqueue(d)
+
+		if err := q.Remove(d.Id); err != nil {
+			t.Errorf("Remove() error = %v", err)
+			return
+		}
+
+		if claimed, _ := q.Claim(now, time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("Claim() = %v, want none", claimed)
+		}
+	})
+
+	t.Run("Concurrent claims should not return a delivery twice", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			d := newTestDelivery(fmt.Sprintf("my-hook-%d", i), now)
+			q.Enqueue(d)
+			defer q.Remove(d.Id)
+		}
+
+		var mu sync.Mutex
+		seen := map[string]int{}
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					claimed, _ := q.Claim(now, time.Minute, 3)
+					mu.Lock()
+					for _, d := range claimed {
+						seen[d.Id]++
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(seen) != 20 {
+			t.Errorf("claimed %d deliveries, want 20", len(seen))
+		}
+		for id, n := range seen {
+			if n != 1 {
+				t.Errorf("delivery %v claimed %d times, want once", id, n)
+			}
+		}
+	})
+}
+
+func TestMemoryQueue(t *testing.T) {
+	testQueue(t, NewMemoryQueue())
+}
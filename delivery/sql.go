@@ -0,0 +1,193 @@
+package delivery
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/navikt/webhookproxy/migrate"
+)
+
+// migrations for the deliveries and dead_letters tables. Deliveries are
+// stored as JSON in data; next_attempt and created_at are kept in their own
+// columns, in unix nanoseconds, so deliveries can be queried by them.
+var migrations = []string{
+	`CREATE TABLE deliveries (
+		id VARCHAR(32) PRIMARY KEY,
+		hook_id VARCHAR(40) NOT NULL,
+		next_attempt BIGINT NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE INDEX deliveries_next_attempt ON deliveries (next_attempt)`,
+	`CREATE TABLE dead_letters (
+		id VARCHAR(32) PRIMARY KEY,
+		hook_id VARCHAR(40) NOT NULL,
+		created_at BIGINT NOT NULL,
+		data TEXT NOT NULL
+	)`,
+	`CREATE INDEX dead_letters_hook_id ON dead_letters (hook_id, created_at)`,
+}
+
+// sqlQueue keeps deliveries in a SQL database shared by all replicas. A
+// delivery is claimed by moving its next attempt only if no other replica
+// moved it first.
+type sqlQueue struct {
+	db *sql.DB
+}
+
+// NewSQLQueue creates a queue on db, migrating the schema if needed.
+func NewSQLQueue(db *sql.DB) (*sqlQueue, error) {
+	if err := migrate.Run(db, "deliveries", migrations); err != nil {
+		return nil, err
+	}
+
+	return &sqlQueue{db}, nil
+}
+
+func (q *sqlQueue) Enqueue(delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.db.Exec(`INSERT INTO deliveries (id, hook_id, next_attempt, data) VALUES ($1, $2, $3, $4)`,
+		delivery.Id, delivery.HookId, delivery.NextAttempt.UnixNano(), string(data))
+	return err
+}
+
+func (q *sqlQueue) Claim(now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	rows, err := q.db.Query(`SELECT next_attempt, data FROM deliveries WHERE next_attempt <= $1
+		ORDER BY next_attempt LIMIT $2`, now.UnixNano(), limit)
+	if err != nil {
+		return nil, err
+	}
+
+	due := make([]*Delivery, 0)
+	for rows.Next() {
+		var nextAttempt int64
+		var data string
+		if err := rows.Scan(&nextAttempt, &data); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		var d Delivery
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		d.NextAttempt = time.Unix(0, nextAttempt)
+		due = append(due, &d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	claimed := make([]*Delivery, 0, len(due))
+	leaseEnd := now.Add(lease)
+	for _, d := range due {
+		res, err := q.db.Exec(`UPDATE deliveries SET next_attempt = $1 WHERE id = $2 AND next_attempt = $3`,
+			leaseEnd.UnixNano(), d.Id, d.NextAttempt.UnixNano())
+		if err != nil {
+			return nil, err
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return nil, err
+		} else if n == 1 {
+			d.NextAttempt = leaseEnd
+			claimed = append(claimed, d)
+		}
+	}
+	return claimed, nil
+}
+
+func (q *sqlQueue) Update(delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.db.Exec(`UPDATE deliveries SET next_attempt = $1, data = $2 WHERE id = $3`,
+		delivery.NextAttempt.UnixNano(), string(data), delivery.Id)
+	return err
+}
+
+func (q *sqlQueue) Remove(id string) error {
+	_, err := q.db.Exec(`DELETE FROM deliveries WHERE id = $1`, id)
+	return err
+}
+
+// sqlDeadLetters keeps dead letters in a SQL database shared by all replicas.
+type sqlDeadLetters struct {
+	db *sql.DB
+}
+
+// NewSQLDeadLetters creates dead letters on db, migrating the schema if
+// needed.
+func NewSQLDeadLetters(db *sql.DB) (*sqlDeadLetters, error) {
+	if err := migrate.Run(db, "deliveries", migrations); err != nil {
+		return nil, err
+	}
+
+	return &sqlDeadLetters{db}, nil
+}
+
+func (l *sqlDeadLetters) Save(delivery *Delivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = l.db.Exec(`INSERT INTO dead_letters (id, hook_id, created_at, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET data = excluded.data`,
+		delivery.Id, delivery.HookId, delivery.CreatedAt.UnixNano(), string(data))
+	return err
+}
+
+func (l *sqlDeadLetters) List(hookId string) ([]*Delivery, error) {
+	rows, err := l.db.Query(`SELECT data FROM dead_letters WHERE hook_id = $1 ORDER BY created_at`, hookId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*Delivery, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		var d Delivery
+		if err := json.Unmarshal([]byte(data), &d); err != nil {
+			return nil, err
+		}
+		list = append(list, &d)
+	}
+
+	return list, rows.Err()
+}
+
+func (l *sqlDeadLetters) Get(id string) (*Delivery, error) {
+	var data string
+	err := l.db.QueryRow(`SELECT data FROM dead_letters WHERE id = $1`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var d Delivery
+	if err := json.Unmarshal([]byte(data), &d); err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (l *sqlDeadLetters) Remove(id string) error {
+	_, err := l.db.Exec(`DELETE FROM dead_letters WHERE id = $1`, id)
+	return err
+}
@@ -0,0 +1,51 @@
+package delivery
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLQueue(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	q, err := NewSQLQueue(db)
+	if err != nil {
+		t.Fatalf("NewSQLQueue() error = %v", err)
+	}
+
+	testQueue(t, q)
+
+	deadLetters, err := NewSQLDeadLetters(db)
+	if err != nil {
+		t.Fatalf("NewSQLDeadLetters() error = %v", err)
+	}
+
+	testDeadLetters(t, deadLetters)
+
+	t.Run("Second replica should not claim deliveries claimed by the first", func(t *testing.T) {
+		replica, err := NewSQLQueue(db)
+		if err != nil {
+			t.Fatalf("NewSQLQueue() error = %v", err)
+		}
+
+		now := time.Now()
+		d := newTestDelivery("my-hook", now)
+		q.Enqueue(d)
+		defer q.Remove(d.Id)
+
+		if claimed, _ := q.Claim(now, time.Minute, 10); len(claimed) != 1 {
+			t.Errorf("Claim() = %v, want [%v]", claimed, d)
+		}
+		if claimed, _ := replica.Claim(now, time.Minute, 10); len(claimed) != 0 {
+			t.Errorf("Claim() = %v, want none", claimed)
+		}
+	})
+}
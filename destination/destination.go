@@ -0,0 +1,157 @@
+package destination
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/navikt/webhookproxy/allowlist"
+)
+
+// Policy decides which urls deliveries may be forwarded to. Urls are checked
+// when webhooks are created, and the addresses connected to are checked
+// again when dialing, so a host name cannot be pointed at a denied address
+// later. Empty fields allow anything, except addresses in Denied.
+type Policy struct {
+	// Schemes are the allowed url schemes.
+	Schemes []string
+	// Hosts are the allowed host names, as path.Match patterns like
+	// *.svc.cluster.local.
+	Hosts []string
+	// Networks are the allowed address ranges.
+	Networks []*net.IPNet
+	// Denied are address ranges that are never allowed.
+	Denied []*net.IPNet
+}
+
+// DefaultDenied are the address ranges denied by the default policy:
+// loopback, link-local, which holds the cloud metadata services, and
+// unspecified addresses, and the metadata services at other addresses.
+var DefaultDenied = []string{
+	"127.0.0.0/8",
+	"::1/128",
+	"169.254.0.0/16",
+	"fe80::/10",
+	"0.0.0.0/8",
+	"::/128",
+	"100.100.100.200/32",
+	"fd00:ec2::254/128",
+}
+
+// DefaultPolicy allows http and https urls to any address outside
+// DefaultDenied.
+func DefaultPolicy() *Policy {
+	denied, err := allowlist.ParseCIDRs(DefaultDenied)
+	if err != nil {
+		panic(err)
+	}
+	return &Policy{Schemes: []string{"http", "https"}, Denied: denied}
+}
+
+// CheckURL checks the scheme and host of rawurl. Host names are not
+// resolved; their addresses are checked when dialing.
+func (p *Policy) CheckURL(rawurl string) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return fmt.Errorf("invalid url: %v", rawurl)
+	}
+
+	if len(p.Schemes) > 0 && !contains(p.Schemes, strings.ToLower(u.Scheme)) {
+		return fmt.Errorf("scheme %v is not allowed", u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("url %v has no host", rawurl)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+
+	if len(p.Hosts) == 0 {
+		return nil
+	}
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %v is not allowed", host)
+}
+
+// CheckIP checks that ip is not denied and in the allowed networks.
+func (p *Policy) CheckIP(ip net.IP) error {
+	for _, ipNet := range p.Denied {
+		if ipNet.Contains(ip) {
+			return fmt.Errorf("address %v is denied", ip)
+		}
+	}
+
+	if len(p.Networks) == 0 {
+		return nil
+	}
+	for _, ipNet := range p.Networks {
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("address %v is not allowed", ip)
+}
+
+// CheckHost resolves host and checks all of its addresses. It is for
+// forwards through a proxy, where the dialer only sees the address of the
+// proxy. Host names are resolved only when the policy restricts addresses,
+// and fail the check if they cannot be resolved.
+func (p *Policy) CheckHost(ctx context.Context, host string) error {
+	if len(p.Denied) == 0 && len(p.Networks) == 0 {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("could not resolve %v: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if err := p.CheckIP(addr.IP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dialer returns a dialer refusing to connect to addresses the policy does
+// not allow. The check is made on the resolved address right before
+// connecting, which defeats DNS rebinding.
+func (p *Policy) Dialer(timeout time.Duration) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("invalid address: %v", address)
+			}
+			return p.CheckIP(ip)
+		},
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
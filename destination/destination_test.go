@@ -0,0 +1,97 @@
+package destination
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/navikt/webhookproxy/allowlist"
+)
+
+func TestPolicy_CheckURL(t *testing.T) {
+	networks, _ := allowlist.ParseCIDRs([]string{"10.0.0.0/8"})
+	strict := DefaultPolicy()
+	strict.Schemes = []string{"https"}
+	strict.Hosts = []string{"*.svc.cluster.local", "jenkins.example.com"}
+	strict.Networks = networks
+
+	tests := []struct {
+		name    string
+		policy  *Policy
+		url     string
+		wantErr bool
+	}{
+		{"internal host", DefaultPolicy(), "http://internal-server.tld/hook", false},
+		{"private address", DefaultPolicy(), "http://10.0.0.1:8080/hook", false},
+		{"metadata service", DefaultPolicy(), "http://169.254.169.254/latest/meta-data/", true},
+		{"loopback", DefaultPolicy(), "http://127.0.0.1:8080/admin", true},
+		{"IPv6 loopback", DefaultPolicy(), "http://[::1]:8080/admin", true},
+		{"IPv4 mapped loopback", DefaultPolicy(), "http://[::ffff:127.0.0.1]:8080/admin", true},
+		{"unspecified address", DefaultPolicy(), "http://0.0.0.0:8080/", true},
+		{"other scheme", DefaultPolicy(), "file:///etc/passwd", true},
+		{"without host", DefaultPolicy(), "http:///hook", true},
+		{"allowed host pattern", strict, "https://deployer.team.svc.cluster.local/hook", false},
+		{"allowed host", strict, "https://JENKINS.example.com/generic-webhook-trigger/invoke", false},
+		{"other host", strict, "https://example.org/hook", true},
+		{"denied scheme", strict, "http://deployer.team.svc.cluster.local/hook", true},
+		{"allowed network", strict, "https://10.1.2.3/hook", false},
+		{"other network", strict, "https://192.168.1.1/hook", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.CheckURL(tt.url); (err != nil) != tt.wantErr {
+				t.Errorf("CheckURL() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPolicy_Dialer(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+
+	newClient := func(p *Policy) *http.Client {
+		return &http.Client{Transport: &http.Transport{DialContext: p.Dialer(time.Second).DialContext}}
+	}
+	// the host name is only resolved when dialing, like a name rebound to
+	// a denied address after the webhook was created
+	url := strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)
+
+	t.Run("dialing a denied address should fail", func(t *testing.T) {
+		_, err := newClient(DefaultPolicy()).Get(url)
+		if err == nil || !strings.Contains(err.Error(), "is denied") {
+			t.Errorf("Get() error = %v, want the address to be denied", err)
+		}
+	})
+
+	t.Run("dialing an allowed address should succeed", func(t *testing.T) {
+		loopback, _ := allowlist.ParseCIDRs([]string{"127.0.0.0/8", "::1/128"})
+		if _, err := newClient(&Policy{Networks: loopback}).Get(url); err != nil {
+			t.Errorf("Get() error = %v", err)
+		}
+	})
+}
+
+func TestPolicy_CheckIP(t *testing.T) {
+	if err := DefaultPolicy().CheckIP(net.ParseIP("fd00:ec2::254")); err == nil {
+		t.Errorf("CheckIP() should deny the EC2 IPv6 metadata service")
+	}
+}
+
+func TestPolicy_CheckHost(t *testing.T) {
+	private, _ := allowlist.ParseCIDRs([]string{"10.0.0.0/8"})
+
+	if err := (&Policy{Denied: private}).CheckHost(context.Background(), "10.1.2.3"); err == nil {
+		t.Errorf("CheckHost() should deny a denied address")
+	}
+	if err := (&Policy{Denied: private}).CheckHost(context.Background(), "internal-server.invalid"); err == nil {
+		t.Errorf("CheckHost() should fail for a host that cannot be resolved")
+	}
+	if err := (&Policy{}).CheckHost(context.Background(), "internal-server.invalid"); err != nil {
+		t.Errorf("CheckHost() should not resolve hosts without address ranges, got %v", err)
+	}
+}
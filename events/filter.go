@@ -0,0 +1,50 @@
+package events
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// Action returns the action of the event in payload, such as opened for a
+// pull_request event, or an empty string if it has none.
+func Action(payload []byte) string {
+	var event struct {
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return ""
+	}
+	return event.Action
+}
+
+// Allowed reports whether a delivery of eventType with payload passes
+// filter. A nil filter allows every event, and so does any filter when the
+// event type is not known.
+func Allowed(filter *webhook.EventFilter, eventType string, payload []byte) bool {
+	if filter == nil || eventType == "" {
+		return true
+	}
+
+	names := []string{eventType}
+	if action := Action(payload); action != "" {
+		names = append(names, eventType+"."+action)
+	}
+
+	if len(filter.Allow) > 0 && !matchesAny(filter.Allow, names) {
+		return false
+	}
+	return !matchesAny(filter.Deny, names)
+}
+
+func matchesAny(patterns []string, names []string) bool {
+	for _, pattern := range patterns {
+		for _, name := range names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
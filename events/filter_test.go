@@ -0,0 +1,39 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func TestAllowed(t *testing.T) {
+	opened := []byte(`{"action": "opened", "number": 1}`)
+	closed := []byte(`{"action": "closed", "number": 1}`)
+	push := []byte(`{"ref": "refs/heads/master"}`)
+
+	tests := []struct {
+		name      string
+		filter    *webhook.EventFilter
+		eventType string
+		payload   []byte
+		want      bool
+	}{
+		{"no filter", nil, "push", push, true},
+		{"allowed type", &webhook.EventFilter{Allow: []string{"push"}}, "push", push, true},
+		{"type not allowed", &webhook.EventFilter{Allow: []string{"push"}}, "issues", opened, false},
+		{"allowed action", &webhook.EventFilter{Allow: []string{"pull_request.opened"}}, "pull_request", opened, true},
+		{"action not allowed", &webhook.EventFilter{Allow: []string{"pull_request.opened"}}, "pull_request", closed, false},
+		{"type allows all actions", &webhook.EventFilter{Allow: []string{"pull_request"}}, "pull_request", closed, true},
+		{"wildcard action", &webhook.EventFilter{Allow: []string{"pull_request*"}}, "pull_request_review", opened, true},
+		{"wildcard type", &webhook.EventFilter{Allow: []string{"*.opened"}}, "issues", opened, true},
+		{"denied type", &webhook.EventFilter{Deny: []string{"push"}}, "push", push, false},
+		{"denied action", &webhook.EventFilter{Allow: []string{"pull_request"}, Deny: []string{"pull_request.closed"}}, "pull_request", closed, false},
+		{"deny overrides allow", &webhook.EventFilter{Allow: []string{"*"}, Deny: []string{"pull_request.*"}}, "pull_request", opened, false},
+		{"unknown type", &webhook.EventFilter{Allow: []string{"push"}}, "", push, true},
+	}
+	for _, tt := range tests {
+		if got := Allowed(tt.filter, tt.eventType, tt.payload); got != tt.want {
+			t.Errorf("Allowed() %v = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package events
+
+import (
+	"net/http"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// typeHeaders name the request header holding the event type per provider.
+// Slack and Stripe only tell the type in the payload.
+var typeHeaders = map[string]string{
+	"":                        "X-Github-Event",
+	webhook.ProviderGitHub:    "X-Github-Event",
+	webhook.ProviderGitLab:    "X-Gitlab-Event",
+	webhook.ProviderBitbucket: "X-Event-Key",
+	webhook.ProviderGitea:     "X-Gitea-Event",
+}
+
+// guidHeaders name the request header holding the sender's id of the
+// delivery per provider.
+var guidHeaders = map[string]string{
+	"":                        "X-Github-Delivery",
+	webhook.ProviderGitHub:    "X-Github-Delivery",
+	webhook.ProviderGitLab:    "X-Gitlab-Event-UUID",
+	webhook.ProviderBitbucket: "X-Request-UUID",
+	webhook.ProviderGitea:     "X-Gitea-Delivery",
+}
+
+// Type returns the event type of a delivery from provider, or an empty
+// string if the headers do not tell.
+func Type(provider string, header http.Header) string {
+	if name, ok := typeHeaders[provider]; ok {
+		return header.Get(name)
+	}
+	return ""
+}
+
+// Guid returns the id the provider gave a delivery, such as the
+// X-GitHub-Delivery header, or an empty string if it has none.
+func Guid(provider string, header http.Header) string {
+	if name, ok := guidHeaders[provider]; ok {
+		return header.Get(name)
+	}
+	return ""
+}
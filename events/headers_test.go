@@ -0,0 +1,30 @@
+package events
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func TestTypeAndGuid(t *testing.T) {
+	tests := []struct {
+		provider string
+		header   http.Header
+		wantType string
+		wantGuid string
+	}{
+		{"", http.Header{"X-Github-Event": {"push"}, "X-Github-Delivery": {"72d3162e-cc78-11e3-81ab-4c9367dc0958"}}, "push", "72d3162e-cc78-11e3-81ab-4c9367dc0958"},
+		{webhook.ProviderGitLab, http.Header{"X-Gitlab-Event": {"Push Hook"}, "X-Gitlab-Event-Uuid": {"13792a34-cac6-4fda-95a8-c58e00a3954e"}}, "Push Hook", "13792a34-cac6-4fda-95a8-c58e00a3954e"},
+		{webhook.ProviderBitbucket, http.Header{"X-Event-Key": {"repo:push"}, "X-Request-Uuid": {"afe4c4a5-fe7b-4ad2-9a52-b3ab5c0b8f7c"}}, "repo:push", "afe4c4a5-fe7b-4ad2-9a52-b3ab5c0b8f7c"},
+		{webhook.ProviderSlack, http.Header{"X-Github-Event": {"push"}}, "", ""},
+	}
+	for _, tt := range tests {
+		if got := Type(tt.provider, tt.header); got != tt.wantType {
+			t.Errorf("Type(%q) = %v, want %v", tt.provider, got, tt.wantType)
+		}
+		if got := Guid(tt.provider, tt.header); got != tt.wantGuid {
+			t.Errorf("Guid(%q) = %v, want %v", tt.provider, got, tt.wantGuid)
+		}
+	}
+}
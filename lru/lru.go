@@ -0,0 +1,67 @@
+// Package lru is a cache of a bounded number of values, evicting the least
+// recently used one when full. It keeps what is derived from webhooks, like
+// parsed templates, from piling up as webhooks are created and deleted.
+package lru
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Cache holds at most Size values by key. It is safe for concurrent use.
+type Cache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+type entry struct {
+	key   string
+	value interface{}
+}
+
+func New(size int) *Cache {
+	return &Cache{size: size, order: list.New(), items: map[string]*list.Element{}}
+}
+
+// Get returns the value under key, marking it as recently used.
+func (c *Cache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*entry).value, true
+}
+
+// Add stores value under key, evicting the least recently used value if the
+// cache is full.
+func (c *Cache) Add(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.items[key]; ok {
+		e.Value.(*entry).value = value
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&entry{key: key, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry).key)
+	}
+}
+
+// Len returns how many values are cached.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
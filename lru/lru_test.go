@@ -0,0 +1,36 @@
+package lru
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCache(t *testing.T) {
+	t.Run("cache should keep at most size values", func(t *testing.T) {
+		c := New(2)
+		for i := 0; i < 10; i++ {
+			c.Add(fmt.Sprint(i), i)
+		}
+		if c.Len() != 2 {
+			t.Errorf("Len() = %d, want 2", c.Len())
+		}
+		if v, ok := c.Get("9"); !ok || v != 9 {
+			t.Errorf("Get() = %v, %v, want the last value added", v, ok)
+		}
+	})
+
+	t.Run("least recently used value should be evicted", func(t *testing.T) {
+		c := New(2)
+		c.Add("a", 1)
+		c.Add("b", 2)
+		c.Get("a")
+		c.Add("c", 3)
+
+		if _, ok := c.Get("b"); ok {
+			t.Errorf("Get() should not find the least recently used value")
+		}
+		if _, ok := c.Get("a"); !ok {
+			t.Errorf("Get() should find the recently used value")
+		}
+	})
+}
@@ -1,8 +1,27 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+	"github.com/navikt/webhookproxy/allowlist"
 	"github.com/navikt/webhookproxy/app"
+	"github.com/navikt/webhookproxy/auth"
+	"github.com/navikt/webhookproxy/delivery"
+	"github.com/navikt/webhookproxy/destination"
+	"github.com/navikt/webhookproxy/ratelimit"
+	"github.com/navikt/webhookproxy/reconciler"
+	"github.com/navikt/webhookproxy/replay"
+	"github.com/navikt/webhookproxy/transform"
+	"github.com/navikt/webhookproxy/webhook"
+	bolt "go.etcd.io/bbolt"
+	_ "github.com/lib/pq"
 )
 
 func main() {
@@ -11,7 +30,336 @@ func main() {
 		listenAddr = ":8080"
 	}
 
-	server := app.NewServer()
+	store, options, err := newStore(os.Getenv("WEBHOOK_STORE"), os.Getenv("WEBHOOK_STORE_PATH"))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up webhook store: %v\n", err)
+		os.Exit(1)
+	}
+	webhook.UseStore(store)
+
+	destinations, err := newDestinationPolicy()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up destination policy: %v\n", err)
+		os.Exit(1)
+	}
+	webhook.UseDestinationPolicy(destinations)
+
+	history, err := newHistory()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up delivery history: %v\n", err)
+		os.Exit(1)
+	}
+	options = append(options, app.WithHistory(history))
+
+	if v := os.Getenv("REPLAY_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid REPLAY_TTL: %v\n", err)
+			os.Exit(1)
+		}
+		options = append(options, app.WithReplayTTL(ttl))
+	}
+
+	if v := os.Getenv("MAX_BODY_SIZE"); v != "" {
+		maxBodySize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || maxBodySize <= 0 {
+			fmt.Fprintf(os.Stderr, "invalid MAX_BODY_SIZE, must be a positive number of bytes: %v\n", v)
+			os.Exit(1)
+		}
+		options = append(options, app.WithMaxBodySize(maxBodySize))
+		transform.UseMaxOutputSize(maxBodySize)
+	}
+
+	rateLimits, err := newRateLimits()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up rate limits: %v\n", err)
+		os.Exit(1)
+	}
+	options = append(options, app.WithRateLimits(rateLimits))
+
+	sources, err := newSourceAllowlist()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up source allowlist: %v\n", err)
+		os.Exit(1)
+	}
+	options = append(options, app.WithSourceAllowlist(sources))
+
+	authenticator, err := newAuthenticator()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to set up authentication: %v\n", err)
+		os.Exit(1)
+	}
+
+	if authenticator != nil {
+		options = append(options, app.WithAuthenticator(authenticator))
+	} else if os.Getenv("ALLOW_UNAUTHENTICATED_MANAGEMENT") == "true" {
+		fmt.Fprintf(os.Stderr, "WARNING: neither API_TOKENS_FILE nor OIDC_JWKS_URL is set, the management API is not protected\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "neither API_TOKENS_FILE nor OIDC_JWKS_URL is set, set ALLOW_UNAUTHENTICATED_MANAGEMENT=true to run without protecting the management API\n")
+		os.Exit(1)
+	}
+
+	server := app.NewServer(options...)
+
+	if hooksDir := os.Getenv("HOOKS_DIR"); hooksDir != "" {
+		interval := 30 * time.Second
+		if v := os.Getenv("HOOKS_DIR_INTERVAL"); v != "" {
+			if interval, err = time.ParseDuration(v); err != nil {
+				fmt.Fprintf(os.Stderr, "invalid HOOKS_DIR_INTERVAL: %v\n", err)
+				os.Exit(1)
+			}
+		}
+		r := reconciler.New(hooksDir, interval)
+		r.OnRemove(server.Forget)
+		go r.Run(nil)
+	}
+
 	server.Initialize()
 	server.Run(listenAddr)
 }
+
+// newStore sets up the webhook store, and the server options keeping async
+// deliveries, dead letters and the replay cache in the same database. They
+// are kept in memory with the memory and file stores.
+func newStore(storeType string, path string) (webhook.Store, []app.Option, error) {
+	switch storeType {
+	case "", "memory":
+		return webhook.NewMemoryStore(), nil, nil
+	case "file":
+		if path == "" {
+			path = "webhooks.json"
+		}
+		cipher, err := newSecretCipher()
+		if err != nil {
+			return nil, nil, err
+		}
+		store, err := webhook.NewFileStore(path, cipher)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, nil, nil
+	case "bolt":
+		if path == "" {
+			path = "webhooks.db"
+		}
+		cipher, err := newSecretCipher()
+		if err != nil {
+			return nil, nil, err
+		}
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, nil, err
+		}
+		store, err := webhook.NewBoltStore(db, cipher)
+		if err != nil {
+			return nil, nil, err
+		}
+		queue, err := delivery.NewBoltQueue(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		deadLetters, err := delivery.NewBoltDeadLetters(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		replays, err := replay.NewBoltCache(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, []app.Option{app.WithQueue(queue), app.WithDeadLetters(deadLetters), app.WithReplayCache(replays)}, nil
+	case "postgres":
+		cipher, err := newSecretCipher()
+		if err != nil {
+			return nil, nil, err
+		}
+		db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+		if err != nil {
+			return nil, nil, err
+		}
+		store, err := webhook.NewSQLStore(db, cipher)
+		if err != nil {
+			return nil, nil, err
+		}
+		queue, err := delivery.NewSQLQueue(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		deadLetters, err := delivery.NewSQLDeadLetters(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		replays, err := replay.NewSQLCache(db)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, []app.Option{app.WithQueue(queue), app.WithDeadLetters(deadLetters), app.WithReplayCache(replays)}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown store type: %v", storeType)
+	}
+}
+
+// newHistory sets up the delivery history, keeping HISTORY_SIZE deliveries
+// per webhook for at most HISTORY_MAX_AGE.
+func newHistory() (*delivery.History, error) {
+	size := 100
+	if v := os.Getenv("HISTORY_SIZE"); v != "" {
+		var err error
+		if size, err = strconv.Atoi(v); err != nil || size < 1 {
+			return nil, fmt.Errorf("HISTORY_SIZE must be a positive number")
+		}
+	}
+
+	maxAge := 24 * time.Hour
+	if v := os.Getenv("HISTORY_MAX_AGE"); v != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid HISTORY_MAX_AGE: %v", err)
+		}
+	}
+
+	return delivery.NewHistory(size, maxAge), nil
+}
+
+// newRateLimits reads the default rate limits of the proxy, teams and
+// webhooks from GLOBAL_RATE_LIMIT, TEAM_RATE_LIMIT and HOOK_RATE_LIMIT, as
+// "<rate>" or "<rate>,<burst>" with the rate in deliveries a second.
+func newRateLimits() (ratelimit.Defaults, error) {
+	var defaults ratelimit.Defaults
+	for name, limit := range map[string]**ratelimit.Limit{
+		"GLOBAL_RATE_LIMIT": &defaults.Global,
+		"TEAM_RATE_LIMIT": &defaults.Team,
+		"HOOK_RATE_LIMIT": &defaults.Hook,
+	} {
+		if v := os.Getenv(name); v != "" {
+			l, err := ratelimit.Parse(v)
+			if err != nil {
+				return defaults, fmt.Errorf("invalid %v: %v", name, err)
+			}
+			*limit = l
+		}
+	}
+	return defaults, nil
+}
+
+// newDestinationPolicy sets up the policy for the urls deliveries are
+// forwarded to from the comma separated lists in DESTINATION_SCHEMES,
+// DESTINATION_HOSTS, DESTINATION_NETWORKS and DESTINATION_DENIED. Each
+// replaces the default of the policy when set.
+func newDestinationPolicy() (*destination.Policy, error) {
+	policy := destination.DefaultPolicy()
+
+	if v := os.Getenv("DESTINATION_SCHEMES"); v != "" {
+		policy.Schemes = strings.Split(v, ",")
+	}
+	if v := os.Getenv("DESTINATION_HOSTS"); v != "" {
+		policy.Hosts = strings.Split(v, ",")
+	}
+	if v := os.Getenv("DESTINATION_NETWORKS"); v != "" {
+		networks, err := allowlist.ParseCIDRs(strings.Split(v, ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DESTINATION_NETWORKS: %v", err)
+		}
+		policy.Networks = networks
+	}
+	if v := os.Getenv("DESTINATION_DENIED"); v != "" {
+		denied, err := allowlist.ParseCIDRs(strings.Split(v, ","))
+		if err != nil {
+			return nil, fmt.Errorf("invalid DESTINATION_DENIED: %v", err)
+		}
+		policy.Denied = denied
+	}
+
+	return policy, nil
+}
+
+// newSourceAllowlist sets up the allowlist of GitHub's hook ranges, loaded
+// from GITHUB_HOOK_RANGES_FILE or from the meta API at GITHUB_META_URL and
+// refreshed every GITHUB_META_INTERVAL. X-Forwarded-For hops added by the
+// proxies in TRUSTED_PROXIES are trusted. GitHub deliveries are refused
+// while configured ranges are not loaded.
+func newSourceAllowlist() (*allowlist.Allowlist, error) {
+	var trusted []*net.IPNet
+	if v := os.Getenv("TRUSTED_PROXIES"); v != "" {
+		var err error
+		if trusted, err = allowlist.ParseCIDRs(strings.Split(v, ",")); err != nil {
+			return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %v", err)
+		}
+	}
+	sources := allowlist.New(trusted)
+
+	if path := os.Getenv("GITHUB_HOOK_RANGES_FILE"); path != "" {
+		sources.Require()
+		return sources, sources.LoadFile(path)
+	}
+
+	if metaUrl := os.Getenv("GITHUB_META_URL"); metaUrl != "" {
+		interval := time.Hour
+		if v := os.Getenv("GITHUB_META_INTERVAL"); v != "" {
+			var err error
+			if interval, err = time.ParseDuration(v); err != nil {
+				return nil, fmt.Errorf("invalid GITHUB_META_INTERVAL: %v", err)
+			}
+		}
+
+		sources.Require()
+		client := &http.Client{Timeout: 10 * time.Second}
+		if err := sources.LoadMeta(client, metaUrl); err != nil {
+			return nil, err
+		}
+		go sources.Refresh(client, metaUrl, interval, nil)
+	}
+
+	return sources, nil
+}
+
+// newSecretCipher creates the cipher used to encrypt webhook secrets at rest
+// from the base64 encoded AES key in WEBHOOK_SECRET_KEY.
+func newSecretCipher() (*webhook.SecretCipher, error) {
+	encodedKey := os.Getenv("WEBHOOK_SECRET_KEY")
+	if encodedKey == "" {
+		return nil, fmt.Errorf("WEBHOOK_SECRET_KEY must be set to encrypt webhook secrets")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("WEBHOOK_SECRET_KEY must be base64: %v", err)
+	}
+
+	return webhook.NewSecretCipher(key)
+}
+
+// newAuthenticator sets up authentication of the management API from static
+// tokens in API_TOKENS_FILE and OIDC tokens validated against OIDC_JWKS_URL.
+// It returns nil if neither is configured.
+func newAuthenticator() (auth.Authenticator, error) {
+	var authenticators []auth.Authenticator
+
+	if path := os.Getenv("API_TOKENS_FILE"); path != "" {
+		tokens, err := auth.LoadTokens(path)
+		if err != nil {
+			return nil, err
+		}
+		authenticators = append(authenticators, auth.NewTokenAuthenticator(tokens))
+	}
+
+	if jwksUrl := os.Getenv("OIDC_JWKS_URL"); jwksUrl != "" {
+		issuer, audience := os.Getenv("OIDC_ISSUER"), os.Getenv("OIDC_AUDIENCE")
+		if issuer == "" || audience == "" {
+			return nil, fmt.Errorf("OIDC_ISSUER and OIDC_AUDIENCE must be set with OIDC_JWKS_URL")
+		}
+		teamsClaim := os.Getenv("OIDC_TEAMS_CLAIM")
+		if teamsClaim == "" {
+			teamsClaim = "groups"
+		}
+		var adminTeams []string
+		if v := os.Getenv("ADMIN_TEAMS"); v != "" {
+			adminTeams = strings.Split(v, ",")
+		}
+		authenticators = append(authenticators, auth.NewJWTAuthenticator(auth.NewJWKS(jwksUrl), issuer, audience, teamsClaim, adminTeams))
+	}
+
+	if len(authenticators) == 0 {
+		return nil, nil
+	}
+	return auth.Chain(authenticators...), nil
+}
@@ -1,18 +1,18 @@
 package middlewares
 
 import (
+	"io"
 	"strings"
 	"github.com/navikt/webhookproxy/webhook"
 	"fmt"
 	"os"
 	"net/http"
-	"crypto/hmac"
-	"crypto/sha1"
 	"time"
-	"encoding/hex"
 	"github.com/navikt/webhookproxy/context"
 	"github.com/gorilla/mux"
 	"github.com/navikt/webhookproxy/errors"
+	"github.com/navikt/webhookproxy/auth"
+	"github.com/navikt/webhookproxy/allowlist"
 )
 
 type Middleware func(http.Handler) http.Handler
@@ -22,7 +22,12 @@ func MustHaveWebhook(h http.Handler) http.Handler {
 		vars := mux.Vars(r)
 		webhookId := vars["id"]
 
-		wh := webhook.Get(webhookId)
+		wh, err := webhook.Get(webhookId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to look up webhook %v: %v\n", webhookId, err)
+			errors.RespondWithError(w, errors.NewAppError(http.StatusInternalServerError, "failed to look up webhook"))
+			return
+		}
 
 		if wh == nil {
 			fmt.Fprintf(os.Stderr, "webhook does not exist: %v\n", webhookId)
@@ -35,34 +40,98 @@ func MustHaveWebhook(h http.Handler) http.Handler {
 	})
 }
 
-func MustHaveValidSignature(h http.Handler) http.Handler {
+// MustBeAuthenticated requires a bearer token accepted by authenticator and
+// puts the authenticated principal in the request context.
+func MustBeAuthenticated(authenticator auth.Authenticator) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization := r.Header.Get("Authorization")
+			if !strings.HasPrefix(authorization, "Bearer ") {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				errors.RespondWithError(w, errors.NewAppError(http.StatusUnauthorized, "missing bearer token"))
+				return
+			}
+
+			principal, err := authenticator.Authenticate(strings.TrimPrefix(authorization, "Bearer "))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "authentication failed: %v\n", err)
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				errors.RespondWithError(w, errors.NewAppError(http.StatusUnauthorized, "invalid token"))
+				return
+			}
+
+			ctx := context.NewContextWithPrincipal(r.Context(), principal)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// MustManageWebhook requires the authenticated principal to be allowed to
+// manage the webhook in the request context. It lets everyone through when
+// the management API is not protected.
+func MustManageWebhook(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		signatureHeader := r.Header.Get("X-Hub-Signature")
+		principal := context.PrincipalFromContext(r.Context())
+		wh := context.WebhookFromContext(r.Context())
 
-		signatureInfo := strings.Split(signatureHeader, "=")
-		if len(signatureInfo) != 2 {
-			fmt.Fprintf(os.Stderr,"invalid signature header: %v\n", signatureInfo)
-			errors.RespondWithError(w, errors.NewAppError(http.StatusBadRequest, "malformed signature header"))
+		if principal != nil && !principal.CanManage(wh.Team) {
+			fmt.Fprintf(os.Stderr, "%v is not allowed to manage webhook %v of team %v\n", principal.Name, wh.Id, wh.Team)
+			errors.RespondWithError(w, errors.NewAppError(http.StatusForbidden, "not allowed to manage webhooks of team " + wh.Team))
 			return
 		}
 
-		if signatureInfo[0] != "sha1" {
-			fmt.Fprintf(os.Stderr,"invalid signature header: %v: unknown algo: %v\n", signatureHeader, signatureInfo[0])
-			errors.RespondWithError(w, errors.NewAppError(http.StatusBadRequest, "malformed signature header, unknown algo"))
-			return
-		}
+		h.ServeHTTP(w, r)
+	})
+}
 
-		signature, err := hex.DecodeString(signatureInfo[1])
+// MustComeFromAllowedSource refuses deliveries sent from outside the source
+// ranges of the webhook in the request context. Webhooks without their own
+// ranges accept GitHub deliveries from GitHub's hook ranges in sources, or
+// from anywhere if sources checks no ranges, and deliveries from other
+// providers from anywhere.
+func MustComeFromAllowedSource(sources *allowlist.Allowlist) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wh := context.WebhookFromContext(r.Context())
+			ip := sources.ClientIP(r)
+
+			allowed := true
+			if len(wh.SourceRanges) > 0 {
+				allowed = allowlist.Contains(wh.SourceNetworks(), ip)
+			} else if wh.Provider == "" || wh.Provider == webhook.ProviderGitHub {
+				allowed = !sources.Checked() || sources.Allowed(ip)
+			}
+
+			if !allowed {
+				fmt.Fprintf(os.Stderr, "refusing delivery to %v from %v, it is not in the allowed source ranges\n", wh.Id, ip)
+				errors.RespondWithError(w, errors.NewAppError(http.StatusForbidden, "source address not allowed"))
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
 
-		if err != nil {
-			fmt.Fprintf(os.Stderr,"invalid signature header: %v\n", err)
-			errors.RespondWithError(w, errors.NewAppError(http.StatusBadRequest, "malformed signature header, unknown contents"))
+// MustHaveValidSignature checks that the delivery was sent by the webhook's
+// provider, using the provider's verifier.
+func MustHaveValidSignature(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provider := ""
+		wh := context.WebhookFromContext(r.Context())
+		if wh != nil {
+			provider = wh.Provider
+		}
+
+		verifier, ok := verifiers[provider]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "no verifier for provider: %v\n", provider)
+			errors.RespondWithError(w, errors.NewAppError(http.StatusInternalServerError, "unsupported provider"))
 			return
 		}
 
-		if !checkSHA1MAC(context.RequestBodyFromContext(r.Context()), signature, context.WebhookFromContext(r.Context()).Secret) {
-			fmt.Fprintf(os.Stderr,"invalid signature: %x\n", signature)
-			errors.RespondWithError(w, errors.NewAppError(http.StatusForbidden, "invalid signature"))
+		if err := verifier.Verify(r, wh); err != nil {
+			errors.RespondWithError(w, err)
 			return
 		}
 
@@ -70,34 +139,53 @@ func MustHaveValidSignature(h http.Handler) http.Handler {
 	})
 }
 
-func checkSHA1MAC(message, messageMAC, key []byte) bool {
-	mac := hmac.New(sha1.New, key)
-	mac.Write(message)
-	expectedMAC := mac.Sum(nil)
-	return hmac.Equal(messageMAC, expectedMAC)
+// redactedHeaders hold credentials, like the GitLab token which is the
+// webhook secret itself, and are never logged.
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Gitlab-Token":      true,
 }
 
+// logOutput is where requests are logged. It is replaced in tests.
+var logOutput io.Writer = os.Stdout
+
 func LogHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Printf("[%v][%v] -> %v %v %v\n", time.Now(), r.RemoteAddr, r.Proto, r.Method, r.URL)
-		fmt.Printf("Headers:\n")
+		fmt.Fprintf(logOutput, "[%v][%v] -> %v %v %v\n", time.Now(), r.RemoteAddr, r.Proto, r.Method, r.URL)
+		fmt.Fprintf(logOutput, "Headers:\n")
 		for key, val := range r.Header {
-			fmt.Printf("%v: %v\n", key, val)
+			if redactedHeaders[http.CanonicalHeaderKey(key)] {
+				val = []string{"<redacted>"}
+			}
+			fmt.Fprintf(logOutput, "%v: %v\n", key, val)
 		}
 
 		h.ServeHTTP(w, r)
 	})
 }
 
-func ReadRequestBodyHandler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx, err := context.NewContextWithRequestBody(r.Context(), r)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to read request body: %v\n", err)
-			errors.RespondWithError(w, errors.NewAppError(http.StatusInternalServerError, "failed to read request body"))
-			return
-		}
-
-		h.ServeHTTP(w, r.WithContext(ctx))
-	})
+// ReadRequestBodyHandler reads the request body into the request context for
+// handlers that need all of it, like the signature verifiers. Bodies larger
+// than maxBytes are refused.
+func ReadRequestBodyHandler(maxBytes int64) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, release, err := context.NewContextWithRequestBody(r.Context(), r, maxBytes)
+			if err == context.ErrRequestBodyTooLarge {
+				fmt.Fprintf(os.Stderr, "refusing request body to %v larger than %d bytes\n", r.URL, maxBytes)
+				errors.RespondWithError(w, errors.NewAppError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body is larger than %d bytes", maxBytes)))
+				return
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read request body: %v\n", err)
+				errors.RespondWithError(w, errors.NewAppError(http.StatusInternalServerError, "failed to read request body"))
+				return
+			}
+			defer release()
+
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
 }
@@ -1,6 +1,8 @@
 package middlewares
 
 import (
+	"bytes"
+	"os"
 	"net/http"
 	"reflect"
 	"testing"
@@ -10,6 +12,8 @@ import (
 	"github.com/navikt/webhookproxy/webhook"
 	"strings"
 	"github.com/gorilla/mux"
+	"github.com/navikt/webhookproxy/auth"
+	"github.com/navikt/webhookproxy/allowlist"
 )
 
 func checkResponseCode(t *testing.T, expected, actual int) {
@@ -42,10 +46,10 @@ func TestMustHaveWebhook(t *testing.T) {
 	})
 	t.Run("Webhook should be put in context", func(t *testing.T) {
 		wh, _ := webhook.New(webhook.CreateWebhookRequest{
-			"my-cool-webhook1",
-			"my-team-name",
-			"http://url-to-server.tld/hook",
-			[]byte("foobar"),
+			Name: "my-cool-webhook1",
+			Team: "my-team-name",
+			Url: "http://url-to-server.tld/hook",
+			Secret: []byte("foobar"),
 		})
 
 		nextHandlerCalled := false
@@ -75,6 +79,212 @@ func TestMustHaveWebhook(t *testing.T) {
 	})
 }
 
+func TestMustBeAuthenticated(t *testing.T) {
+	authenticator := auth.NewTokenAuthenticator([]auth.Token{{Name: "team-a-ci", Token: "s3cr3t"}})
+
+	t.Run("Missing token should fail", func(t *testing.T) {
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("MustBeAuthenticated() should not call next handler in chain")
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hooks", nil)
+
+		MustBeAuthenticated(authenticator)(dummyHandler).ServeHTTP(w, r)
+
+		checkResponseCode(t, http.StatusUnauthorized, w.Code)
+		checkResponseBody(t, "{\"message\":\"missing bearer token\"}\n", w.Body.String())
+	})
+
+	t.Run("Invalid token should fail", func(t *testing.T) {
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("MustBeAuthenticated() should not call next handler in chain")
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hooks", nil)
+		r.Header.Set("Authorization", "Bearer wrong")
+
+		MustBeAuthenticated(authenticator)(dummyHandler).ServeHTTP(w, r)
+
+		checkResponseCode(t, http.StatusUnauthorized, w.Code)
+		checkResponseBody(t, "{\"message\":\"invalid token\"}\n", w.Body.String())
+	})
+
+	t.Run("Principal should be put in context", func(t *testing.T) {
+		nextHandlerCalled := false
+
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			nextHandlerCalled = true
+
+			principal := context.PrincipalFromContext(r.Context())
+			if principal == nil || principal.Name != "team-a-ci" {
+				t.Errorf("MustBeAuthenticated() should set principal in request context, was <%v>", principal)
+			}
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hooks", nil)
+		r.Header.Set("Authorization", "Bearer s3cr3t")
+
+		MustBeAuthenticated(authenticator)(dummyHandler).ServeHTTP(w, r)
+
+		if !nextHandlerCalled {
+			t.Errorf("MustBeAuthenticated() should call next handler in chain")
+		}
+	})
+}
+
+func TestMustManageWebhook(t *testing.T) {
+	wh := &webhook.Webhook{Id: "my-hook-id", Team: "team-a"}
+
+	t.Run("Member of another team should be forbidden", func(t *testing.T) {
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("MustManageWebhook() should not call next handler in chain")
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hooks/" + wh.Id, nil)
+		ctx := context.NewContextWithWebhook(r.Context(), wh)
+		ctx = context.NewContextWithPrincipal(ctx, &auth.Principal{Name: "team-b-ci", Teams: []string{"team-b"}})
+
+		MustManageWebhook(dummyHandler).ServeHTTP(w, r.WithContext(ctx))
+
+		checkResponseCode(t, http.StatusForbidden, w.Code)
+		checkResponseBody(t, "{\"message\":\"not allowed to manage webhooks of team team-a\"}\n", w.Body.String())
+	})
+
+	t.Run("Member of the webhook's team should pass", func(t *testing.T) {
+		nextHandlerCalled := false
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			nextHandlerCalled = true
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/hooks/" + wh.Id, nil)
+		ctx := context.NewContextWithWebhook(r.Context(), wh)
+		ctx = context.NewContextWithPrincipal(ctx, &auth.Principal{Name: "team-a-ci", Teams: []string{"team-a"}})
+
+		MustManageWebhook(dummyHandler).ServeHTTP(w, r.WithContext(ctx))
+
+		if !nextHandlerCalled {
+			t.Errorf("MustManageWebhook() should call next handler in chain")
+		}
+	})
+}
+
+func TestMustComeFromAllowedSource(t *testing.T) {
+	hooks, _ := allowlist.ParseCIDRs([]string{"192.30.252.0/22"})
+	sources := allowlist.New(nil)
+	sources.Set(hooks)
+
+	tests := []struct {
+		name       string
+		webhook    *webhook.Webhook
+		remoteAddr string
+		want       bool
+	}{
+		{"GitHub delivery from hook range", &webhook.Webhook{Id: "my-hook-id"}, "192.30.252.1:43210", true},
+		{"GitHub delivery from elsewhere", &webhook.Webhook{Id: "my-hook-id"}, "203.0.113.1:43210", false},
+		{"GitLab delivery from elsewhere", &webhook.Webhook{Id: "my-hook-id", Provider: webhook.ProviderGitLab}, "203.0.113.1:43210", true},
+		{"delivery from own range", &webhook.Webhook{Id: "my-hook-id", Provider: webhook.ProviderGitLab, SourceRanges: []string{"203.0.113.0/24"}}, "203.0.113.1:43210", true},
+		{"delivery from outside own range", &webhook.Webhook{Id: "my-hook-id", SourceRanges: []string{"203.0.113.0/24"}}, "192.30.252.1:43210", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nextHandlerCalled := false
+			dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+				nextHandlerCalled = true
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/hooks/" + tt.webhook.Id, nil)
+			r.RemoteAddr = tt.remoteAddr
+			ctx := context.NewContextWithWebhook(r.Context(), tt.webhook)
+
+			MustComeFromAllowedSource(sources)(dummyHandler).ServeHTTP(w, r.WithContext(ctx))
+
+			if nextHandlerCalled != tt.want {
+				t.Errorf("MustComeFromAllowedSource() called next handler = %v, want %v", nextHandlerCalled, tt.want)
+			}
+			if !tt.want {
+				checkResponseCode(t, http.StatusForbidden, w.Code)
+				checkResponseBody(t, "{\"message\":\"source address not allowed\"}\n", w.Body.String())
+			}
+		})
+	}
+
+	t.Run("GitHub delivery should pass when no ranges are configured", func(t *testing.T) {
+		nextHandlerCalled := false
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			nextHandlerCalled = true
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/hooks/my-hook-id", nil)
+		r.RemoteAddr = "203.0.113.1:43210"
+		ctx := context.NewContextWithWebhook(r.Context(), &webhook.Webhook{Id: "my-hook-id"})
+
+		MustComeFromAllowedSource(allowlist.New(nil))(dummyHandler).ServeHTTP(w, r.WithContext(ctx))
+
+		if !nextHandlerCalled {
+			t.Errorf("MustComeFromAllowedSource() should call next handler in chain")
+		}
+	})
+
+	t.Run("GitHub delivery should be refused while required ranges are not loaded", func(t *testing.T) {
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("MustComeFromAllowedSource() should not call next handler in chain")
+		})
+
+		required := allowlist.New(nil)
+		required.Require()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/hooks/my-hook-id", nil)
+		r.RemoteAddr = "192.30.252.1:43210"
+		ctx := context.NewContextWithWebhook(r.Context(), &webhook.Webhook{Id: "my-hook-id"})
+
+		MustComeFromAllowedSource(required)(dummyHandler).ServeHTTP(w, r.WithContext(ctx))
+
+		checkResponseCode(t, http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Delivery should be checked against the ranges parsed when the webhook was created", func(t *testing.T) {
+		wh, err := webhook.FromRequest(webhook.CreateWebhookRequest{
+			Name: "my-ranged-hook",
+			Team: "my-team",
+			Url: "http://my-server.tld/hook",
+			Secret: []byte("s3cr3t"),
+			SourceRanges: []string{"203.0.113.0/24"},
+		}, webhook.SourceAPI)
+		if err != nil {
+			t.Fatalf("FromRequest() error = %v", err)
+		}
+		if got := wh.SourceNetworks(); len(got) != 1 || got[0].String() != "203.0.113.0/24" {
+			t.Errorf("SourceNetworks() = %v, want [203.0.113.0/24]", got)
+		}
+
+		for addr, want := range map[string]bool{"203.0.113.1:43210": true, "192.30.252.1:43210": false} {
+			nextHandlerCalled := false
+			dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+				nextHandlerCalled = true
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/hooks/" + wh.Id, nil)
+			r.RemoteAddr = addr
+			ctx := context.NewContextWithWebhook(r.Context(), wh)
+
+			MustComeFromAllowedSource(sources)(dummyHandler).ServeHTTP(w, r.WithContext(ctx))
+
+			if nextHandlerCalled != want {
+				t.Errorf("MustComeFromAllowedSource() from %v called next handler = %v, want %v", addr, nextHandlerCalled, want)
+			}
+		}
+	})
+}
+
 func TestMustHaveValidSignature(t *testing.T) {
 	t.Run("No header should fail", func(t *testing.T) {
 		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
@@ -127,10 +337,10 @@ func TestMustHaveValidSignature(t *testing.T) {
 
 	t.Run("Invalid signature should fail", func(t *testing.T) {
 		wh, _ := webhook.New(webhook.CreateWebhookRequest{
-			"my-cool-webhook2",
-			"my-team-name",
-			"http://url-to-server.tld/hook",
-			[]byte("foobar"),
+			Name: "my-cool-webhook2",
+			Team: "my-team-name",
+			Url: "http://url-to-server.tld/hook",
+			Secret: []byte("foobar"),
 		})
 
 		givenSignature := "816421f91f8bb65da114aef4616abf77052cccfe"
@@ -144,7 +354,7 @@ func TestMustHaveValidSignature(t *testing.T) {
 		r = mux.SetURLVars(r, map[string]string{"id": wh.Id})
 		r.Header.Set("X-Hub-Signature", "sha1=" + givenSignature)
 
-		handler := ReadRequestBodyHandler(MustHaveWebhook(MustHaveValidSignature(dummyHandler)))
+		handler := ReadRequestBodyHandler(1024)(MustHaveWebhook(MustHaveValidSignature(dummyHandler)))
 		handler.ServeHTTP(w, r)
 
 		checkResponseCode(t, http.StatusForbidden, w.Code)
@@ -153,10 +363,10 @@ func TestMustHaveValidSignature(t *testing.T) {
 
 	t.Run("Valid signature should pass", func(t *testing.T) {
 		wh, _ := webhook.New(webhook.CreateWebhookRequest{
-			"my-cool-webhook3",
-			"my-team-name",
-			"http://url-to-server.tld/hook",
-			[]byte("foobar"),
+			Name: "my-cool-webhook3",
+			Team: "my-team-name",
+			Url: "http://url-to-server.tld/hook",
+			Secret: []byte("foobar"),
 		})
 
 		givenSignature := "816421f91f8bb65da114aef4616abf77052cccfe"
@@ -166,7 +376,7 @@ func TestMustHaveValidSignature(t *testing.T) {
 			nextHandlerCalled = true
 		})
 
-		handler := ReadRequestBodyHandler(MustHaveWebhook(MustHaveValidSignature(dummyHandler)))
+		handler := ReadRequestBodyHandler(1024)(MustHaveWebhook(MustHaveValidSignature(dummyHandler)))
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/hook/" + wh.Id, strings.NewReader("Hello, World!"))
@@ -180,6 +390,88 @@ func TestMustHaveValidSignature(t *testing.T) {
 			return
 		}
 	})
+
+	t.Run("Valid sha256 signature should be preferred", func(t *testing.T) {
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-cool-webhook4",
+			Team: "my-team-name",
+			Url: "http://url-to-server.tld/hook",
+			Secret: []byte("foobar"),
+		})
+
+		nextHandlerCalled := false
+
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			nextHandlerCalled = true
+		})
+
+		handler := ReadRequestBodyHandler(1024)(MustHaveWebhook(MustHaveValidSignature(dummyHandler)))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/hook/" + wh.Id, strings.NewReader("Hello, World!"))
+		r = mux.SetURLVars(r, map[string]string{"id": wh.Id})
+		r.Header.Set("X-Hub-Signature", "sha1=0000000000000000000000000000000000000000")
+		r.Header.Set("X-Hub-Signature-256", "sha256=47f6b34fd7b43d81a91ce2dc51b5e37858f661c31b3cafbabcb86cd82f7fd571")
+
+		handler.ServeHTTP(w, r)
+
+		if !nextHandlerCalled {
+			t.Errorf("MustHaveValidSignature() should call next handler in chain")
+			return
+		}
+	})
+
+	t.Run("Invalid sha256 signature should fail even with valid sha1 signature", func(t *testing.T) {
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-cool-webhook5",
+			Team: "my-team-name",
+			Url: "http://url-to-server.tld/hook",
+			Secret: []byte("foobar"),
+		})
+
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("MustHaveValidSignature() should not call next handler in chain")
+		})
+
+		handler := ReadRequestBodyHandler(1024)(MustHaveWebhook(MustHaveValidSignature(dummyHandler)))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/hook/" + wh.Id, strings.NewReader("Hello, World!"))
+		r = mux.SetURLVars(r, map[string]string{"id": wh.Id})
+		r.Header.Set("X-Hub-Signature", "sha1=816421f91f8bb65da114aef4616abf77052cccfe")
+		r.Header.Set("X-Hub-Signature-256", "sha256=0000000000000000000000000000000000000000000000000000000000000000")
+
+		handler.ServeHTTP(w, r)
+
+		checkResponseCode(t, http.StatusForbidden, w.Code)
+		checkResponseBody(t, "{\"message\":\"invalid signature\"}\n", w.Body.String())
+	})
+
+	t.Run("Sha1 signature should fail when webhook requires sha256", func(t *testing.T) {
+		wh, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name: "my-cool-webhook6",
+			Team: "my-team-name",
+			Url: "http://url-to-server.tld/hook",
+			Secret: []byte("foobar"),
+			RequireSHA256: true,
+		})
+
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("MustHaveValidSignature() should not call next handler in chain")
+		})
+
+		handler := ReadRequestBodyHandler(1024)(MustHaveWebhook(MustHaveValidSignature(dummyHandler)))
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/hook/" + wh.Id, strings.NewReader("Hello, World!"))
+		r = mux.SetURLVars(r, map[string]string{"id": wh.Id})
+		r.Header.Set("X-Hub-Signature", "sha1=816421f91f8bb65da114aef4616abf77052cccfe")
+
+		handler.ServeHTTP(w, r)
+
+		checkResponseCode(t, http.StatusBadRequest, w.Code)
+		checkResponseBody(t, "{\"message\":\"sha256 signature required\"}\n", w.Body.String())
+	})
 }
 
 func Test_checkSHA1MAC(t *testing.T) {
@@ -221,6 +513,17 @@ func Test_checkSHA1MAC(t *testing.T) {
 	}
 }
 
+func Test_checkSHA256MAC(t *testing.T) {
+	signature, _ := hex.DecodeString("47f6b34fd7b43d81a91ce2dc51b5e37858f661c31b3cafbabcb86cd82f7fd571")
+
+	if !checkSHA256MAC([]byte("Hello, World!"), signature, []byte("foobar")) {
+		t.Errorf("checkSHA256MAC() = false for valid hmac")
+	}
+	if checkSHA256MAC([]byte("Hello, World!"), signature, []byte("foobar1234")) {
+		t.Errorf("checkSHA256MAC() = true for invalid hmac")
+	}
+}
+
 func TestReadRequestBodyHandler(t *testing.T) {
 	t.Run("Request body should be put in context", func(t *testing.T) {
 		body := "Hello, World!"
@@ -238,7 +541,7 @@ func TestReadRequestBodyHandler(t *testing.T) {
 			}
 		})
 
-		handler := ReadRequestBodyHandler(dummyHandler)
+		handler := ReadRequestBodyHandler(1024)(dummyHandler)
 
 		w := httptest.NewRecorder()
 		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
@@ -250,4 +553,92 @@ func TestReadRequestBodyHandler(t *testing.T) {
 			return
 		}
 	})
+
+	t.Run("Body of the max size should be read", func(t *testing.T) {
+		body := strings.Repeat("a", 16)
+
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			if bodyFromContext := context.RequestBodyFromContext(r.Context()); body != string(bodyFromContext) {
+				t.Errorf("ReadRequestBodyHandler() should set body in request context to <%v>, was <%v>", body, string(bodyFromContext))
+			}
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+
+		ReadRequestBodyHandler(16)(dummyHandler).ServeHTTP(w, r)
+
+		checkResponseCode(t, http.StatusOK, w.Code)
+	})
+
+	t.Run("Body larger than the max size should be refused", func(t *testing.T) {
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("ReadRequestBodyHandler() should not call next handler in chain")
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 17)))
+
+		ReadRequestBodyHandler(16)(dummyHandler).ServeHTTP(w, r)
+
+		checkResponseCode(t, http.StatusRequestEntityTooLarge, w.Code)
+		checkResponseBody(t, "{\"message\":\"request body is larger than 16 bytes\"}\n", w.Body.String())
+	})
+
+	t.Run("Body of unknown length larger than the max size should be refused", func(t *testing.T) {
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+			t.Errorf("ReadRequestBodyHandler() should not call next handler in chain")
+		})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/", strings.NewReader(strings.Repeat("a", 17)))
+		r.ContentLength = -1
+
+		ReadRequestBodyHandler(16)(dummyHandler).ServeHTTP(w, r)
+
+		checkResponseCode(t, http.StatusRequestEntityTooLarge, w.Code)
+	})
+
+	t.Run("Bodies of earlier requests should not leak into later ones", func(t *testing.T) {
+		for _, body := range []string{"a longer first body", "short"} {
+			dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {
+				if bodyFromContext := context.RequestBodyFromContext(r.Context()); body != string(bodyFromContext) {
+					t.Errorf("ReadRequestBodyHandler() should set body in request context to <%v>, was <%v>", body, string(bodyFromContext))
+				}
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+
+			ReadRequestBodyHandler(1024)(dummyHandler).ServeHTTP(w, r)
+		}
+	})
+}
+
+func TestLogHandler(t *testing.T) {
+	t.Run("Credentials should not be logged", func(t *testing.T) {
+		var logged bytes.Buffer
+		logOutput = &logged
+		defer func() { logOutput = os.Stdout }()
+
+		dummyHandler := http.HandlerFunc(func (w http.ResponseWriter, r *http.Request) {})
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/hooks/my-hook", strings.NewReader("Hello, World!"))
+		r.Header.Set("X-Gitlab-Token", "gitlab-webhook-secret")
+		r.Header.Set("Authorization", "Bearer api-token")
+		r.Header.Set("Cookie", "session=session-cookie")
+		r.Header.Set("X-Gitlab-Event", "Push Hook")
+
+		LogHandler(dummyHandler).ServeHTTP(w, r)
+
+		for _, secret := range []string{"gitlab-webhook-secret", "api-token", "session-cookie"} {
+			if strings.Contains(logged.String(), secret) {
+				t.Errorf("LogHandler() logged <%v>: %v", secret, logged.String())
+			}
+		}
+		if !strings.Contains(logged.String(), "Push Hook") {
+			t.Errorf("LogHandler() should log other headers, logged %v", logged.String())
+		}
+	})
 }
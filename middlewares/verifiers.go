@@ -0,0 +1,249 @@
+package middlewares
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/navikt/webhookproxy/context"
+	"github.com/navikt/webhookproxy/errors"
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// Verifier checks that a delivery was sent by the provider of the webhook,
+// typically by checking a signature over the request body made with the
+// webhook secret. Failures are returned as errors.appError.
+type Verifier interface {
+	Verify(r *http.Request, wh *webhook.Webhook) error
+}
+
+type VerifierFunc func(r *http.Request, wh *webhook.Webhook) error
+
+func (f VerifierFunc) Verify(r *http.Request, wh *webhook.Webhook) error {
+	return f(r, wh)
+}
+
+var verifiers = map[string]Verifier{
+	"":                        VerifierFunc(verifyGitHub),
+	webhook.ProviderGitHub:    VerifierFunc(verifyGitHub),
+	webhook.ProviderGitLab:    VerifierFunc(verifyGitLab),
+	webhook.ProviderBitbucket: VerifierFunc(verifyBitbucket),
+	webhook.ProviderGitea:     VerifierFunc(verifyGitea),
+	webhook.ProviderSlack:     VerifierFunc(verifySlack),
+	webhook.ProviderStripe:    VerifierFunc(verifyStripe),
+}
+
+// defaultSignatureTolerance is how old a timestamped signature may be when
+// the webhook does not say otherwise.
+const defaultSignatureTolerance = 5 * time.Minute
+
+// now is replaced in tests.
+var now = time.Now
+
+var signatureAlgos = map[string]func(message, messageMAC, key []byte) bool{
+	"sha1":   checkSHA1MAC,
+	"sha256": checkSHA256MAC,
+}
+
+func checkSHA1MAC(message, messageMAC, key []byte) bool {
+	return checkMAC(sha1.New, message, messageMAC, key)
+}
+
+func checkSHA256MAC(message, messageMAC, key []byte) bool {
+	return checkMAC(sha256.New, message, messageMAC, key)
+}
+
+func checkMAC(newHash func() hash.Hash, message, messageMAC, key []byte) bool {
+	mac := hmac.New(newHash, key)
+	mac.Write(message)
+	expectedMAC := mac.Sum(nil)
+	return hmac.Equal(messageMAC, expectedMAC)
+}
+
+// verifyGitHub checks the HMAC signature GitHub computes over the request
+// body with the webhook secret. X-Hub-Signature-256 is preferred when
+// present; otherwise the SHA-1 X-Hub-Signature is checked, unless the
+// webhook requires SHA-256.
+func verifyGitHub(r *http.Request, wh *webhook.Webhook) error {
+	signatureHeader := r.Header.Get("X-Hub-Signature-256")
+	if signatureHeader == "" {
+		signatureHeader = r.Header.Get("X-Hub-Signature")
+	}
+
+	signatureInfo := strings.Split(signatureHeader, "=")
+	if len(signatureInfo) != 2 {
+		fmt.Fprintf(os.Stderr, "invalid signature header: %v\n", signatureInfo)
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header")
+	}
+
+	checkMAC, ok := signatureAlgos[signatureInfo[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid signature header: %v: unknown algo: %v\n", signatureHeader, signatureInfo[0])
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header, unknown algo")
+	}
+
+	signature, err := hex.DecodeString(signatureInfo[1])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid signature header: %v\n", err)
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header, unknown contents")
+	}
+
+	if wh.RequireSHA256 && signatureInfo[0] != "sha256" {
+		fmt.Fprintf(os.Stderr, "webhook %v requires sha256 signature, got %v\n", wh.Id, signatureInfo[0])
+		return errors.NewAppError(http.StatusBadRequest, "sha256 signature required")
+	}
+
+	if !checkMAC(context.RequestBodyFromContext(r.Context()), signature, wh.Secret) {
+		fmt.Fprintf(os.Stderr, "invalid signature: %x\n", signature)
+		return errors.NewAppError(http.StatusForbidden, "invalid signature")
+	}
+
+	return nil
+}
+
+// verifyGitLab compares the X-Gitlab-Token header with the webhook secret.
+// GitLab does not sign the request body.
+func verifyGitLab(r *http.Request, wh *webhook.Webhook) error {
+	token := r.Header.Get("X-Gitlab-Token")
+	if token == "" {
+		fmt.Fprintf(os.Stderr, "missing X-Gitlab-Token header\n")
+		return errors.NewAppError(http.StatusBadRequest, "missing token header")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(token), wh.Secret) != 1 {
+		fmt.Fprintf(os.Stderr, "invalid X-Gitlab-Token for webhook %v\n", wh.Id)
+		return errors.NewAppError(http.StatusForbidden, "invalid token")
+	}
+
+	return nil
+}
+
+// verifyBitbucket checks the HMAC-SHA256 signature in X-Hub-Signature,
+// formatted like GitHub's as sha256=<hex>.
+func verifyBitbucket(r *http.Request, wh *webhook.Webhook) error {
+	signatureHeader := r.Header.Get("X-Hub-Signature")
+	if !strings.HasPrefix(signatureHeader, "sha256=") {
+		fmt.Fprintf(os.Stderr, "invalid signature header: %v\n", signatureHeader)
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header")
+	}
+
+	return verifyHexSHA256(strings.TrimPrefix(signatureHeader, "sha256="), context.RequestBodyFromContext(r.Context()), wh.Secret)
+}
+
+// verifyGitea checks the hex encoded HMAC-SHA256 signature in
+// X-Gitea-Signature.
+func verifyGitea(r *http.Request, wh *webhook.Webhook) error {
+	signatureHeader := r.Header.Get("X-Gitea-Signature")
+	if signatureHeader == "" {
+		fmt.Fprintf(os.Stderr, "missing X-Gitea-Signature header\n")
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header")
+	}
+
+	return verifyHexSHA256(signatureHeader, context.RequestBodyFromContext(r.Context()), wh.Secret)
+}
+
+// verifySlack checks Slack's v0 signature, an HMAC-SHA256 of
+// v0:<timestamp>:<body> with the signing secret, and that the timestamp is
+// within the tolerance.
+func verifySlack(r *http.Request, wh *webhook.Webhook) error {
+	timestamp := r.Header.Get("X-Slack-Request-Timestamp")
+	signatureHeader := r.Header.Get("X-Slack-Signature")
+	if timestamp == "" || !strings.HasPrefix(signatureHeader, "v0=") {
+		fmt.Fprintf(os.Stderr, "invalid slack signature headers: %v %v\n", timestamp, signatureHeader)
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header")
+	}
+
+	if err := checkTimestamp(timestamp, wh); err != nil {
+		return err
+	}
+
+	message := append([]byte("v0:"+timestamp+":"), context.RequestBodyFromContext(r.Context())...)
+	return verifyHexSHA256(strings.TrimPrefix(signatureHeader, "v0="), message, wh.Secret)
+}
+
+// verifyStripe checks the Stripe-Signature header, t=<timestamp> followed by
+// one or more v1=<signature>, where each signature is an HMAC-SHA256 of
+// <timestamp>.<body>. Any v1 signature may match, since Stripe signs with
+// both the old and the new secret while a secret is being rolled.
+func verifyStripe(r *http.Request, wh *webhook.Webhook) error {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+
+	if timestamp == "" || len(signatures) == 0 {
+		fmt.Fprintf(os.Stderr, "invalid Stripe-Signature header: %v\n", r.Header.Get("Stripe-Signature"))
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header")
+	}
+
+	if err := checkTimestamp(timestamp, wh); err != nil {
+		return err
+	}
+
+	message := append([]byte(timestamp+"."), context.RequestBodyFromContext(r.Context())...)
+
+	var err error
+	for _, signature := range signatures {
+		if err = verifyHexSHA256(signature, message, wh.Secret); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func verifyHexSHA256(signatureHex string, message []byte, secret []byte) error {
+	signature, err := hex.DecodeString(signatureHex)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid signature header: %v\n", err)
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature header, unknown contents")
+	}
+
+	if !checkSHA256MAC(message, signature, secret) {
+		fmt.Fprintf(os.Stderr, "invalid signature: %x\n", signature)
+		return errors.NewAppError(http.StatusForbidden, "invalid signature")
+	}
+
+	return nil
+}
+
+// checkTimestamp refuses signatures with a unix timestamp outside of the
+// webhook's tolerance, so captured deliveries cannot be replayed later.
+func checkTimestamp(timestamp string, wh *webhook.Webhook) error {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid signature timestamp: %v\n", timestamp)
+		return errors.NewAppError(http.StatusBadRequest, "malformed signature timestamp")
+	}
+
+	tolerance := defaultSignatureTolerance
+	if wh.SignatureTolerance > 0 {
+		tolerance = time.Duration(wh.SignatureTolerance) * time.Second
+	}
+
+	age := now().Sub(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		fmt.Fprintf(os.Stderr, "signature timestamp %v is outside tolerance of %v\n", timestamp, tolerance)
+		return errors.NewAppError(http.StatusForbidden, "signature timestamp outside tolerance")
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package middlewares
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/navikt/webhookproxy/context"
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func hmacSHA256Hex(message string, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestMustHaveValidSignature_providers(t *testing.T) {
+	fixedNow := time.Unix(1531420618, 0)
+	now = func() time.Time { return fixedNow }
+	defer func() { now = time.Now }()
+
+	body := `{"token": "Jhj5dZrVaK7ZwHHjRyZWjbDl"}`
+	ts := strconv.FormatInt(fixedNow.Unix(), 10)
+	oldTs := strconv.FormatInt(fixedNow.Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		provider  string
+		tolerance int
+		headers   map[string]string
+		want      int
+	}{
+		{"gitlab valid token", webhook.ProviderGitLab, 0, map[string]string{"X-Gitlab-Token": "foobar"}, http.StatusOK},
+		{"gitlab invalid token", webhook.ProviderGitLab, 0, map[string]string{"X-Gitlab-Token": "foobaz"}, http.StatusForbidden},
+		{"gitlab missing token", webhook.ProviderGitLab, 0, map[string]string{}, http.StatusBadRequest},
+
+		{"bitbucket valid signature", webhook.ProviderBitbucket, 0, map[string]string{"X-Hub-Signature": "sha256=" + hmacSHA256Hex(body, "foobar")}, http.StatusOK},
+		{"bitbucket invalid signature", webhook.ProviderBitbucket, 0, map[string]string{"X-Hub-Signature": "sha256=" + hmacSHA256Hex(body, "foobaz")}, http.StatusForbidden},
+		{"bitbucket sha1 signature", webhook.ProviderBitbucket, 0, map[string]string{"X-Hub-Signature": "sha1=816421f91f8bb65da114aef4616abf77052cccfe"}, http.StatusBadRequest},
+
+		{"gitea valid signature", webhook.ProviderGitea, 0, map[string]string{"X-Gitea-Signature": hmacSHA256Hex(body, "foobar")}, http.StatusOK},
+		{"gitea invalid signature", webhook.ProviderGitea, 0, map[string]string{"X-Gitea-Signature": hmacSHA256Hex(body, "foobaz")}, http.StatusForbidden},
+
+		{"slack valid signature", webhook.ProviderSlack, 0, map[string]string{
+			"X-Slack-Request-Timestamp": ts,
+			"X-Slack-Signature":         "v0=" + hmacSHA256Hex("v0:"+ts+":"+body, "foobar"),
+		}, http.StatusOK},
+		{"slack invalid signature", webhook.ProviderSlack, 0, map[string]string{
+			"X-Slack-Request-Timestamp": ts,
+			"X-Slack-Signature":         "v0=" + hmacSHA256Hex("v0:"+ts+":"+body, "foobaz"),
+		}, http.StatusForbidden},
+		{"slack old timestamp", webhook.ProviderSlack, 0, map[string]string{
+			"X-Slack-Request-Timestamp": oldTs,
+			"X-Slack-Signature":         "v0=" + hmacSHA256Hex("v0:"+oldTs+":"+body, "foobar"),
+		}, http.StatusForbidden},
+		{"slack old timestamp within webhook tolerance", webhook.ProviderSlack, 900, map[string]string{
+			"X-Slack-Request-Timestamp": oldTs,
+			"X-Slack-Signature":         "v0=" + hmacSHA256Hex("v0:"+oldTs+":"+body, "foobar"),
+		}, http.StatusOK},
+
+		{"stripe valid signature", webhook.ProviderStripe, 0, map[string]string{
+			"Stripe-Signature": "t=" + ts + ",v1=" + hmacSHA256Hex(ts+"."+body, "foobar") + ",v0=6ffbb59b2300aae63f27240690",
+		}, http.StatusOK},
+		{"stripe valid signature during secret roll", webhook.ProviderStripe, 0, map[string]string{
+			"Stripe-Signature": "t=" + ts + ",v1=" + hmacSHA256Hex(ts+"."+body, "old-secret") + ",v1=" + hmacSHA256Hex(ts+"."+body, "foobar"),
+		}, http.StatusOK},
+		{"stripe invalid signature", webhook.ProviderStripe, 0, map[string]string{
+			"Stripe-Signature": "t=" + ts + ",v1=" + hmacSHA256Hex(ts+"."+body, "foobaz"),
+		}, http.StatusForbidden},
+		{"stripe old timestamp", webhook.ProviderStripe, 0, map[string]string{
+			"Stripe-Signature": "t=" + oldTs + ",v1=" + hmacSHA256Hex(oldTs+"."+body, "foobar"),
+		}, http.StatusForbidden},
+		{"stripe missing timestamp", webhook.ProviderStripe, 0, map[string]string{
+			"Stripe-Signature": "v1=" + hmacSHA256Hex(ts+"."+body, "foobar"),
+		}, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := &webhook.Webhook{
+				Id:                 "my-hook-id",
+				Secret:             []byte("foobar"),
+				Provider:           tt.provider,
+				SignatureTolerance: tt.tolerance,
+			}
+
+			dummyHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/hooks/"+wh.Id, strings.NewReader(body))
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			r = r.WithContext(context.NewContextWithWebhook(r.Context(), wh))
+
+			ReadRequestBodyHandler(1024)(MustHaveValidSignature(dummyHandler)).ServeHTTP(w, r)
+
+			checkResponseCode(t, tt.want, w.Code)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Run applies the migrations of a component that have not been applied yet,
+// in order, each in its own transaction. Applied versions are recorded per
+// component in the schema_migrations table, so released migrations must never
+// be changed; append a new one instead.
+//
+// When several replicas start at the same time, one of them applies a
+// migration and the others fail to record it; they then see it as applied
+// and move on.
+func Run(db *sql.DB, component string, migrations []string) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		component VARCHAR(64) NOT NULL,
+		version INTEGER NOT NULL,
+		PRIMARY KEY (component, version)
+	)`)
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	for i, migration := range migrations {
+		version := i + 1
+
+		applied, err := isApplied(db, component, version)
+		if err != nil {
+			return err
+		}
+		if applied {
+			continue
+		}
+
+		if err := apply(db, component, version, migration); err != nil {
+			if applied, _ := isApplied(db, component, version); applied {
+				continue
+			}
+			return fmt.Errorf("failed to apply %v migration %d: %v", component, version, err)
+		}
+	}
+
+	return nil
+}
+
+func isApplied(db *sql.DB, component string, version int) (bool, error) {
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations WHERE component = $1 AND version = $2`, component, version).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func apply(db *sql.DB, component string, version int, migration string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`INSERT INTO schema_migrations (component, version) VALUES ($1, $2)`, component, version); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(migration); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
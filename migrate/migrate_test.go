@@ -0,0 +1,74 @@
+package migrate
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("sql.Open() error = %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	return db
+}
+
+func TestRun(t *testing.T) {
+	t.Run("Migrations should be applied once", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		migrations := []string{
+			`CREATE TABLE things (id INTEGER PRIMARY KEY)`,
+			`INSERT INTO things (id) VALUES (1)`,
+		}
+
+		for i := 0; i < 2; i++ {
+			if err := Run(db, "things", migrations); err != nil {
+				t.Errorf("Run() error = %v", err)
+				return
+			}
+		}
+
+		var count int
+		db.QueryRow(`SELECT COUNT(*) FROM things`).Scan(&count)
+		if count != 1 {
+			t.Errorf("things has %d rows, want 1", count)
+		}
+	})
+
+	t.Run("New migrations should be applied after existing ones", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		migrations := []string{`CREATE TABLE things (id INTEGER PRIMARY KEY)`}
+		Run(db, "things", migrations)
+
+		migrations = append(migrations, `ALTER TABLE things ADD COLUMN name TEXT`)
+		if err := Run(db, "things", migrations); err != nil {
+			t.Errorf("Run() error = %v", err)
+			return
+		}
+
+		if _, err := db.Exec(`INSERT INTO things (id, name) VALUES (1, 'foo')`); err != nil {
+			t.Errorf("migration was not applied: %v", err)
+		}
+	})
+
+	t.Run("Failing migration should not be recorded", func(t *testing.T) {
+		db := openTestDB(t)
+		defer db.Close()
+
+		if err := Run(db, "things", []string{`NOT VALID SQL`}); err == nil {
+			t.Errorf("Run() should fail on invalid migration")
+			return
+		}
+
+		if applied, _ := isApplied(db, "things", 1); applied {
+			t.Errorf("failed migration should not be recorded as applied")
+		}
+	})
+}
@@ -0,0 +1,187 @@
+// Package ratelimit limits how often deliveries are forwarded with token
+// buckets. A bucket holds up to Burst tokens and is refilled with Rate tokens
+// a second; every delivery takes a token from the buckets of its webhook, its
+// team and the whole proxy.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit is the rate of a bucket in tokens a second, and how many tokens it
+// holds when full.
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst,omitempty"`
+}
+
+// Defaults are the limits applied to the whole proxy, to every team and to
+// every webhook without a limit of its own. Nil limits are not applied.
+type Defaults struct {
+	Global *Limit
+	Team   *Limit
+	Hook   *Limit
+}
+
+// Scopes limits are applied to.
+const (
+	ScopeGlobal = "global"
+	ScopeTeam   = "team"
+	ScopeHook   = "hook"
+)
+
+// Scope is a bucket a delivery takes a token from. Buckets are told apart by
+// their key.
+type Scope struct {
+	Name  string
+	Key   string
+	Limit *Limit
+}
+
+// Validate checks that l has a positive rate and a burst that is not
+// negative. A burst of zero is the rate rounded up.
+func Validate(l *Limit) error {
+	if l == nil {
+		return nil
+	}
+	if l.Rate <= 0 || math.IsInf(l.Rate, 0) || math.IsNaN(l.Rate) {
+		return fmt.Errorf("rate limit rate must be positive")
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("rate limit burst must not be negative")
+	}
+	return nil
+}
+
+// Parse parses a limit written as "<rate>" or "<rate>,<burst>".
+func Parse(s string) (*Limit, error) {
+	parts := strings.SplitN(s, ",", 2)
+
+	rate, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate limit: %v", s)
+	}
+	l := &Limit{Rate: rate}
+	if len(parts) == 2 {
+		if l.Burst, err = strconv.Atoi(strings.TrimSpace(parts[1])); err != nil {
+			return nil, fmt.Errorf("invalid rate limit burst: %v", s)
+		}
+	}
+
+	if err := Validate(l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return math.Max(1, math.Ceil(l.Rate))
+}
+
+// pruneInterval is how often full buckets are removed.
+const pruneInterval = time.Minute
+
+type bucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the bucket was last used.
+func (b *bucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed*b.limit.Rate)
+		b.last = now
+	}
+}
+
+// wait returns how long it takes until the bucket has a token.
+func (b *bucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// Limiter keeps the buckets of the scopes deliveries are limited in. It is
+// kept in process memory, so every replica limits on its own. It is safe for
+// concurrent use.
+type Limiter struct {
+	mu         sync.Mutex
+	buckets    map[string]*bucket
+	lastPruned time.Time
+}
+
+// NewLimiter creates a limiter with full buckets.
+func NewLimiter() *Limiter {
+	return &Limiter{buckets: map[string]*bucket{}}
+}
+
+// Reserve takes a token from the bucket of every scope and returns how long
+// to wait before acting on them. Buckets may be emptied ahead of time for
+// waits up to maxWait; if the wait is longer nothing is taken, and ok is
+// false. The scope with the longest wait is returned when there is one.
+func (l *Limiter) Reserve(scopes []Scope, now time.Time, maxWait time.Duration) (wait time.Duration, limited *Scope, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPruned) > pruneInterval {
+		for key, b := range l.buckets {
+			if b.refill(now); b.tokens >= b.limit.burst() {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastPruned = now
+	}
+
+	buckets := make([]*bucket, 0, len(scopes))
+	for i, scope := range scopes {
+		if scope.Limit == nil {
+			continue
+		}
+
+		b, found := l.buckets[scope.Key]
+		if !found || b.limit != *scope.Limit {
+			// a changed limit starts over with a full bucket
+			b = &bucket{limit: *scope.Limit, tokens: scope.Limit.burst(), last: now}
+			l.buckets[scope.Key] = b
+		}
+		b.refill(now)
+		buckets = append(buckets, b)
+
+		if w := b.wait(); w > wait {
+			wait = w
+			limited = &scopes[i]
+		}
+	}
+
+	if wait > maxWait {
+		return wait, limited, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return wait, limited, true
+}
+
+// Scopes returns the scopes a delivery to the webhook hookId of team is
+// limited in, with the webhook's own limit replacing the default if set.
+func (d Defaults) Scopes(hookId string, team string, own *Limit) []Scope {
+	hook := d.Hook
+	if own != nil {
+		hook = own
+	}
+	return []Scope{
+		{Name: ScopeHook, Key: ScopeHook + "/" + hookId, Limit: hook},
+		{Name: ScopeTeam, Key: ScopeTeam + "/" + team, Limit: d.Team},
+		{Name: ScopeGlobal, Key: ScopeGlobal, Limit: d.Global},
+	}
+}
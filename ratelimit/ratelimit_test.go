@@ -0,0 +1,127 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Limit
+		wantErr bool
+	}{
+		{in: "10", want: Limit{Rate: 10}},
+		{in: "0.5, 5", want: Limit{Rate: 0.5, Burst: 5}},
+		{in: "0", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "ten", wantErr: true},
+		{in: "10,x", wantErr: true},
+		{in: "10,-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && *got != tt.want {
+				t.Errorf("Parse() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiter_Reserve(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	limit := &Limit{Rate: 1, Burst: 2}
+	scopes := []Scope{{Name: ScopeHook, Key: "hook/a", Limit: limit}}
+
+	t.Run("burst should be allowed right away", func(t *testing.T) {
+		l := NewLimiter()
+		for i := 0; i < 2; i++ {
+			if wait, _, ok := l.Reserve(scopes, now, 0); !ok || wait != 0 {
+				t.Errorf("Reserve() %d = %v, %v, want 0, true", i, wait, ok)
+			}
+		}
+
+		wait, limited, ok := l.Reserve(scopes, now, 0)
+		if ok || wait != time.Second {
+			t.Errorf("Reserve() over burst = %v, %v, want 1s, false", wait, ok)
+		}
+		if limited == nil || limited.Name != ScopeHook {
+			t.Errorf("Reserve() over burst should tell the limiting scope, got %+v", limited)
+		}
+	})
+
+	t.Run("bucket should be refilled at the rate", func(t *testing.T) {
+		l := NewLimiter()
+		l.Reserve(scopes, now, 0)
+		l.Reserve(scopes, now, 0)
+
+		if _, _, ok := l.Reserve(scopes, now.Add(500*time.Millisecond), 0); ok {
+			t.Errorf("Reserve() should not be allowed before a token is earned")
+		}
+		if _, _, ok := l.Reserve(scopes, now.Add(time.Second), 0); !ok {
+			t.Errorf("Reserve() should be allowed once a token is earned")
+		}
+	})
+
+	t.Run("tokens should be reserved ahead up to max wait", func(t *testing.T) {
+		l := NewLimiter()
+		l.Reserve(scopes, now, 0)
+		l.Reserve(scopes, now, 0)
+
+		for i, want := range []time.Duration{time.Second, 2 * time.Second} {
+			if wait, _, ok := l.Reserve(scopes, now, 2*time.Second); !ok || wait != want {
+				t.Errorf("Reserve() %d = %v, %v, want %v, true", i, wait, ok, want)
+			}
+		}
+		if wait, _, ok := l.Reserve(scopes, now, 2*time.Second); ok || wait != 3*time.Second {
+			t.Errorf("Reserve() past max wait = %v, %v, want 3s, false", wait, ok)
+		}
+	})
+
+	t.Run("nothing should be taken when one scope is limited", func(t *testing.T) {
+		l := NewLimiter()
+		team := Scope{Name: ScopeTeam, Key: "team/x", Limit: &Limit{Rate: 1, Burst: 1}}
+		hooks := []Scope{{Name: ScopeHook, Key: "hook/a", Limit: limit}, team}
+
+		l.Reserve(hooks, now, 0)
+		if _, limited, ok := l.Reserve(hooks, now, 0); ok || limited.Name != ScopeTeam {
+			t.Errorf("Reserve() should be limited by the team, got %+v, %v", limited, ok)
+		}
+		if _, _, ok := l.Reserve(scopes, now, 0); !ok {
+			t.Errorf("Reserve() refused by the team should not take a token from the hook")
+		}
+	})
+
+	t.Run("scopes without a limit should not be limited", func(t *testing.T) {
+		l := NewLimiter()
+		for i := 0; i < 100; i++ {
+			if _, _, ok := l.Reserve(Defaults{}.Scopes("a", "x", nil), now, 0); !ok {
+				t.Fatalf("Reserve() without limits should be allowed")
+			}
+		}
+	})
+}
+
+func TestDefaults_Scopes(t *testing.T) {
+	defaults := Defaults{Global: &Limit{Rate: 100}, Team: &Limit{Rate: 10}, Hook: &Limit{Rate: 1}}
+	own := &Limit{Rate: 5}
+
+	scopes := defaults.Scopes("a", "x", own)
+	if scopes[0].Key != "hook/a" || scopes[0].Limit != own {
+		t.Errorf("Scopes() should limit the hook by its own limit, got %+v", scopes[0])
+	}
+	if scopes[1].Key != "team/x" || scopes[1].Limit != defaults.Team {
+		t.Errorf("Scopes() should limit the team by the default, got %+v", scopes[1])
+	}
+	if scopes[2].Key != "global" || scopes[2].Limit != defaults.Global {
+		t.Errorf("Scopes() should limit the proxy by the default, got %+v", scopes[2])
+	}
+
+	if scopes := defaults.Scopes("a", "x", nil); scopes[0].Limit != defaults.Hook {
+		t.Errorf("Scopes() should limit hooks without their own limit by the default, got %+v", scopes[0])
+	}
+}
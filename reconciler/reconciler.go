@@ -0,0 +1,203 @@
+package reconciler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+// Reconciler keeps the file managed webhooks in the store in sync with the
+// webhook definitions in a directory, typically a mounted ConfigMap or
+// Secret.
+//
+// Every file ending in .yaml, .yml or .json holds one CreateWebhookRequest or
+// a list of them. Hidden files are skipped, which also skips the ..data
+// directories Kubernetes uses to swap mounted files atomically.
+type Reconciler struct {
+	dir      string
+	interval time.Duration
+	removed  func(wh *webhook.Webhook)
+}
+
+func New(dir string, interval time.Duration) *Reconciler {
+	return &Reconciler{dir: dir, interval: interval}
+}
+
+// OnRemove sets a function called with every file managed webhook removed,
+// to drop what else is kept about it.
+func (r *Reconciler) OnRemove(removed func(wh *webhook.Webhook)) {
+	r.removed = removed
+}
+
+// Run reconciles immediately and then on every interval until stop is closed.
+// The directory is polled rather than watched, since mounted ConfigMaps are
+// updated by swapping symlinks.
+func (r *Reconciler) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Reconcile(); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to reconcile webhooks from %v: %v\n", r.dir, err)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Reconcile adds, updates and removes file managed webhooks to match the
+// directory. Webhooks created through the API are never touched, also when
+// they are created while reconciling. Nothing is
+// changed if any file fails to load, so a broken file does not remove the
+// webhooks it defines.
+func (r *Reconciler) Reconcile() error {
+	desired, err := r.load()
+	if err != nil {
+		return err
+	}
+
+	existing, err := webhook.List()
+	if err != nil {
+		return err
+	}
+
+	current := map[string]*webhook.Webhook{}
+	for _, wh := range existing {
+		current[wh.Id] = wh
+
+		if _, ok := desired[wh.Id]; !ok && wh.IsFileManaged() {
+			fmt.Printf("Removing file managed webhook %v/%v\n", wh.Team, wh.Name)
+			if err := webhook.Delete(wh.Id); err != nil {
+				return err
+			}
+			if r.removed != nil {
+				r.removed(wh)
+			}
+		}
+	}
+
+	for id, wh := range desired {
+		cur, ok := current[id]
+		if ok && !cur.IsFileManaged() {
+			fmt.Fprintf(os.Stderr, "webhook %v/%v is already registered through the API, skipping file definition\n", wh.Team, wh.Name)
+			continue
+		}
+
+		if !ok {
+			// created rather than saved, as the webhook may have been
+			// registered through the API since the webhooks were listed
+			_, err := webhook.Create(wh)
+			if err == webhook.ErrExists {
+				fmt.Fprintf(os.Stderr, "webhook %v/%v is already registered through the API, skipping file definition\n", wh.Team, wh.Name)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Added file managed webhook %v/%v\n", wh.Team, wh.Name)
+			continue
+		}
+
+		wh.CreatedAt = cur.CreatedAt
+		unchanged := *cur
+		unchanged.ProxyUrl = ""
+		if reflect.DeepEqual(&unchanged, wh) {
+			continue
+		}
+		fmt.Printf("Updating file managed webhook %v/%v\n", wh.Team, wh.Name)
+		if _, err := webhook.Save(wh); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// load returns the webhooks defined in the directory by id.
+func (r *Reconciler) load() (map[string]*webhook.Webhook, error) {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		name := f.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		switch filepath.Ext(name) {
+		case ".yaml", ".yml", ".json":
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	webhooks := map[string]*webhook.Webhook{}
+	for _, name := range names {
+		requests, err := readFile(filepath.Join(r.dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+
+		for _, request := range requests {
+			wh, err := webhook.FromRequest(request, webhook.SourceFile)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %v/%v: %v", name, request.Team, request.Name, err)
+			}
+
+			if _, ok := webhooks[wh.Id]; ok {
+				return nil, fmt.Errorf("%v: %v/%v is defined more than once", name, request.Team, request.Name)
+			}
+			webhooks[wh.Id] = wh
+		}
+	}
+
+	return webhooks, nil
+}
+
+func readFile(path string) ([]webhook.CreateWebhookRequest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	j, err := yaml.YAMLToJSON(b)
+	if err != nil {
+		return nil, err
+	}
+
+	j = bytes.TrimSpace(j)
+	if bytes.Equal(j, []byte("null")) {
+		return nil, nil
+	}
+
+	if bytes.HasPrefix(j, []byte("[")) {
+		var requests []webhook.CreateWebhookRequest
+		if err := json.Unmarshal(j, &requests); err != nil {
+			return nil, err
+		}
+		return requests, nil
+	}
+
+	var request webhook.CreateWebhookRequest
+	if err := json.Unmarshal(j, &request); err != nil {
+		return nil, err
+	}
+	return []webhook.CreateWebhookRequest{request}, nil
+}
@@ -0,0 +1,220 @@
+package reconciler
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/navikt/webhookproxy/webhook"
+)
+
+func clearWebhooks() {
+	webhooks, _ := webhook.List()
+	for _, w := range webhooks {
+		webhook.Delete(w.Id)
+	}
+}
+
+// unlistedStore leaves a webhook out of List, as if it was created right
+// after the webhooks were listed.
+type unlistedStore struct {
+	webhook.Store
+	id string
+}
+
+func (s *unlistedStore) List() ([]*webhook.Webhook, error) {
+	webhooks, err := s.Store.List()
+	listed := webhooks[:0]
+	for _, wh := range webhooks {
+		if wh.Id != s.id {
+			listed = append(listed, wh)
+		}
+	}
+	return listed, err
+}
+
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "webhookproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, dir string, name string, contents string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+const teamAHooks = `
+- name: build-hook
+  team: team-a
+  url: http://ci.team-a.svc/hook
+  secret: Zm9vYmFy
+- name: deploy-hook
+  team: team-a
+  url: http://deploy.team-a.svc/hook
+  secret: Zm9vYmFy
+`
+
+func TestReconciler_Reconcile(t *testing.T) {
+	t.Run("Webhooks in files should be added", func(t *testing.T) {
+		dir := newTestDir(t)
+		defer os.RemoveAll(dir)
+		defer clearWebhooks()
+
+		writeFile(t, dir, "team-a.yaml", teamAHooks)
+		writeFile(t, dir, "team-b.json", `{"name": "hook", "team": "team-b", "url": "http://team-b.svc/hook", "secret": "Zm9vYmFy"}`)
+		writeFile(t, dir, "README.md", "not a webhook")
+
+		if err := New(dir, time.Minute).Reconcile(); err != nil {
+			t.Errorf("Reconcile() error = %v", err)
+			return
+		}
+
+		webhooks, _ := webhook.List()
+		if len(webhooks) != 3 {
+			t.Errorf("List() returned %d webhooks, want 3", len(webhooks))
+		}
+
+		wh, _ := webhook.Lookup("team-b", "hook")
+		if wh == nil {
+			t.Errorf("Lookup() = nil, want webhook from team-b.json")
+			return
+		}
+		if wh.Source != webhook.SourceFile || string(wh.Secret) != "foobar" {
+			t.Errorf("Lookup() = %+v, want file managed webhook with secret foobar", wh)
+		}
+	})
+
+	t.Run("Changed and removed definitions should be reconciled", func(t *testing.T) {
+		dir := newTestDir(t)
+		defer os.RemoveAll(dir)
+		defer clearWebhooks()
+
+		r := New(dir, time.Minute)
+		writeFile(t, dir, "team-a.yaml", teamAHooks)
+		r.Reconcile()
+		before, _ := webhook.Lookup("team-a", "build-hook")
+
+		writeFile(t, dir, "team-a.yaml", `
+name: build-hook
+team: team-a
+url: http://new-ci.team-a.svc/hook
+secret: Zm9vYmFy
+`)
+		if err := r.Reconcile(); err != nil {
+			t.Errorf("Reconcile() error = %v", err)
+			return
+		}
+
+		wh, _ := webhook.Lookup("team-a", "build-hook")
+		if wh == nil || wh.Url != "http://new-ci.team-a.svc/hook" {
+			t.Errorf("Lookup() = %+v, want updated url", wh)
+			return
+		}
+		if !wh.CreatedAt.Equal(before.CreatedAt) {
+			t.Errorf("CreatedAt = %v, want it kept as %v", wh.CreatedAt, before.CreatedAt)
+		}
+
+		if wh, _ := webhook.Lookup("team-a", "deploy-hook"); wh != nil {
+			t.Errorf("Lookup() = %+v, want removed webhook", wh)
+		}
+	})
+
+	t.Run("Webhooks created through the API should not be touched", func(t *testing.T) {
+		dir := newTestDir(t)
+		defer os.RemoveAll(dir)
+		defer clearWebhooks()
+
+		apiHook, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name:   "build-hook",
+			Team:   "team-a",
+			Url:    "http://api.team-a.svc/hook",
+			Secret: []byte("foobar"),
+		})
+
+		writeFile(t, dir, "team-a.yaml", teamAHooks)
+		New(dir, time.Minute).Reconcile()
+
+		os.Remove(filepath.Join(dir, "team-a.yaml"))
+		New(dir, time.Minute).Reconcile()
+
+		wh, _ := webhook.Get(apiHook.Id)
+		if wh == nil || wh.Url != apiHook.Url || wh.Source != webhook.SourceAPI {
+			t.Errorf("Get() = %+v, want untouched %+v", wh, apiHook)
+		}
+	})
+
+	t.Run("Webhooks created through the API while reconciling should not be overwritten", func(t *testing.T) {
+		dir := newTestDir(t)
+		defer os.RemoveAll(dir)
+		defer clearWebhooks()
+
+		store := webhook.NewMemoryStore()
+		webhook.UseStore(store)
+		defer webhook.UseStore(webhook.NewMemoryStore())
+		apiHook, _ := webhook.New(webhook.CreateWebhookRequest{
+			Name:   "build-hook",
+			Team:   "team-a",
+			Url:    "http://api.team-a.svc/hook",
+			Secret: []byte("foobar"),
+		})
+		webhook.UseStore(&unlistedStore{store, apiHook.Id})
+
+		writeFile(t, dir, "team-a.yaml", teamAHooks)
+		if err := New(dir, time.Minute).Reconcile(); err != nil {
+			t.Errorf("Reconcile() error = %v", err)
+		}
+
+		wh, _ := webhook.Get(apiHook.Id)
+		if wh == nil || wh.Url != apiHook.Url || wh.Source != webhook.SourceAPI {
+			t.Errorf("Get() = %+v, want untouched %+v", wh, apiHook)
+		}
+	})
+
+	t.Run("Removed webhooks should be passed on", func(t *testing.T) {
+		dir := newTestDir(t)
+		defer os.RemoveAll(dir)
+		defer clearWebhooks()
+
+		var removed []string
+		r := New(dir, time.Minute)
+		r.OnRemove(func(wh *webhook.Webhook) { removed = append(removed, wh.Name) })
+
+		writeFile(t, dir, "team-a.yaml", teamAHooks)
+		r.Reconcile()
+		writeFile(t, dir, "team-a.yaml", "")
+		r.Reconcile()
+
+		sort.Strings(removed)
+		if !reflect.DeepEqual(removed, []string{"build-hook", "deploy-hook"}) {
+			t.Errorf("OnRemove() got %v, want both removed webhooks", removed)
+		}
+	})
+
+	t.Run("Invalid file should not remove any webhooks", func(t *testing.T) {
+		dir := newTestDir(t)
+		defer os.RemoveAll(dir)
+		defer clearWebhooks()
+
+		r := New(dir, time.Minute)
+		writeFile(t, dir, "team-a.yaml", teamAHooks)
+		r.Reconcile()
+
+		writeFile(t, dir, "team-a.yaml", "- name: [broken")
+		if err := r.Reconcile(); err == nil {
+			t.Errorf("Reconcile() should fail on invalid file")
+		}
+
+		webhooks, _ := webhook.List()
+		if len(webhooks) != 2 {
+			t.Errorf("List() returned %d webhooks, want 2", len(webhooks))
+		}
+	})
+}
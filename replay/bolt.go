@@ -0,0 +1,98 @@
+package replay
+
+import (
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var replaysBucket = []byte("replays")
+
+// boltCache keeps keys in an embedded bbolt database, with the expiry in
+// the binary encoding of time.Time as value.
+type boltCache struct {
+	db *bolt.DB
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+func NewBoltCache(db *bolt.DB) (*boltCache, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(replaysBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltCache{db: db}, nil
+}
+
+func (c *boltCache) Add(key string, now time.Time, expires time.Time) (bool, error) {
+	added := false
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(replaysBucket)
+		if c.shouldPrune(now) {
+			if err := prune(b, now); err != nil {
+				return err
+			}
+		}
+
+		if v := b.Get([]byte(key)); v != nil && decodeTime(v).After(now) {
+			return nil
+		}
+		added = true
+		return b.Put([]byte(key), encodeTime(expires))
+	})
+	return added, err
+}
+
+func (c *boltCache) Remove(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(replaysBucket).Delete([]byte(key))
+	})
+}
+
+func (c *boltCache) shouldPrune(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPruned) <= pruneInterval {
+		return false
+	}
+	c.lastPruned = now
+	return true
+}
+
+func prune(b *bolt.Bucket, now time.Time) error {
+	var expired [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if !decodeTime(v).After(now) {
+			expired = append(expired, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, k := range expired {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeTime(t time.Time) []byte {
+	b, _ := t.MarshalBinary()
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	var t time.Time
+	t.UnmarshalBinary(b)
+	return t
+}
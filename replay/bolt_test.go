@@ -0,0 +1,32 @@
+package replay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhookproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := bolt.Open(filepath.Join(dir, "webhooks.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c, err := NewBoltCache(db)
+	if err != nil {
+		t.Fatalf("NewBoltCache() error = %v", err)
+	}
+
+	testCache(t, c)
+}
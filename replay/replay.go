@@ -0,0 +1,67 @@
+package replay
+
+import (
+	"sync"
+	"time"
+)
+
+// Cache remembers the deliveries a webhook received for a while, so a
+// captured delivery cannot be replayed. Keys are the webhook id and the
+// sender's id of the delivery. Caches must be safe for concurrent use, and
+// Add must be atomic so only one of several replicas receiving the same
+// delivery accepts it.
+type Cache interface {
+	// Add records key until expires. It reports false if key is already
+	// recorded and has not expired.
+	Add(key string, now time.Time, expires time.Time) (bool, error)
+	// Remove forgets key, so the delivery is accepted again.
+	Remove(key string) error
+}
+
+// Key returns the key of a delivery to a webhook.
+func Key(hookId string, guid string) string {
+	return hookId + "/" + guid
+}
+
+// pruneInterval is how often expired keys are removed.
+const pruneInterval = time.Minute
+
+type memoryCache struct {
+	mu         sync.Mutex
+	expires    map[string]time.Time
+	lastPruned time.Time
+}
+
+// NewMemoryCache creates a cache in process memory, which only protects a
+// single replica and is lost on restart.
+func NewMemoryCache() *memoryCache {
+	return &memoryCache{expires: map[string]time.Time{}}
+}
+
+func (c *memoryCache) Add(key string, now time.Time, expires time.Time) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPruned) > pruneInterval {
+		for k, e := range c.expires {
+			if !e.After(now) {
+				delete(c.expires, k)
+			}
+		}
+		c.lastPruned = now
+	}
+
+	if e, ok := c.expires[key]; ok && e.After(now) {
+		return false, nil
+	}
+	c.expires[key] = expires
+	return true, nil
+}
+
+func (c *memoryCache) Remove(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.expires, key)
+	return nil
+}
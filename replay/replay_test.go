@@ -0,0 +1,78 @@
+package replay
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func testCache(t *testing.T, c Cache) {
+	now := time.Now()
+
+	t.Run("New key should be added", func(t *testing.T) {
+		added, err := c.Add(Key("my-hook", "72d3162e"), now, now.Add(time.Hour))
+		if err != nil || !added {
+			t.Errorf("Add() = %v, %v, want true", added, err)
+		}
+	})
+
+	t.Run("Recorded key should not be added again", func(t *testing.T) {
+		added, err := c.Add(Key("my-hook", "72d3162e"), now.Add(time.Minute), now.Add(time.Hour))
+		if err != nil || added {
+			t.Errorf("Add() = %v, %v, want false", added, err)
+		}
+	})
+
+	t.Run("Key of another webhook should be added", func(t *testing.T) {
+		added, err := c.Add(Key("my-other-hook", "72d3162e"), now, now.Add(time.Hour))
+		if err != nil || !added {
+			t.Errorf("Add() = %v, %v, want true", added, err)
+		}
+	})
+
+	t.Run("Expired key should be added again", func(t *testing.T) {
+		later := now.Add(2 * time.Hour)
+		added, err := c.Add(Key("my-hook", "72d3162e"), later, later.Add(time.Hour))
+		if err != nil || !added {
+			t.Errorf("Add() = %v, %v, want true", added, err)
+		}
+	})
+
+	t.Run("Removed key should be added again", func(t *testing.T) {
+		c.Add(Key("my-hook", "a1b2c3d4"), now, now.Add(time.Hour))
+		if err := c.Remove(Key("my-hook", "a1b2c3d4")); err != nil {
+			t.Errorf("Remove() error = %v", err)
+		}
+
+		added, err := c.Add(Key("my-hook", "a1b2c3d4"), now, now.Add(time.Hour))
+		if err != nil || !added {
+			t.Errorf("Add() = %v, %v, want true", added, err)
+		}
+	})
+
+	t.Run("Concurrent adds should add a key once", func(t *testing.T) {
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		added := 0
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if ok, _ := c.Add(Key("my-hook", "e5f6a7b8"), now, now.Add(time.Hour)); ok {
+					mu.Lock()
+					added++
+					mu.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		if added != 1 {
+			t.Errorf("Add() added the key %d times, want once", added)
+		}
+	})
+}
+
+func TestMemoryCache(t *testing.T) {
+	testCache(t, NewMemoryCache())
+}
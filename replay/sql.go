@@ -0,0 +1,73 @@
+package replay
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/navikt/webhookproxy/migrate"
+)
+
+// migrations for the replays table. The expiry is kept in unix nanoseconds.
+var migrations = []string{
+	`CREATE TABLE replays (
+		id VARCHAR(255) PRIMARY KEY,
+		expires_at BIGINT NOT NULL
+	)`,
+	`CREATE INDEX replays_expires_at ON replays (expires_at)`,
+}
+
+// sqlCache keeps keys in a SQL database shared by all replicas. The primary
+// key makes sure only one replica adds a key.
+type sqlCache struct {
+	db *sql.DB
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+// NewSQLCache creates a cache on db, migrating the schema if needed.
+func NewSQLCache(db *sql.DB) (*sqlCache, error) {
+	if err := migrate.Run(db, "replays", migrations); err != nil {
+		return nil, err
+	}
+
+	return &sqlCache{db: db}, nil
+}
+
+func (c *sqlCache) Add(key string, now time.Time, expires time.Time) (bool, error) {
+	if c.shouldPrune(now) {
+		if _, err := c.db.Exec(`DELETE FROM replays WHERE expires_at <= $1`, now.UnixNano()); err != nil {
+			return false, err
+		}
+	}
+
+	if _, err := c.db.Exec(`DELETE FROM replays WHERE id = $1 AND expires_at <= $2`, key, now.UnixNano()); err != nil {
+		return false, err
+	}
+
+	res, err := c.db.Exec(`INSERT INTO replays (id, expires_at) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		key, expires.UnixNano())
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (c *sqlCache) Remove(key string) error {
+	_, err := c.db.Exec(`DELETE FROM replays WHERE id = $1`, key)
+	return err
+}
+
+func (c *sqlCache) shouldPrune(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.lastPruned) <= pruneInterval {
+		return false
+	}
+	c.lastPruned = now
+	return true
+}
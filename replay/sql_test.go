@@ -0,0 +1,38 @@
+package replay
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLCache(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	c, err := NewSQLCache(db)
+	if err != nil {
+		t.Fatalf("NewSQLCache() error = %v", err)
+	}
+
+	testCache(t, c)
+
+	t.Run("Second replica should not add a key added by the first", func(t *testing.T) {
+		replica, err := NewSQLCache(db)
+		if err != nil {
+			t.Fatalf("NewSQLCache() error = %v", err)
+		}
+
+		now := time.Now()
+		c.Add(Key("my-hook", "c9d0e1f2"), now, now.Add(time.Hour))
+		if added, err := replica.Add(Key("my-hook", "c9d0e1f2"), now, now.Add(time.Hour)); err != nil || added {
+			t.Errorf("Add() = %v, %v, want false", added, err)
+		}
+	})
+}
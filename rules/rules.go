@@ -0,0 +1,243 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/navikt/webhookproxy/lru"
+)
+
+// Rule routes deliveries whose payload meets all conditions in When to the
+// named targets, or drops them. A rule without conditions matches every
+// delivery.
+type Rule struct {
+	When    []Condition `json:"when,omitempty"`
+	Targets []string    `json:"targets,omitempty"`
+	Drop    bool        `json:"drop,omitempty"`
+}
+
+// Condition compares the value at Path in the payload with Value. Path is a
+// dot separated list of object keys and array indexes, like
+// pull_request.base.ref or commits.0.id.
+type Condition struct {
+	Path  string      `json:"path"`
+	Op    string      `json:"op"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Operators conditions can use.
+const (
+	// OpEq holds if the value equals Value.
+	OpEq = "eq"
+	// OpNe holds if the value is missing or does not equal Value.
+	OpNe = "ne"
+	// OpIn holds if the value equals one of the values in the list Value.
+	OpIn = "in"
+	// OpPrefix and OpSuffix hold if the value is a string starting or
+	// ending with Value.
+	OpPrefix = "prefix"
+	OpSuffix = "suffix"
+	// OpGlob holds if the value is a string matching the path.Match pattern
+	// Value.
+	OpGlob = "glob"
+	// OpRegex holds if the value is a string matching the regular
+	// expression Value.
+	OpRegex = "regex"
+	// OpExists holds if the value is present, or missing if Value is false.
+	OpExists = "exists"
+)
+
+// Validate checks that rules are well formed, returning an error telling
+// which rule and condition is wrong.
+func Validate(rules []Rule) error {
+	for i, rule := range rules {
+		if rule.Drop == (len(rule.Targets) > 0) {
+			return fmt.Errorf("rule %d: either targets or drop must be given", i+1)
+		}
+
+		for j, condition := range rule.When {
+			if err := condition.validate(); err != nil {
+				return fmt.Errorf("rule %d: condition %d: %v", i+1, j+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c Condition) validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("path is required")
+	}
+	for _, key := range strings.Split(c.Path, ".") {
+		if key == "" {
+			return fmt.Errorf("invalid path: %v", c.Path)
+		}
+	}
+
+	switch c.Op {
+	case OpEq, OpNe:
+		if c.Value == nil {
+			return fmt.Errorf("%v needs a value", c.Op)
+		}
+	case OpIn:
+		if _, ok := c.Value.([]interface{}); !ok {
+			return fmt.Errorf("%v needs a list of values", c.Op)
+		}
+	case OpPrefix, OpSuffix:
+		if _, ok := c.Value.(string); !ok {
+			return fmt.Errorf("%v needs a string value", c.Op)
+		}
+	case OpGlob:
+		pattern, ok := c.Value.(string)
+		if !ok {
+			return fmt.Errorf("%v needs a string value", c.Op)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob pattern: %v", pattern)
+		}
+	case OpRegex:
+		pattern, ok := c.Value.(string)
+		if !ok {
+			return fmt.Errorf("%v needs a string value", c.Op)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("invalid regular expression: %v", err)
+		}
+	case OpExists:
+		if _, ok := c.Value.(bool); !ok && c.Value != nil {
+			return fmt.Errorf("%v needs a boolean value", c.Op)
+		}
+	default:
+		return fmt.Errorf("unknown op: %v", c.Op)
+	}
+	return nil
+}
+
+// Match returns the index of the first rule the payload meets, or -1 if it
+// meets none or is not JSON.
+func Match(rules []Rule, payload []byte) int {
+	if len(rules) == 0 {
+		return -1
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(payload, &document); err != nil {
+		return -1
+	}
+
+	for i, rule := range rules {
+		if rule.matches(document) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r Rule) matches(document interface{}) bool {
+	for _, condition := range r.When {
+		if !condition.holds(document) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Condition) holds(document interface{}) bool {
+	value, found := lookup(document, c.Path)
+
+	switch c.Op {
+	case OpEq:
+		return found && equal(value, c.Value)
+	case OpNe:
+		return !found || !equal(value, c.Value)
+	case OpIn:
+		values, _ := c.Value.([]interface{})
+		for _, v := range values {
+			if found && equal(value, v) {
+				return true
+			}
+		}
+		return false
+	case OpExists:
+		want, ok := c.Value.(bool)
+		return found == (want || !ok)
+	}
+
+	s, isString := value.(string)
+	pattern, _ := c.Value.(string)
+	if !found || !isString {
+		return false
+	}
+
+	switch c.Op {
+	case OpPrefix:
+		return strings.HasPrefix(s, pattern)
+	case OpSuffix:
+		return strings.HasSuffix(s, pattern)
+	case OpGlob:
+		ok, _ := path.Match(pattern, s)
+		return ok
+	case OpRegex:
+		re, err := compile(pattern)
+		return err == nil && re.MatchString(s)
+	}
+	return false
+}
+
+// lookup returns the value at path in document.
+func lookup(document interface{}, path string) (interface{}, bool) {
+	value := document
+	for _, key := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if value, ok = v[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(v) {
+				return nil, false
+			}
+			value = v[i]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// equal compares JSON values. Numbers given in rules may be ints while
+// payload numbers are always float64.
+func equal(a, b interface{}) bool {
+	if n, ok := b.(int); ok {
+		b = float64(n)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// maxCachedExpressions is how many compiled expressions are kept, shared by
+// the rules of all webhooks.
+const maxCachedExpressions = 1000
+
+var expressions = lru.New(maxCachedExpressions)
+
+// compile compiles a regular expression once and caches it, as the same
+// expressions are matched on every delivery.
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := expressions.Get(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	expressions.Add(pattern, re)
+	return re, nil
+}
@@ -0,0 +1,113 @@
+package rules
+
+import (
+	"testing"
+)
+
+const payload = `{
+	"ref": "refs/heads/main",
+	"repository": {"full_name": "navikt/webhookproxy", "private": false, "size": 42},
+	"commits": [{"id": "a1b2c3", "message": "Fix typo"}]
+}`
+
+func TestCondition_holds(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition Condition
+		want      bool
+	}{
+		{"eq string", Condition{Path: "ref", Op: OpEq, Value: "refs/heads/main"}, true},
+		{"eq other string", Condition{Path: "ref", Op: OpEq, Value: "refs/heads/dev"}, false},
+		{"eq nested bool", Condition{Path: "repository.private", Op: OpEq, Value: false}, true},
+		{"eq number", Condition{Path: "repository.size", Op: OpEq, Value: 42}, true},
+		{"eq missing", Condition{Path: "repository.owner", Op: OpEq, Value: "navikt"}, false},
+		{"ne string", Condition{Path: "ref", Op: OpNe, Value: "refs/heads/dev"}, true},
+		{"ne missing", Condition{Path: "pull_request.base.ref", Op: OpNe, Value: "main"}, true},
+		{"in", Condition{Path: "repository.full_name", Op: OpIn, Value: []interface{}{"navikt/a", "navikt/webhookproxy"}}, true},
+		{"not in", Condition{Path: "repository.full_name", Op: OpIn, Value: []interface{}{"navikt/a"}}, false},
+		{"prefix", Condition{Path: "ref", Op: OpPrefix, Value: "refs/heads/"}, true},
+		{"suffix", Condition{Path: "ref", Op: OpSuffix, Value: "/dev"}, false},
+		{"glob", Condition{Path: "repository.full_name", Op: OpGlob, Value: "navikt/*"}, true},
+		{"regex", Condition{Path: "commits.0.message", Op: OpRegex, Value: "^(Fix|Add) "}, true},
+		{"regex on number", Condition{Path: "repository.size", Op: OpRegex, Value: "42"}, false},
+		{"array index out of range", Condition{Path: "commits.1.id", Op: OpExists}, false},
+		{"exists", Condition{Path: "commits.0.id", Op: OpExists}, true},
+		{"not exists", Condition{Path: "pull_request", Op: OpExists, Value: false}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Match([]Rule{{When: []Condition{tt.condition}, Drop: true}}, []byte(payload)) == 0
+			if got != tt.want {
+				t.Errorf("holds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{
+		{When: []Condition{{Path: "ref", Op: OpEq, Value: "refs/heads/dev"}}, Targets: []string{"staging"}},
+		{When: []Condition{{Path: "ref", Op: OpEq, Value: "refs/heads/main"}, {Path: "repository.private", Op: OpEq, Value: true}}, Drop: true},
+		{When: []Condition{{Path: "ref", Op: OpEq, Value: "refs/heads/main"}}, Targets: []string{"production"}},
+		{Drop: true},
+	}
+
+	t.Run("first matching rule should win", func(t *testing.T) {
+		if got := Match(rules, []byte(payload)); got != 2 {
+			t.Errorf("Match() = %v, want 2", got)
+		}
+	})
+
+	t.Run("rule without conditions should match anything", func(t *testing.T) {
+		if got := Match(rules, []byte(`{"ref": "refs/tags/v1"}`)); got != 3 {
+			t.Errorf("Match() = %v, want 3", got)
+		}
+	})
+
+	t.Run("payload that is not JSON should match no rule", func(t *testing.T) {
+		if got := Match(rules, []byte("payload=%7B%7D")); got != -1 {
+			t.Errorf("Match() = %v, want -1", got)
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []Rule
+		want  string
+	}{
+		{"valid", []Rule{{When: []Condition{{Path: "ref", Op: OpEq, Value: "main"}}, Targets: []string{"a"}}, {Drop: true}}, ""},
+		{"neither targets nor drop", []Rule{{When: []Condition{{Path: "ref", Op: OpEq, Value: "main"}}}}, "rule 1: either targets or drop must be given"},
+		{"both targets and drop", []Rule{{Targets: []string{"a"}, Drop: true}}, "rule 1: either targets or drop must be given"},
+		{"empty path", []Rule{{Drop: true}, {When: []Condition{{Op: OpExists}}, Drop: true}}, "rule 2: condition 1: path is required"},
+		{"invalid path", []Rule{{When: []Condition{{Path: "repository..name", Op: OpExists}}, Drop: true}}, "rule 1: condition 1: invalid path: repository..name"},
+		{"unknown op", []Rule{{When: []Condition{{Path: "ref", Op: "equals", Value: "main"}}, Drop: true}}, "rule 1: condition 1: unknown op: equals"},
+		{"eq without value", []Rule{{When: []Condition{{Path: "ref", Op: OpEq}}, Drop: true}}, "rule 1: condition 1: eq needs a value"},
+		{"in without list", []Rule{{When: []Condition{{Path: "ref", Op: OpIn, Value: "main"}}, Drop: true}}, "rule 1: condition 1: in needs a list of values"},
+		{"invalid glob", []Rule{{When: []Condition{{Path: "ref", Op: OpGlob, Value: "refs/[heads"}}, Drop: true}}, "rule 1: condition 1: invalid glob pattern: refs/[heads"},
+		{"invalid regex", []Rule{{When: []Condition{{Path: "ref", Op: OpRegex, Value: "refs/(heads"}}, Drop: true}}, "rule 1: condition 1: invalid regular expression: error parsing regexp: missing closing ): `refs/(heads`"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.rules)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("Validate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate_doesNotCache(t *testing.T) {
+	before := expressions.Len()
+	if err := Validate([]Rule{{When: []Condition{{Path: "ref", Op: OpRegex, Value: "^refs/tags/validated-"}}, Drop: true}}); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	if expressions.Len() != before {
+		t.Errorf("Validate() should not cache expressions")
+	}
+}
@@ -0,0 +1,112 @@
+// Package signature signs the payloads webhookproxy forwards, and verifies
+// them in the services receiving them.
+//
+// The signature is sent in the X-Webhookproxy-Signature header as
+//
+//	t=<unix timestamp>,v1=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// keyed with the signing secret of the target. The timestamp lets receivers
+// refuse old deliveries that are replayed. A header may hold several v1
+// signatures while secrets are rotated; one of them has to match.
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is the request header holding the signature.
+const Header = "X-Webhookproxy-Signature"
+
+// DefaultTolerance is how old a signature VerifyRequest accepts.
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	ErrMissing   = errors.New("missing signature")
+	ErrMalformed = errors.New("malformed signature")
+	ErrExpired   = errors.New("signature timestamp is outside the tolerance")
+	ErrMismatch  = errors.New("signature does not match")
+)
+
+// Sign returns the signature header value for body signed with secret at t.
+func Sign(secret []byte, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac(secret, timestamp, body))
+}
+
+// Verify checks that header is a signature of body made with secret no more
+// than tolerance from now.
+func Verify(secret []byte, header string, body []byte, tolerance time.Duration) error {
+	if header == "" {
+		return ErrMissing
+	}
+
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrMalformed
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signature, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return ErrMalformed
+			}
+			signatures = append(signatures, signature)
+		}
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrMalformed
+	}
+
+	age := time.Since(time.Unix(seconds, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+
+	expected := mac(secret, timestamp, body)
+	for _, signature := range signatures {
+		if hmac.Equal(signature, expected) {
+			return nil
+		}
+	}
+	return ErrMismatch
+}
+
+// VerifyRequest reads the body of r and verifies its signature with
+// DefaultTolerance. The body is returned, and r.Body is replaced so it can
+// be read again.
+func VerifyRequest(secret []byte, r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := Verify(secret, r.Header.Get(Header), body, DefaultTolerance); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func mac(secret []byte, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return h.Sum(nil)
+}
@@ -0,0 +1,65 @@
+package signature
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+var secret = []byte("target-secret")
+
+func TestSign(t *testing.T) {
+	got := Sign(secret, time.Unix(1492774577, 0), []byte(`{"ref": "refs/heads/main"}`))
+	if want := "t=1492774577,v1=856a13f5edf6df48af967441a0d8569a07a15781cad31e630e55b996a5f4ef14"; got != want {
+		t.Errorf("Sign() = %v, want %v", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/main"}`)
+	now := time.Now()
+	valid := Sign(secret, now, body)
+
+	tests := []struct {
+		name   string
+		header string
+		body   []byte
+		want   error
+	}{
+		{"valid", valid, body, nil},
+		{"rotated secret", valid + ",v1=" + strings.Repeat("0", 64), body, nil},
+		{"missing", "", body, ErrMissing},
+		{"without timestamp", "v1=" + strings.Repeat("0", 64), body, ErrMalformed},
+		{"not hex", "t=1492774577,v1=zz", body, ErrMalformed},
+		{"old", Sign(secret, now.Add(-time.Hour), body), body, ErrExpired},
+		{"other body", valid, []byte(`{"ref": "refs/heads/dev"}`), ErrMismatch},
+		{"other secret", Sign([]byte("other-secret"), now, body), body, ErrMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Verify(secret, tt.header, tt.body, DefaultTolerance); err != tt.want {
+				t.Errorf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	body := `{"ref": "refs/heads/main"}`
+	r, _ := http.NewRequest("POST", "http://internal-server.tld/hook", strings.NewReader(body))
+	r.Header.Set(Header, Sign(secret, time.Now(), []byte(body)))
+
+	got, err := VerifyRequest(secret, r)
+	if err != nil {
+		t.Fatalf("VerifyRequest() error = %v", err)
+	}
+	if string(got) != body {
+		t.Errorf("VerifyRequest() = %s, want %s", got, body)
+	}
+
+	if again, err := ioutil.ReadAll(r.Body); err != nil || string(again) != body {
+		t.Errorf("request body = %s, want it readable again", again)
+	}
+}
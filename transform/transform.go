@@ -0,0 +1,258 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/navikt/webhookproxy/lru"
+)
+
+// Transform rewrites payloads before they are forwarded, for consumers that
+// do not understand the sender's JSON. Template is a text/template rendered
+// into the forwarded body. ContentType replaces application/json, and
+// Headers are added to the forwarded request, their values being templates
+// too.
+type Transform struct {
+	Template    string            `json:"template"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+// Data is what templates are rendered with. Payload is the decoded JSON
+// payload, nil if the payload is not JSON, and Body the payload as received.
+type Data struct {
+	Event    string
+	Delivery string
+	Payload  interface{}
+	Body     string
+}
+
+// Output is a transformed payload and the headers to forward it with.
+type Output struct {
+	Body   []byte
+	Header http.Header
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": func(sep string, values []interface{}) string {
+		s := make([]string, len(values))
+		for i, v := range values {
+			s[i] = fmt.Sprint(v)
+		}
+		return strings.Join(s, sep)
+	},
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+}
+
+// Validate checks that the templates of t parse and its headers are valid.
+func Validate(t *Transform) error {
+	if t == nil {
+		return nil
+	}
+	if t.Template == "" {
+		return fmt.Errorf("transform template is required")
+	}
+	if _, err := compile(t.Template); err != nil {
+		return fmt.Errorf("invalid transform template: %v", err)
+	}
+
+	for name, value := range t.Headers {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("invalid transform header name: %q", name)
+		}
+		if _, err := compile(value); err != nil {
+			return fmt.Errorf("invalid template for header %v: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// Apply renders the payload body through t. A nil transform forwards the
+// body as it is. The parsed templates are cached, as the same templates are
+// rendered for every delivery.
+func Apply(t *Transform, data Data) (*Output, error) {
+	return apply(t, data, cached)
+}
+
+// Preview is Apply for transforms that are not stored, like the ones tried
+// out before creating a webhook. Their templates are not cached.
+func Preview(t *Transform, data Data) (*Output, error) {
+	return apply(t, data, compile)
+}
+
+func apply(t *Transform, data Data, compile func(string) (*template.Template, error)) (*Output, error) {
+	if t == nil {
+		return &Output{Body: []byte(data.Body)}, nil
+	}
+
+	if data.Payload == nil {
+		// Payload stays nil if the body is not JSON
+		json.Unmarshal([]byte(data.Body), &data.Payload)
+	}
+
+	tmpl, err := compile(t.Template)
+	if err != nil {
+		return nil, err
+	}
+	body, err := render(tmpl, data)
+	if err != nil {
+		return nil, err
+	}
+
+	header := http.Header{}
+	if t.ContentType != "" {
+		header.Set("Content-Type", t.ContentType)
+	}
+	for name, value := range t.Headers {
+		tmpl, err := compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("header %v: %v", name, err)
+		}
+		v, err := render(tmpl, data)
+		if err != nil {
+			return nil, fmt.Errorf("header %v: %v", name, err)
+		}
+		header.Set(name, strings.TrimSpace(string(v)))
+	}
+
+	return &Output{Body: body, Header: header}, nil
+}
+
+// ErrOutputTooLarge is returned when a template renders more than the max
+// output size.
+var ErrOutputTooLarge = fmt.Errorf("transform output is too large")
+
+// ErrRenderTooLong is returned when a template loops or calls templates more
+// than maxRenderSteps times, or renders for longer than maxRenderTime.
+var ErrRenderTooLong = fmt.Errorf("transform takes too long to render")
+
+const (
+	maxRenderSteps = 100000
+	maxRenderTime  = time.Second
+)
+
+var maxOutputSize int64 = 5 << 20
+
+// UseMaxOutputSize sets how many bytes a template may render, by default as
+// many as the largest body received. Like the Use functions of the webhook
+// package it should be called once at startup.
+func UseMaxOutputSize(n int64) {
+	maxOutputSize = n
+}
+
+// limitedBuffer fails writes past max bytes, so a template ranging over a
+// large payload stops once its output is too large.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.max {
+		return 0, ErrOutputTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+func render(tmpl *template.Template, data Data) ([]byte, error) {
+	// text/template cannot be cancelled, so compile puts a call to the step
+	// function into every loop and template, counting the steps taken
+	steps := 0
+	deadline := time.Now().Add(maxRenderTime)
+	tmpl, err := tmpl.Clone()
+	if err != nil {
+		return nil, err
+	}
+	tmpl.Funcs(template.FuncMap{stepFunc: func() (string, error) {
+		steps++
+		if steps > maxRenderSteps || time.Now().After(deadline) {
+			return "", ErrRenderTooLong
+		}
+		return "", nil
+	}})
+
+	buf := &limitedBuffer{max: maxOutputSize}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// maxCachedTemplates is how many parsed templates are kept, more than the
+// webhooks of a proxy usually have transforms.
+const maxCachedTemplates = 1000
+
+var templates = lru.New(maxCachedTemplates)
+
+// stepFunc counts the steps of a render. It is called at the start of every
+// loop body and template, and replaced by a counter for every render.
+const stepFunc = "webhookproxyStep"
+
+var stepFuncs = template.FuncMap{stepFunc: func() string { return "" }}
+
+var step = template.Must(template.New("step").Funcs(stepFuncs).Parse("{{" + stepFunc + "}}")).Tree.Root.Nodes[0]
+
+func compile(text string) (*template.Template, error) {
+	tmpl, err := template.New("transform").Funcs(funcs).Funcs(stepFuncs).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			addSteps(t.Tree.Root)
+			t.Tree.Root.Nodes = append([]parse.Node{step}, t.Tree.Root.Nodes...)
+		}
+	}
+	return tmpl, nil
+}
+
+// addSteps puts a step at the start of every loop body under node.
+func addSteps(node parse.Node) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			addSteps(child)
+		}
+	case *parse.RangeNode:
+		addSteps(n.List)
+		addSteps(n.ElseList)
+		n.List.Nodes = append([]parse.Node{step}, n.List.Nodes...)
+	case *parse.IfNode:
+		addSteps(n.List)
+		addSteps(n.ElseList)
+	case *parse.WithNode:
+		addSteps(n.List)
+		addSteps(n.ElseList)
+	}
+}
+
+// cached parses a template once and caches it.
+func cached(text string) (*template.Template, error) {
+	if tmpl, ok := templates.Get(text); ok {
+		return tmpl.(*template.Template), nil
+	}
+
+	tmpl, err := compile(text)
+	if err != nil {
+		return nil, err
+	}
+	templates.Add(text, tmpl)
+	return tmpl, nil
+}
@@ -0,0 +1,132 @@
+package transform
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const payload = `{"ref": "refs/heads/main", "repository": {"full_name": "navikt/webhookproxy"}, "commits": [{"id": "a1b2c3"}, {"id": "d4e5f6"}]}`
+
+func TestApply(t *testing.T) {
+	t.Run("nil transform should forward the body as it is", func(t *testing.T) {
+		got, err := Apply(nil, Data{Event: "push", Body: payload})
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+		if string(got.Body) != payload || got.Header != nil {
+			t.Errorf("Apply() = %s %v, want body unchanged and no header", got.Body, got.Header)
+		}
+	})
+
+	t.Run("template should render payload, event and headers", func(t *testing.T) {
+		transform := &Transform{
+			Template:    `{{.Event}} to {{trimPrefix "refs/heads/" .Payload.ref}} of {{.Payload.repository.full_name}}: {{range $i, $c := .Payload.commits}}{{if $i}},{{end}}{{$c.id}}{{end}}`,
+			ContentType: "text/plain",
+			Headers:     map[string]string{"X-Repository": "{{.Payload.repository.full_name | upper}}"},
+		}
+
+		got, err := Apply(transform, Data{Event: "push", Delivery: "72d3162e", Body: payload})
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+
+		if want := "push to main of navikt/webhookproxy: a1b2c3,d4e5f6"; string(got.Body) != want {
+			t.Errorf("Apply() body = %s, want %s", got.Body, want)
+		}
+		want := http.Header{"Content-Type": {"text/plain"}, "X-Repository": {"NAVIKT/WEBHOOKPROXY"}}
+		if !reflect.DeepEqual(got.Header, want) {
+			t.Errorf("Apply() header = %v, want %v", got.Header, want)
+		}
+	})
+
+	t.Run("json should encode values", func(t *testing.T) {
+		got, err := Apply(&Transform{Template: `{"text": {{printf "%s pushed" .Payload.ref | json}}, "repository": {{json .Payload.repository}}}`}, Data{Body: payload})
+		if err != nil {
+			t.Fatalf("Apply() error = %v", err)
+		}
+		if want := `{"text": "refs/heads/main pushed", "repository": {"full_name":"navikt/webhookproxy"}}`; string(got.Body) != want {
+			t.Errorf("Apply() body = %s, want %s", got.Body, want)
+		}
+	})
+
+	t.Run("failing template should return an error", func(t *testing.T) {
+		if _, err := Apply(&Transform{Template: `{{index .Payload.commits 5}}`}, Data{Body: payload}); err == nil {
+			t.Errorf("Apply() should fail")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		transform *Transform
+		wantErr   bool
+	}{
+		{"nil", nil, false},
+		{"valid", &Transform{Template: "{{.Event}}", Headers: map[string]string{"X-Event": "{{.Event}}"}}, false},
+		{"empty template", &Transform{}, true},
+		{"invalid template", &Transform{Template: "{{.Event"}, true},
+		{"unknown function", &Transform{Template: "{{yaml .Payload}}"}, true},
+		{"invalid header name", &Transform{Template: "{{.Event}}", Headers: map[string]string{"X Event": "push"}}, true},
+		{"invalid header template", &Transform{Template: "{{.Event}}", Headers: map[string]string{"X-Event": "{{end}}"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(tt.transform); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPreview(t *testing.T) {
+	before := templates.Len()
+	tr := &Transform{Template: `{{.Event}} previewed`, Headers: map[string]string{"X-Event": "{{.Event}} previewed"}}
+
+	output, err := Preview(tr, Data{Event: "push"})
+	if err != nil || string(output.Body) != "push previewed" || output.Header.Get("X-Event") != "push previewed" {
+		t.Errorf("Preview() = %v, %v", output, err)
+	}
+	if templates.Len() != before {
+		t.Errorf("Preview() should not cache templates")
+	}
+}
+
+func TestApply_limits(t *testing.T) {
+	commits := `{"commits": [` + strings.Repeat(`{"id": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"},`, 999) + `{"id": "0d1a26e67d8f5eaf1f6ba5c57fc3c7d91ac0fd1c"}]}`
+
+	t.Run("output larger than the max should be refused", func(t *testing.T) {
+		defer UseMaxOutputSize(maxOutputSize)
+		UseMaxOutputSize(10000)
+
+		tr := &Transform{Template: `{{range .Payload.commits}}{{range $.Payload.commits}}{{.id}}{{end}}{{end}}`}
+		if _, err := Apply(tr, Data{Body: commits}); err != ErrOutputTooLarge {
+			t.Errorf("Apply() error = %v, want %v", err, ErrOutputTooLarge)
+		}
+	})
+
+	t.Run("loops taking too many steps should be stopped", func(t *testing.T) {
+		tr := &Transform{Template: `{{range .Payload.commits}}{{range $.Payload.commits}}{{end}}{{end}}`}
+		if _, err := Preview(tr, Data{Body: commits}); err == nil || !strings.Contains(err.Error(), ErrRenderTooLong.Error()) {
+			t.Errorf("Preview() error = %v, want %v", err, ErrRenderTooLong)
+		}
+	})
+
+	t.Run("recursive templates taking too many steps should be stopped", func(t *testing.T) {
+		ten := func(name string) string { return strings.Repeat(`{{template "`+name+`" .}}`, 10) }
+		tr := &Transform{Template: `{{define "a"}}` + ten("b") + `{{end}}{{define "b"}}` + ten("c") + `{{end}}` +
+			`{{define "c"}}{{range .Payload.commits}}{{end}}{{end}}{{template "a" .}}`}
+		if _, err := Preview(tr, Data{Body: commits}); err == nil || !strings.Contains(err.Error(), ErrRenderTooLong.Error()) {
+			t.Errorf("Preview() error = %v, want %v", err, ErrRenderTooLong)
+		}
+	})
+
+	t.Run("templates within the limits should render", func(t *testing.T) {
+		tr := &Transform{Template: `{{range .Payload.commits}}{{.id}}{{end}}`}
+		if output, err := Apply(tr, Data{Body: commits}); err != nil || len(output.Body) != 40000 {
+			t.Errorf("Apply() = %v, %v", output, err)
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+var webhooksBucket = []byte("webhooks")
+
+// boltStore keeps webhooks in an embedded bbolt database, one JSON value per
+// webhook keyed by id. Secrets are encrypted before they are written.
+type boltStore struct {
+	db     *bolt.DB
+	cipher *SecretCipher
+}
+
+func NewBoltStore(db *bolt.DB, cipher *SecretCipher) (*boltStore, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(webhooksBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &boltStore{db, cipher}, nil
+}
+
+func (s *boltStore) List() ([]*Webhook, error) {
+	list := make([]*Webhook, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).ForEach(func(k, v []byte) error {
+			wh, err := decodeWebhook(s.cipher, v)
+			if err != nil {
+				return err
+			}
+			list = append(list, wh)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *boltStore) Get(id string) (*Webhook, error) {
+	var wh *Webhook
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(webhooksBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+
+		var err error
+		wh, err = decodeWebhook(s.cipher, v)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return wh, nil
+}
+
+func (s *boltStore) Create(webhook *Webhook) error {
+	v, err := encodeWebhook(s.cipher, webhook)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(webhooksBucket)
+		if b.Get([]byte(webhook.Id)) != nil {
+			return ErrExists
+		}
+		return b.Put([]byte(webhook.Id), v)
+	})
+}
+
+func (s *boltStore) Save(webhook *Webhook) error {
+	v, err := encodeWebhook(s.cipher, webhook)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).Put([]byte(webhook.Id), v)
+	})
+}
+
+func (s *boltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(webhooksBucket).Delete([]byte(id))
+	})
+}
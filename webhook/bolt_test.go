@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestBoltStore(t *testing.T, path string) (*bolt.DB, *boltStore) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatalf("bolt.Open() error = %v", err)
+	}
+
+	cipher, _ := NewSecretCipher([]byte("0123456789abcdef0123456789abcdef"))
+	s, err := NewBoltStore(db, cipher)
+	if err != nil {
+		t.Fatalf("NewBoltStore() error = %v", err)
+	}
+
+	return db, s
+}
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "webhookproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "webhooks.db")
+
+	db, s := openTestBoltStore(t, path)
+
+	testStore(t, s)
+
+	t.Run("Secret should not be stored in plain text", func(t *testing.T) {
+		wh := newTestWebhook("my-secret-hook")
+		wh.Secret = []byte("very-secret-value")
+		if err := s.Save(wh); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+
+		var record storedWebhook
+		db.View(func(tx *bolt.Tx) error {
+			return json.Unmarshal(tx.Bucket(webhooksBucket).Get([]byte(wh.Id)), &record)
+		})
+		if len(record.Secret) == 0 || bytes.Contains(record.Secret, wh.Secret) {
+			t.Errorf("stored secret = %q, want it encrypted", record.Secret)
+		}
+	})
+
+	t.Run("Webhooks should survive reopening the store", func(t *testing.T) {
+		want := newTestWebhook("my-durable-hook")
+		if err := s.Save(want); err != nil {
+			t.Errorf("Save() error = %v", err)
+			return
+		}
+
+		db.Close()
+		db, reopened := openTestBoltStore(t, path)
+		defer db.Close()
+
+		got, err := reopened.Get(want.Id)
+		if err != nil {
+			t.Errorf("Get() error = %v", err)
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get() = %v, want %v", got, want)
+		}
+	})
+}
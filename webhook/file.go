@@ -0,0 +1,156 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStore keeps all webhooks in a single JSON file, rewritten on every
+// change. Webhooks are copied in and out of the store, and secrets are
+// encrypted with cipher before they are written.
+type fileStore struct {
+	path     string
+	cipher   *SecretCipher
+	mu       sync.Mutex
+	webhooks map[string]*Webhook
+}
+
+func NewFileStore(path string, cipher *SecretCipher) (*fileStore, error) {
+	s := &fileStore{path: path, cipher: cipher, webhooks: map[string]*Webhook{}}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []json.RawMessage
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, err
+	}
+
+	for _, record := range records {
+		wh, err := decodeWebhook(cipher, record)
+		if err != nil {
+			return nil, err
+		}
+		s.webhooks[wh.Id] = wh
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) List() ([]*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*Webhook, 0)
+	for _, v := range s.webhooks {
+		list = append(list, v.copy())
+	}
+	return list, nil
+}
+
+func (s *fileStore) Get(id string) (*Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if hook, ok := s.webhooks[id]; ok {
+		return hook.copy(), nil
+	}
+	return nil, nil
+}
+
+func (s *fileStore) Create(webhook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.webhooks[webhook.Id]; ok {
+		return ErrExists
+	}
+	return s.put(webhook)
+}
+
+func (s *fileStore) Save(webhook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.put(webhook)
+}
+
+// put adds or replaces a webhook and writes the file, restoring the previous
+// state if that fails. It must be called with mu held.
+func (s *fileStore) put(webhook *Webhook) error {
+	previous, existed := s.webhooks[webhook.Id]
+	s.webhooks[webhook.Id] = webhook.copy()
+
+	if err := s.write(); err != nil {
+		if existed {
+			s.webhooks[webhook.Id] = previous
+		} else {
+			delete(s.webhooks, webhook.Id)
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.webhooks[id]
+	if !existed {
+		return nil
+	}
+	delete(s.webhooks, id)
+
+	if err := s.write(); err != nil {
+		s.webhooks[id] = previous
+		return err
+	}
+	return nil
+}
+
+// write replaces the file atomically by writing to a temporary file in the
+// same directory and renaming it.
+func (s *fileStore) write() error {
+	records := make([]json.RawMessage, 0, len(s.webhooks))
+	for _, wh := range s.webhooks {
+		record, err := encodeWebhook(s.cipher, wh)
+		if err != nil {
+			return err
+		}
+		records = append(records, record)
+	}
+
+	b, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,96 @@
+package webhook
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// memoryStore keeps webhooks in process memory; they are lost on restart.
+//
+// Lookups happen on every proxied request while changes are rare, so reads
+// go lock free against an immutable snapshot of the map. Writers serialize
+// on mu and replace the snapshot with a modified copy.
+//
+// Webhooks are copied in and out of the store, so callers may modify the
+// webhooks they get without affecting other requests.
+type memoryStore struct {
+	mu       sync.Mutex
+	webhooks atomic.Value
+}
+
+func NewMemoryStore() *memoryStore {
+	s := &memoryStore{}
+	s.webhooks.Store(map[string]*Webhook{})
+	return s
+}
+
+func (s *memoryStore) snapshot() map[string]*Webhook {
+	return s.webhooks.Load().(map[string]*Webhook)
+}
+
+// update replaces the snapshot with a copy modified by fn. It must be called
+// with mu held.
+func (s *memoryStore) update(fn func(webhooks map[string]*Webhook)) {
+	current := s.snapshot()
+	next := make(map[string]*Webhook, len(current)+1)
+	for k, v := range current {
+		next[k] = v
+	}
+	fn(next)
+	s.webhooks.Store(next)
+}
+
+func (s *memoryStore) List() ([]*Webhook, error) {
+	webhooks := s.snapshot()
+	list := make([]*Webhook, 0, len(webhooks))
+	for _, v := range webhooks {
+		list = append(list, v.copy())
+	}
+	return list, nil
+}
+
+func (s *memoryStore) Get(id string) (*Webhook, error) {
+	if hook, ok := s.snapshot()[id]; !ok {
+		return nil, nil
+	} else {
+		return hook.copy(), nil
+	}
+}
+
+func (s *memoryStore) Create(webhook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshot()[webhook.Id]; ok {
+		return ErrExists
+	}
+
+	s.update(func(webhooks map[string]*Webhook) {
+		webhooks[webhook.Id] = webhook.copy()
+	})
+	return nil
+}
+
+func (s *memoryStore) Save(webhook *Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.update(func(webhooks map[string]*Webhook) {
+		webhooks[webhook.Id] = webhook.copy()
+	})
+	return nil
+}
+
+func (s *memoryStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.snapshot()[id]; !ok {
+		return nil
+	}
+
+	s.update(func(webhooks map[string]*Webhook) {
+		delete(webhooks, id)
+	})
+	return nil
+}
@@ -0,0 +1,49 @@
+package webhook
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+// SecretCipher encrypts webhook secrets before they are written to a durable
+// store. Secrets are sealed with AES-GCM, using the webhook id as additional
+// data so an encrypted secret cannot be moved to another webhook.
+type SecretCipher struct {
+	aead cipher.AEAD
+}
+
+// NewSecretCipher creates a cipher from a 16, 24 or 32 byte AES key.
+func NewSecretCipher(key []byte) (*SecretCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SecretCipher{aead}, nil
+}
+
+func (c *SecretCipher) Encrypt(id string, secret []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return c.aead.Seal(nonce, nonce, secret, []byte(id)), nil
+}
+
+func (c *SecretCipher) Decrypt(id string, encrypted []byte) ([]byte, error) {
+	nonceSize := c.aead.NonceSize()
+	if len(encrypted) < nonceSize {
+		return nil, fmt.Errorf("encrypted secret is too short")
+	}
+
+	return c.aead.Open(nil, encrypted[:nonceSize], encrypted[nonceSize:], []byte(id))
+}
@@ -0,0 +1,44 @@
+package webhook
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretCipher(t *testing.T) {
+	cipher, err := NewSecretCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("NewSecretCipher() error = %v", err)
+	}
+
+	t.Run("Encrypted secret should decrypt to original", func(t *testing.T) {
+		encrypted, err := cipher.Encrypt("hook-id", []byte("foobar"))
+		if err != nil {
+			t.Errorf("Encrypt() error = %v", err)
+			return
+		}
+
+		got, err := cipher.Decrypt("hook-id", encrypted)
+		if err != nil {
+			t.Errorf("Decrypt() error = %v", err)
+			return
+		}
+		if !bytes.Equal(got, []byte("foobar")) {
+			t.Errorf("Decrypt() = %s, want foobar", got)
+		}
+	})
+
+	t.Run("Secret encrypted for another webhook should fail", func(t *testing.T) {
+		encrypted, _ := cipher.Encrypt("hook-id", []byte("foobar"))
+
+		if _, err := cipher.Decrypt("other-hook-id", encrypted); err == nil {
+			t.Errorf("Decrypt() should fail for another webhook id")
+		}
+	})
+
+	t.Run("Invalid key size should fail", func(t *testing.T) {
+		if _, err := NewSecretCipher([]byte("too-short")); err == nil {
+			t.Errorf("NewSecretCipher() should fail for invalid key size")
+		}
+	})
+}
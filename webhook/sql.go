@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"database/sql"
+	"github.com/navikt/webhookproxy/migrate"
+)
+
+// migrations for the webhooks table. The webhook itself is stored as JSON in
+// data so new fields do not need a migration.
+var migrations = []string{
+	`CREATE TABLE webhooks (
+		id VARCHAR(40) PRIMARY KEY,
+		team VARCHAR(255) NOT NULL,
+		name VARCHAR(255) NOT NULL,
+		data TEXT NOT NULL
+	)`,
+}
+
+// sqlStore keeps webhooks in a SQL database shared by all replicas. The
+// queries are written for PostgreSQL and also run on SQLite. Secrets are
+// encrypted before they are written.
+type sqlStore struct {
+	db     *sql.DB
+	cipher *SecretCipher
+}
+
+// NewSQLStore creates a store on db, migrating the schema if needed.
+func NewSQLStore(db *sql.DB, cipher *SecretCipher) (*sqlStore, error) {
+	if err := migrate.Run(db, "webhooks", migrations); err != nil {
+		return nil, err
+	}
+
+	return &sqlStore{db, cipher}, nil
+}
+
+func (s *sqlStore) List() ([]*Webhook, error) {
+	rows, err := s.db.Query(`SELECT data FROM webhooks ORDER BY team, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]*Webhook, 0)
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+
+		wh, err := decodeWebhook(s.cipher, []byte(data))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, wh)
+	}
+
+	return list, rows.Err()
+}
+
+func (s *sqlStore) Get(id string) (*Webhook, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM webhooks WHERE id = $1`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeWebhook(s.cipher, []byte(data))
+}
+
+func (s *sqlStore) Create(webhook *Webhook) error {
+	data, err := encodeWebhook(s.cipher, webhook)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.Exec(`INSERT INTO webhooks (id, team, name, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO NOTHING`,
+		webhook.Id, webhook.Team, webhook.Name, string(data))
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+func (s *sqlStore) Save(webhook *Webhook) error {
+	data, err := encodeWebhook(s.cipher, webhook)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.Exec(`INSERT INTO webhooks (id, team, name, data) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET team = excluded.team, name = excluded.name, data = excluded.data`,
+		webhook.Id, webhook.Team, webhook.Name, string(data))
+	return err
+}
+
+func (s *sqlStore) Delete(id string) error {
+	_, err := s.db.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+	return err
+}
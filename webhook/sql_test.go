@@ -0,0 +1,81 @@
+package webhook
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestSQLStore(t *testing.T, db *sql.DB) *sqlStore {
+	cipher, _ := NewSecretCipher([]byte("0123456789abcdef0123456789abcdef"))
+	s, err := NewSQLStore(db, cipher)
+	if err != nil {
+		t.Fatalf("NewSQLStore() error = %v", err)
+	}
+	return s
+}
+
+func TestSQLStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	s := openTestSQLStore(t, db)
+
+	testStore(t, s)
+
+	t.Run("Saving an existing webhook should update it", func(t *testing.T) {
+		want := newTestWebhook("my-updated-hook")
+		s.Save(want)
+
+		want.Url = "http://other-server.tld/hook"
+		if err := s.Save(want); err != nil {
+			t.Errorf("Save() error = %v", err)
+			return
+		}
+
+		got, _ := s.Get(want.Id)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get() = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Secret should not be stored in plain text", func(t *testing.T) {
+		wh := newTestWebhook("my-secret-hook")
+		wh.Secret = []byte("very-secret-value")
+		if err := s.Save(wh); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+
+		var data string
+		db.QueryRow(`SELECT data FROM webhooks WHERE id = $1`, wh.Id).Scan(&data)
+		var record storedWebhook
+		json.Unmarshal([]byte(data), &record)
+		if len(record.Secret) == 0 || bytes.Contains(record.Secret, wh.Secret) {
+			t.Errorf("stored secret = %q, want it encrypted", record.Secret)
+		}
+	})
+
+	t.Run("Second replica should see webhooks and not migrate again", func(t *testing.T) {
+		want := newTestWebhook("my-shared-hook")
+		s.Save(want)
+
+		replica := openTestSQLStore(t, db)
+
+		got, err := replica.Get(want.Id)
+		if err != nil {
+			t.Errorf("Get() error = %v", err)
+			return
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Get() = %v, want %v", got, want)
+		}
+	})
+}
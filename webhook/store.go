@@ -0,0 +1,142 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/navikt/webhookproxy/destination"
+	"github.com/navikt/webhookproxy/errors"
+	"net/http"
+)
+
+// Store persists webhook registrations. Get returns nil and no error when
+// the webhook does not exist. Create fails with ErrExists if a webhook with
+// the same id exists, while Save adds or replaces it. Stores must be safe for
+// concurrent use.
+type Store interface {
+	List() ([]*Webhook, error)
+	Get(id string) (*Webhook, error)
+	Create(webhook *Webhook) error
+	Save(webhook *Webhook) error
+	Delete(id string) error
+}
+
+var ErrExists = errors.NewAppError(http.StatusConflict, "webhook already exists")
+
+// storedWebhook is the persisted representation of a webhook. Unlike the API
+// representation it includes the secrets.
+type storedWebhook struct {
+	*Webhook
+	Secret         []byte            `json:"secret"`
+	SigningSecrets map[string][]byte `json:"signing_secrets,omitempty"`
+	ClientKey      []byte            `json:"client_key,omitempty"`
+}
+
+// encodeWebhook serializes a webhook for a durable store, encrypting the
+// secrets.
+func encodeWebhook(cipher *SecretCipher, webhook *Webhook) ([]byte, error) {
+	secret, err := cipher.Encrypt(webhook.Id, webhook.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	var signingSecrets map[string][]byte
+	for name, signingSecret := range webhook.SigningSecrets {
+		if signingSecrets == nil {
+			signingSecrets = map[string][]byte{}
+		}
+		// bound to the target as well, so secrets cannot be swapped
+		// between targets
+		if signingSecrets[name], err = cipher.Encrypt(webhook.Id+"/"+name, signingSecret); err != nil {
+			return nil, err
+		}
+	}
+
+	var clientKey []byte
+	if webhook.ClientKey != nil {
+		if clientKey, err = cipher.Encrypt(webhook.Id+"/client_key", webhook.ClientKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(storedWebhook{webhook, secret, signingSecrets, clientKey})
+}
+
+func decodeWebhook(cipher *SecretCipher, v []byte) (*Webhook, error) {
+	var record storedWebhook
+	if err := json.Unmarshal(v, &record); err != nil {
+		return nil, err
+	}
+
+	secret, err := cipher.Decrypt(record.Id, record.Secret)
+	if err != nil {
+		return nil, err
+	}
+
+	record.Webhook.Secret = secret
+	record.Webhook.sourceNetworks = parseSourceRanges(record.Webhook.SourceRanges)
+
+	for name, encrypted := range record.SigningSecrets {
+		signingSecret, err := cipher.Decrypt(record.Id+"/"+name, encrypted)
+		if err != nil {
+			return nil, err
+		}
+		if record.Webhook.SigningSecrets == nil {
+			record.Webhook.SigningSecrets = map[string][]byte{}
+		}
+		record.Webhook.SigningSecrets[name] = signingSecret
+	}
+
+	if record.ClientKey != nil {
+		if record.Webhook.ClientKey, err = cipher.Decrypt(record.Id+"/client_key", record.ClientKey); err != nil {
+			return nil, err
+		}
+	}
+	return record.Webhook, nil
+}
+
+var store Store = NewMemoryStore()
+
+// UseStore sets the store used by the package level functions. It should be
+// called once at startup, before the server starts handling requests.
+func UseStore(s Store) {
+	store = s
+}
+
+var destinations = destination.DefaultPolicy()
+
+// UseDestinationPolicy sets the policy the urls of new webhooks are checked
+// against. Like UseStore it should be called once at startup.
+func UseDestinationPolicy(p *destination.Policy) {
+	destinations = p
+}
+
+// DestinationPolicy returns the policy the urls of new webhooks are checked
+// against, for forwarding to check the addresses dialed too.
+func DestinationPolicy() *destination.Policy {
+	return destinations
+}
+
+func List() ([]*Webhook, error) {
+	return store.List()
+}
+
+func Get(id string) (*Webhook, error) {
+	return store.Get(id)
+}
+
+func Create(webhook *Webhook) (*Webhook, error) {
+	if err := store.Create(webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func Save(webhook *Webhook) (*Webhook, error) {
+	if err := store.Save(webhook); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func Delete(id string) error {
+	return store.Delete(id)
+}
@@ -1,10 +1,22 @@
 package webhook
 
 import (
-	"fmt"
 	"time"
 	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"github.com/navikt/webhookproxy/breaker"
+	"github.com/navikt/webhookproxy/errors"
+	"github.com/navikt/webhookproxy/ratelimit"
+	"github.com/navikt/webhookproxy/rules"
+	"github.com/navikt/webhookproxy/transform"
 )
 
 type CreateWebhookRequest struct {
@@ -12,8 +24,164 @@ type CreateWebhookRequest struct {
 	Team   string `json:"team"`
 	Url    string `json:"url"`
 	Secret []byte `json:"secret"`
+	// RequireSHA256 refuses deliveries signed with SHA-1 only.
+	RequireSHA256 bool `json:"require_sha256,omitempty"`
+	// Provider is the service sending deliveries, GitHub if empty.
+	Provider string `json:"provider,omitempty"`
+	// SignatureTolerance is how old a timestamped signature may be, in
+	// seconds. Used for Slack and Stripe.
+	SignatureTolerance int `json:"signature_tolerance,omitempty"`
+	// Async acknowledges deliveries right away and forwards them from a
+	// queue, retrying failed forwards.
+	Async bool `json:"async,omitempty"`
+	// Retry configures retries of async deliveries, defaults if nil.
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// Targets replace Url, Async and Retry when deliveries are forwarded to
+	// more than one url.
+	Targets []Target `json:"targets,omitempty"`
+	// Response is the response strategy, ResponsePrimary if empty.
+	Response string `json:"response,omitempty"`
+	// Events selects the events that are forwarded, all if nil.
+	Events *EventFilter `json:"events,omitempty"`
+	// Rules route deliveries to some of the targets, or drop them, based
+	// on the payload. The first matching rule applies, and deliveries
+	// matching none are forwarded to all targets.
+	Rules []rules.Rule `json:"rules,omitempty"`
+	// Transform rewrites payloads before they are forwarded, which are
+	// forwarded as received if nil.
+	Transform *transform.Transform `json:"transform,omitempty"`
+	// Headers decides which headers of received deliveries are forwarded,
+	// the default allowlist if nil.
+	Headers *HeaderPolicy `json:"headers,omitempty"`
+	// SigningSecret re-signs the deliveries forwarded to Url. It is
+	// separate from Secret, which is shared with the sender.
+	SigningSecret []byte `json:"signing_secret,omitempty"`
+	// SigningSecrets re-sign the deliveries forwarded to targets, by
+	// target name.
+	SigningSecrets map[string][]byte `json:"signing_secrets,omitempty"`
+	// SourceRanges are the address ranges deliveries are accepted from, in
+	// CIDR notation. They replace GitHub's hook ranges, and are needed to
+	// check the sources of other providers.
+	SourceRanges []string `json:"source_ranges,omitempty"`
+	// RateLimit limits how often deliveries are forwarded, replacing the
+	// default limit of webhooks.
+	RateLimit *ratelimit.Limit `json:"rate_limit,omitempty"`
+	// CircuitBreaker configures the circuits of the targets, defaults if
+	// nil.
+	CircuitBreaker *breaker.Settings `json:"circuit_breaker,omitempty"`
+	// Client configures the client deliveries are forwarded with, the
+	// default client if nil.
+	Client *ClientSettings `json:"client,omitempty"`
+	// ClientKey is the PEM encoded private key of the client certificate.
+	ClientKey []byte `json:"client_key,omitempty"`
+}
+
+// MaxClientTimeout is the longest timeout in seconds webhooks may set. The
+// dispatcher leases queued deliveries for longer than this, so a slow
+// forward is not claimed and forwarded twice.
+const MaxClientTimeout = 30
+
+// ClientSettings configure the client deliveries to the targets of a webhook
+// are forwarded with. The key of the client certificate is given separately,
+// as it is never shown.
+type ClientSettings struct {
+	// Timeout is how many seconds a forward may take, 5 if unset and at
+	// most MaxClientTimeout.
+	Timeout int `json:"timeout,omitempty"`
+	// CA holds PEM encoded certificate authorities trusted for the
+	// targets, in addition to the system ones.
+	CA string `json:"ca,omitempty"`
+	// Certificate is the PEM encoded client certificate presented to
+	// targets asking for one.
+	Certificate string `json:"certificate,omitempty"`
+	// Proxy is the url of an HTTP proxy deliveries are forwarded through.
+	Proxy string `json:"proxy,omitempty"`
+}
+
+// HeaderPolicy decides which headers of received deliveries are forwarded.
+// Allow replaces the default allowlist when given. Headers in Strip are never
+// forwarded, and neither are signatures and tokens if StripSensitive is set.
+type HeaderPolicy struct {
+	Allow          []string `json:"allow,omitempty"`
+	Strip          []string `json:"strip,omitempty"`
+	StripSensitive bool     `json:"strip_sensitive,omitempty"`
+}
+
+// EventFilter selects events by type, or by type and action joined by a dot
+// like pull_request.opened. Patterns may contain the wildcards of
+// path.Match. An event is forwarded if it matches a pattern in Allow, or
+// Allow is empty, and matches no pattern in Deny.
+type EventFilter struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Target is an url deliveries to a webhook are forwarded to, with its own
+// options. The name identifies the target in outcomes and the history.
+type Target struct {
+	Name  string       `json:"name,omitempty"`
+	Url   string       `json:"url"`
+	Async bool         `json:"async,omitempty"`
+	Retry *RetryPolicy `json:"retry,omitempty"`
+}
+
+// Response strategies, deciding what a delivery is answered with when it is
+// forwarded to several targets.
+const (
+	// ResponsePrimary answers with the response of the first target.
+	ResponsePrimary = "primary"
+	// ResponseAll answers with an error unless all targets succeed.
+	ResponseAll = "all"
+	// ResponseAccepted always answers 202 Accepted.
+	ResponseAccepted = "accepted"
+)
+
+var responseStrategies = map[string]bool{
+	"":               true,
+	ResponsePrimary:  true,
+	ResponseAll:      true,
+	ResponseAccepted: true,
+}
+
+// RetryPolicy configures how failed async deliveries are retried. The wait
+// before a retry starts at InitialBackoff and doubles after every attempt up
+// to MaxBackoff, varied randomly by the Jitter fraction. Zero values use the
+// defaults, except for Jitter which is only defaulted when unset, so it can
+// be turned off with 0.
+type RetryPolicy struct {
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// InitialBackoff and MaxBackoff are in seconds.
+	InitialBackoff int `json:"initial_backoff,omitempty"`
+	MaxBackoff int `json:"max_backoff,omitempty"`
+	Jitter *float64 `json:"jitter,omitempty"`
 }
 
+// Providers webhooks can receive deliveries from.
+const (
+	ProviderGitHub    = "github"
+	ProviderGitLab    = "gitlab"
+	ProviderBitbucket = "bitbucket"
+	ProviderGitea     = "gitea"
+	ProviderSlack     = "slack"
+	ProviderStripe    = "stripe"
+)
+
+var providers = map[string]bool{
+	"":                true,
+	ProviderGitHub:    true,
+	ProviderGitLab:    true,
+	ProviderBitbucket: true,
+	ProviderGitea:     true,
+	ProviderSlack:     true,
+	ProviderStripe:    true,
+}
+
+// Sources a webhook can be registered from.
+const (
+	SourceAPI  = "api"
+	SourceFile = "file"
+)
+
 type Webhook struct {
 	Id       string `json:"id"`
 	Name     string `json:"name"`
@@ -22,20 +190,177 @@ type Webhook struct {
 	Secret   []byte `json:"-"`
 	ProxyUrl string `json:"proxy_url"`
 	CreatedAt time.Time `json:"created_at"`
+	Source   string `json:"source"`
+	RequireSHA256 bool `json:"require_sha256,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	SignatureTolerance int `json:"signature_tolerance,omitempty"`
+	Async bool `json:"async,omitempty"`
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	Targets []Target `json:"targets,omitempty"`
+	Response string `json:"response,omitempty"`
+	Events *EventFilter `json:"events,omitempty"`
+	Rules []rules.Rule `json:"rules,omitempty"`
+	Transform *transform.Transform `json:"transform,omitempty"`
+	Headers *HeaderPolicy `json:"headers,omitempty"`
+	// SigningSecrets are never shown, like Secret. The unnamed target of a
+	// webhook without targets has its secret under the empty name.
+	SigningSecrets map[string][]byte `json:"-"`
+	SourceRanges []string `json:"source_ranges,omitempty"`
+	RateLimit *ratelimit.Limit `json:"rate_limit,omitempty"`
+	CircuitBreaker *breaker.Settings `json:"circuit_breaker,omitempty"`
+	Client *ClientSettings `json:"client,omitempty"`
+	// ClientKey is never shown, like Secret.
+	ClientKey []byte `json:"-"`
+	// sourceNetworks are the parsed SourceRanges, set by FromRequest and
+	// the stores so deliveries are not checked against ranges parsed anew.
+	sourceNetworks []*net.IPNet
+}
+
+// AllTargets returns the targets deliveries are forwarded to. A webhook
+// without targets has a single unnamed target made of its url, async and
+// retry.
+func (w *Webhook) AllTargets() []Target {
+	if len(w.Targets) == 0 {
+		return []Target{{Url: w.Url, Async: w.Async, Retry: w.Retry}}
+	}
+	return w.Targets
 }
 
-var webhooks = map[string]*Webhook{}
+// Target returns the target with the given name, or nil if there is none.
+func (w *Webhook) Target(name string) *Target {
+	for _, target := range w.AllTargets() {
+		if target.Name == name {
+			return &target
+		}
+	}
+	return nil
+}
+
+// SigningSecret returns the secret deliveries to the named target are
+// signed with, or nil if they are not signed.
+func (w *Webhook) SigningSecret(target string) []byte {
+	return w.SigningSecrets[target]
+}
+
+// TargetsNamed returns the targets with the given names.
+func (w *Webhook) TargetsNamed(names []string) []Target {
+	var targets []Target
+	for _, name := range names {
+		if target := w.Target(name); target != nil {
+			targets = append(targets, *target)
+		}
+	}
+	return targets
+}
 
-func List() []*Webhook {
-	//var list []*Webhook
-	list := make([]*Webhook, 0)
-	for _, v := range webhooks {
-		list = append(list, v)
+// SourceNetworks returns the parsed SourceRanges. The ranges of webhooks not
+// built by FromRequest or read from a store are parsed on every call.
+func (w *Webhook) SourceNetworks() []*net.IPNet {
+	if w.sourceNetworks == nil && len(w.SourceRanges) > 0 {
+		return parseSourceRanges(w.SourceRanges)
 	}
-	return list
+	return w.sourceNetworks
 }
 
-func Lookup(team string, name string) *Webhook {
+// parseSourceRanges parses ranges validated by FromRequest, skipping any
+// that are invalid.
+func parseSourceRanges(cidrs []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	return networks
+}
+
+// IsFileManaged reports whether the webhook is defined in a file and managed
+// by the reconciler rather than through the API.
+func (w *Webhook) IsFileManaged() bool {
+	return w.Source == SourceFile
+}
+
+// copy returns a copy of the webhook that shares no mutable fields other
+// than the secrets, which are never modified in place.
+func (w *Webhook) copy() *Webhook {
+	c := *w
+	c.Retry = w.Retry.copy()
+	if w.Targets != nil {
+		c.Targets = make([]Target, len(w.Targets))
+		for i, target := range w.Targets {
+			target.Retry = target.Retry.copy()
+			c.Targets[i] = target
+		}
+	}
+	if w.Events != nil {
+		c.Events = &EventFilter{
+			Allow: append([]string(nil), w.Events.Allow...),
+			Deny: append([]string(nil), w.Events.Deny...),
+		}
+	}
+	if w.Rules != nil {
+		c.Rules = make([]rules.Rule, len(w.Rules))
+		for i, rule := range w.Rules {
+			rule.When = append([]rules.Condition(nil), rule.When...)
+			rule.Targets = append([]string(nil), rule.Targets...)
+			c.Rules[i] = rule
+		}
+	}
+	if w.Transform != nil {
+		t := *w.Transform
+		if w.Transform.Headers != nil {
+			t.Headers = make(map[string]string, len(w.Transform.Headers))
+			for name, value := range w.Transform.Headers {
+				t.Headers[name] = value
+			}
+		}
+		c.Transform = &t
+	}
+	if w.Headers != nil {
+		c.Headers = &HeaderPolicy{
+			Allow: append([]string(nil), w.Headers.Allow...),
+			Strip: append([]string(nil), w.Headers.Strip...),
+			StripSensitive: w.Headers.StripSensitive,
+		}
+	}
+	if w.SourceRanges != nil {
+		c.SourceRanges = append([]string(nil), w.SourceRanges...)
+		c.sourceNetworks = append([]*net.IPNet(nil), w.sourceNetworks...)
+	}
+	if w.RateLimit != nil {
+		l := *w.RateLimit
+		c.RateLimit = &l
+	}
+	if w.CircuitBreaker != nil {
+		b := *w.CircuitBreaker
+		c.CircuitBreaker = &b
+	}
+	if w.Client != nil {
+		client := *w.Client
+		c.Client = &client
+	}
+	if w.SigningSecrets != nil {
+		c.SigningSecrets = make(map[string][]byte, len(w.SigningSecrets))
+		for name, secret := range w.SigningSecrets {
+			c.SigningSecrets[name] = secret
+		}
+	}
+	return &c
+}
+
+func (p *RetryPolicy) copy() *RetryPolicy {
+	if p == nil {
+		return nil
+	}
+	c := *p
+	if p.Jitter != nil {
+		jitter := *p.Jitter
+		c.Jitter = &jitter
+	}
+	return &c
+}
+
+func Lookup(team string, name string) (*Webhook, error) {
 	return Get(getId(team, name))
 }
 
@@ -47,38 +372,265 @@ func getId(team string, name string) string {
 }
 
 func New(request CreateWebhookRequest) (*Webhook, error) {
-	id := getId(request.Team, request.Name)
+	webhook, err := FromRequest(request, SourceAPI)
+	if err != nil {
+		return nil, err
+	}
+
+	return Create(webhook)
+}
+
+// FromRequest validates request and builds the webhook it describes without
+// saving it.
+func FromRequest(request CreateWebhookRequest, source string) (*Webhook, error) {
+	if request.Name == "" || request.Team == "" || (request.Url == "" && len(request.Targets) == 0) {
+		return nil, errors.NewAppError(http.StatusBadRequest, "name, team and url are required")
+	}
+
+	if !providers[request.Provider] {
+		return nil, errors.NewAppError(http.StatusBadRequest, "unknown provider: " + request.Provider)
+	}
+
+	if request.SignatureTolerance < 0 {
+		return nil, errors.NewAppError(http.StatusBadRequest, "signature_tolerance must not be negative")
+	}
+
+	if err := validateRetry(request.Retry); err != nil {
+		return nil, err
+	}
+
+	if err := validateTargets(request); err != nil {
+		return nil, err
+	}
+
+	if !responseStrategies[request.Response] {
+		return nil, errors.NewAppError(http.StatusBadRequest, "unknown response strategy: " + request.Response)
+	}
+
+	if err := validateEvents(request.Events); err != nil {
+		return nil, err
+	}
+
+	if err := validateRules(request); err != nil {
+		return nil, err
+	}
+
+	if err := transform.Validate(request.Transform); err != nil {
+		return nil, errors.NewAppError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateHeaders(request.Headers); err != nil {
+		return nil, err
+	}
+
+	if err := ratelimit.Validate(request.RateLimit); err != nil {
+		return nil, errors.NewAppError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := breaker.Validate(request.CircuitBreaker); err != nil {
+		return nil, errors.NewAppError(http.StatusBadRequest, err.Error())
+	}
+
+	if err := validateClient(request.Client, request.ClientKey); err != nil {
+		return nil, err
+	}
 
-	if Get(id) != nil {
-		return nil, fmt.Errorf("webhook already exists")
+	secrets, err := signingSecrets(request)
+	if err != nil {
+		return nil, err
 	}
 
-	webhook := &Webhook{
-		Id: id,
+	urls := []string{request.Url}
+	for _, target := range request.Targets {
+		urls = append(urls, target.Url)
+	}
+	for _, u := range urls {
+		if u == "" {
+			continue
+		}
+		if err := destinations.CheckURL(u); err != nil {
+			return nil, errors.NewAppError(http.StatusBadRequest, "url not allowed: " + err.Error())
+		}
+	}
+
+	var sourceNetworks []*net.IPNet
+	for _, cidr := range request.SourceRanges {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.NewAppError(http.StatusBadRequest, "invalid source range: " + cidr)
+		}
+		sourceNetworks = append(sourceNetworks, network)
+	}
+
+	return &Webhook{
+		Id: getId(request.Team, request.Name),
 		Name: request.Name,
 		Team: request.Team,
 		Url: request.Url,
 		Secret: request.Secret,
 		CreatedAt: time.Now(),
+		Source: source,
+		RequireSHA256: request.RequireSHA256,
+		Provider: request.Provider,
+		SignatureTolerance: request.SignatureTolerance,
+		Async: request.Async,
+		Retry: request.Retry,
+		Targets: request.Targets,
+		Response: request.Response,
+		Events: request.Events,
+		Rules: request.Rules,
+		Transform: request.Transform,
+		Headers: request.Headers,
+		SigningSecrets: secrets,
+		SourceRanges: request.SourceRanges,
+		RateLimit: request.RateLimit,
+		CircuitBreaker: request.CircuitBreaker,
+		Client: request.Client,
+		ClientKey: request.ClientKey,
+		sourceNetworks: sourceNetworks,
+	}, nil
+}
+
+func validateEvents(filter *EventFilter) error {
+	if filter == nil {
+		return nil
 	}
 
-	return Save(webhook)
+	for _, pattern := range append(append([]string(nil), filter.Allow...), filter.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return errors.NewAppError(http.StatusBadRequest, "invalid event pattern: " + pattern)
+		}
+	}
+	return nil
 }
 
-func Save(webhook *Webhook) (*Webhook, error) {
-	webhooks[webhook.Id] = webhook
-	return webhook, nil
+func validateRules(request CreateWebhookRequest) error {
+	if err := rules.Validate(request.Rules); err != nil {
+		return errors.NewAppError(http.StatusBadRequest, err.Error())
+	}
+
+	for i, rule := range request.Rules {
+		for _, name := range rule.Targets {
+			if !hasTarget(request.Targets, name) {
+				return errors.NewAppError(http.StatusBadRequest, fmt.Sprintf("rule %d: unknown target: %v", i+1, name))
+			}
+		}
+	}
+	return nil
 }
 
-func Get(id string) *Webhook {
-	if hook, ok := webhooks[id]; !ok {
-		return nil;
-	} else {
-		return hook
+func hasTarget(targets []Target, name string) bool {
+	for _, target := range targets {
+		if target.Name == name {
+			return true
+		}
 	}
+	return false
 }
 
-func Delete(id string) error {
-	delete(webhooks, id)
+// signingSecrets returns the signing secrets of request by target name.
+func signingSecrets(request CreateWebhookRequest) (map[string][]byte, error) {
+	if request.SigningSecret != nil && len(request.Targets) > 0 {
+		return nil, errors.NewAppError(http.StatusBadRequest, "signing_secret is set per target in signing_secrets when targets are given")
+	}
+	if request.SigningSecret != nil {
+		request.SigningSecrets = map[string][]byte{"": request.SigningSecret}
+	}
+
+	for name, secret := range request.SigningSecrets {
+		if known := name == "" && len(request.Targets) == 0 || hasTarget(request.Targets, name); !known {
+			return nil, errors.NewAppError(http.StatusBadRequest, "signing secret for unknown target: " + name)
+		}
+		if len(secret) == 0 {
+			return nil, errors.NewAppError(http.StatusBadRequest, "signing secrets must not be empty")
+		}
+	}
+	return request.SigningSecrets, nil
+}
+
+func validateHeaders(policy *HeaderPolicy) error {
+	if policy == nil {
+		return nil
+	}
+
+	for _, name := range append(append([]string(nil), policy.Allow...), policy.Strip...) {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return errors.NewAppError(http.StatusBadRequest, "invalid header name: " + name)
+		}
+	}
+	return nil
+}
+
+func validateClient(client *ClientSettings, key []byte) error {
+	if client == nil {
+		client = &ClientSettings{}
+	}
+	if client.Timeout < 0 {
+		return errors.NewAppError(http.StatusBadRequest, "client timeout must not be negative")
+	}
+	if client.Timeout > MaxClientTimeout {
+		return errors.NewAppError(http.StatusBadRequest, fmt.Sprintf("client timeout must be at most %d seconds", MaxClientTimeout))
+	}
+
+	if client.CA != "" && !x509.NewCertPool().AppendCertsFromPEM([]byte(client.CA)) {
+		return errors.NewAppError(http.StatusBadRequest, "invalid client ca, must be PEM encoded certificates")
+	}
+
+	if (client.Certificate != "") != (len(key) > 0) {
+		return errors.NewAppError(http.StatusBadRequest, "client certificate and client_key must be given together")
+	}
+	if client.Certificate != "" {
+		if _, err := tls.X509KeyPair([]byte(client.Certificate), key); err != nil {
+			return errors.NewAppError(http.StatusBadRequest, "invalid client certificate: " + err.Error())
+		}
+	}
+
+	if client.Proxy != "" {
+		if u, err := url.Parse(client.Proxy); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.NewAppError(http.StatusBadRequest, "invalid client proxy: " + client.Proxy)
+		}
+		if err := destinations.CheckURL(client.Proxy); err != nil {
+			return errors.NewAppError(http.StatusBadRequest, "proxy not allowed: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func validateRetry(retry *RetryPolicy) error {
+	if retry == nil {
+		return nil
+	}
+	if retry.MaxAttempts < 0 || retry.InitialBackoff < 0 || retry.MaxBackoff < 0 {
+		return errors.NewAppError(http.StatusBadRequest, "retry settings must not be negative")
+	}
+	if retry.Jitter != nil && (*retry.Jitter < 0 || *retry.Jitter > 1) {
+		return errors.NewAppError(http.StatusBadRequest, "retry jitter must be between 0 and 1")
+	}
+	return nil
+}
+
+func validateTargets(request CreateWebhookRequest) error {
+	if len(request.Targets) == 0 {
+		return nil
+	}
+
+	if request.Url != "" || request.Async || request.Retry != nil {
+		return errors.NewAppError(http.StatusBadRequest, "url, async and retry are set per target when targets are given")
+	}
+
+	names := map[string]bool{}
+	for _, target := range request.Targets {
+		if target.Name == "" || target.Url == "" {
+			return errors.NewAppError(http.StatusBadRequest, "targets need a name and an url")
+		}
+		if names[target.Name] {
+			return errors.NewAppError(http.StatusBadRequest, "duplicate target: " + target.Name)
+		}
+		names[target.Name] = true
+
+		if err := validateRetry(target.Retry); err != nil {
+			return err
+		}
+	}
 	return nil
 }